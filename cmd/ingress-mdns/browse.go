@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/miekg/dns"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// browsedService is a DNS-SD service instance found on the network
+type browsedService struct {
+	Instance string
+	Target   string
+	Port     uint16
+	IPs      []string
+}
+
+// runBrowse browses the network for the DNS-SD service types of the hostnames and
+// checks whether the hostnames of the Ingresses in the cluster can be resolved
+func runBrowse(arguments docopt.Opts) {
+	config := configFromArguments(arguments)
+	filter, err := config.Filter()
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	timeoutValue, _ := arguments.String("--timeout")
+	timeout, err := time.ParseDuration(timeoutValue)
+	if err != nil {
+		log.Panicf("Invalid --timeout: %v", err)
+	}
+	ifaces := getBrowseInterfaces(arguments, config)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+	for _, serviceType := range []string{config.CleartextServiceType, config.TLSServiceType} {
+		services := browseServices(ifaces, serviceType, timeout)
+		fmt.Fprintf(out, "%v.local: %v instances\n", serviceType, len(services))
+		for _, service := range services {
+			fmt.Fprintf(out, "  %v\t%v:%v\t%v\n", service.Instance, service.Target, service.Port, strings.Join(service.IPs, ", "))
+		}
+	}
+
+	// Without access to a cluster only the browsed services can be listed
+	kubeConfigPath, _ := arguments.String("--kubeconfig")
+	kubeContext, _ := arguments.String("--context")
+	kubeConfig, err := getKubeConfig(kubeConfigPath, kubeContext)
+	if err != nil {
+		log.Warnf("Not comparing with the hostnames of the cluster: %v", err)
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	hostnames := map[string]bool{}
+	for _, namespace := range filter.WatchNamespaces() {
+		ingresses, err := clientset.NetworkingV1().Ingresses(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			log.Panicf("Unable to list ingresses: %v", err)
+		}
+		for i := range ingresses.Items {
+			ingress := &ingresses.Items[i]
+			data := controller.HostnameData{Namespace: ingress.Namespace, IngressName: ingress.Name, ClusterName: kubeContext}
+			for _, local := range controller.IngressHostnames(ingress, filter, false) {
+				hostnames[filter.Rename(local.Hostname, data)] = true
+			}
+		}
+	}
+	sorted := []string{}
+	for hostname := range hostnames {
+		sorted = append(sorted, hostname)
+	}
+	sort.Strings(sorted)
+	fmt.Fprintf(out, "Ingress hostnames: %v\n", len(sorted))
+	for _, hostname := range sorted {
+		ips := announce.Resolve(ifaces, hostname+".local.", timeout)
+		if len(ips) == 0 {
+			fmt.Fprintf(out, "  %v.local\tnot resolvable\t\n", hostname)
+			continue
+		}
+		fmt.Fprintf(out, "  %v.local\tresolvable\t%v\n", hostname, strings.Join(ips, ", "))
+	}
+}
+
+// getBrowseInterfaces returns the interfaces given with --interface, those of
+// the node when running in the pod or otherwise all multicast interfaces
+func getBrowseInterfaces(arguments docopt.Opts, config *controller.Config) []net.Interface {
+	if len(config.Interfaces) > 0 {
+		return getBroadcastInterfaces(config, nil)
+	}
+	if os.Getenv("NODE_NAME") != "" || os.Getenv("HOST_IP") != "" {
+		return getBroadcastInterfaces(config, getHostIPs(arguments))
+	}
+	ifaces := []net.Interface{}
+	all, err := net.Interfaces()
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+// browseServices queries the instances of the service type and resolves their targets
+func browseServices(ifaces []net.Interface, serviceType string, timeout time.Duration) []browsedService {
+	records := []dns.RR{}
+	for _, iface := range ifaces {
+		records = append(records, announce.Query(iface, []uint16{dns.TypePTR}, serviceType+".local.", timeout, false)...)
+	}
+	services := map[string]*browsedService{}
+	for _, record := range records {
+		if ptr, ok := record.(*dns.PTR); ok && services[ptr.Ptr] == nil {
+			services[ptr.Ptr] = &browsedService{Instance: strings.TrimSuffix(ptr.Ptr, ".")}
+		}
+	}
+	for _, record := range records {
+		if srv, ok := record.(*dns.SRV); ok && services[srv.Hdr.Name] != nil {
+			services[srv.Hdr.Name].Target = strings.TrimSuffix(srv.Target, ".")
+			services[srv.Hdr.Name].Port = srv.Port
+		}
+	}
+	result := []browsedService{}
+	for _, service := range services {
+		// Responders may leave out the address records, ask for them explicitly
+		if service.Target != "" {
+			service.IPs = announce.AddressesOf(records, service.Target+".")
+			if len(service.IPs) == 0 {
+				service.IPs = announce.Resolve(ifaces, service.Target+".", timeout)
+			}
+		}
+		result = append(result, *service)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Instance < result[j].Instance })
+	return result
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
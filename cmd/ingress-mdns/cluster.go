@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	k8snet "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// clusterConfig is a cluster whose hostnames are broadcast
+type clusterConfig struct {
+	// name is the kubeconfig context or --cluster-name, empty for the cluster the pod runs in
+	name       string
+	kubeConfig *rest.Config
+	// advertiseIPs override the address source for the hostnames of the cluster
+	advertiseIPs []net.IP
+}
+
+// cluster holds the controller and sources of a cluster
+type cluster struct {
+	name             string
+	kubeConfig       *rest.Config
+	clientset        kubernetes.Interface
+	ctrl             *controller.Controller
+	ingressSource    *controller.IngressSource
+	eventBroadcaster record.EventBroadcaster
+	// The cache of the manager of the cluster the sources read from
+	cache        *controller.Cache
+	resyncPeriod time.Duration
+}
+
+// getClusterConfigs returns the clusters given with --contexts, or the cluster
+// of --kubeconfig and --context when there are none
+func getClusterConfigs(arguments docopt.Opts) []clusterConfig {
+	kubeConfigPath, _ := arguments.String("--kubeconfig")
+	contexts, err := arguments.String("--contexts")
+	if err != nil {
+		context, _ := arguments.String("--context")
+		kubeConfig, err := getKubeConfig(kubeConfigPath, context)
+		if err != nil {
+			log.Panicf("Unable to load the kubeconfig: %v", err)
+		}
+		name, _ := arguments.String("--cluster-name")
+		return []clusterConfig{{name: name, kubeConfig: kubeConfig}}
+	}
+	if _, err := arguments.String("--cluster-name"); err == nil {
+		log.Panic("--cluster-name can not be combined with --contexts, the clusters are named after the contexts")
+	}
+	if _, err := arguments.String("--context"); err == nil {
+		log.Panic("--context can not be combined with --contexts")
+	}
+	configs := []clusterConfig{}
+	for _, value := range strings.Split(contexts, ",") {
+		config, err := parseContext(strings.TrimSpace(value), kubeConfigPath)
+		if err != nil {
+			log.Panicf("Invalid --contexts: %v", err)
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// getKubeConfig loads the context of the kubeconfig at the path or in $KUBECONFIG,
+// the current context when empty. Without either the service account of the pod
+// is used, falling back to ~/.kube/config outside of a cluster.
+func getKubeConfig(path string, context string) (*rest.Config, error) {
+	if path == "" && context == "" && os.Getenv("KUBECONFIG") == "" {
+		kubeConfig, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return kubeConfig, err
+		}
+		log.Debugf("Not running in a cluster, using the default kubeconfig")
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context})
+	return loader.ClientConfig()
+}
+
+// parseContext loads a context of the kubeconfig given as name or name=ip
+func parseContext(value string, kubeConfigPath string) (clusterConfig, error) {
+	parts := strings.SplitN(value, "=", 2)
+	config := clusterConfig{name: parts[0]}
+	if config.name == "" {
+		return config, fmt.Errorf("Empty context name in %q", value)
+	}
+	if len(parts) == 2 {
+		ip := net.ParseIP(parts[1])
+		if ip == nil {
+			return config, fmt.Errorf("Invalid IP %v of context %v", parts[1], config.name)
+		}
+		config.advertiseIPs = []net.IP{ip}
+	}
+	kubeConfig, err := getKubeConfig(kubeConfigPath, config.name)
+	if err != nil {
+		return config, fmt.Errorf("Unable to load context %v: %v", config.name, err)
+	}
+	config.kubeConfig = kubeConfig
+	return config, nil
+}
+
+// newCluster creates the controller and the sources enabled by the flags for the cluster
+func newCluster(
+	arguments docopt.Opts,
+	clusterConfig clusterConfig,
+	announcer announce.Announcer,
+	ifaces []net.Interface,
+	addresses announce.AddressSource,
+	config *controller.Config,
+	resyncPeriod time.Duration,
+) *cluster {
+	clientset, err := kubernetes.NewForConfig(clusterConfig.kubeConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	ctrl, err := controller.NewController(announcer, ifaces, config)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	ctrl.SetCluster(clusterConfig.name, clusterConfig.advertiseIPs)
+	if _, err := arguments.String("--cluster-name"); err == nil {
+		clusterNameOnly, _ := arguments.Bool("--cluster-name-only")
+		ctrl.SetClusterDomain(clusterNameOnly)
+	}
+	ctrl.SetAddressSource(addresses)
+	ingressAPI, err := getIngressAPI(clientset)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	c := &cluster{
+		name:             clusterConfig.name,
+		kubeConfig:       clusterConfig.kubeConfig,
+		clientset:        clientset,
+		ctrl:             ctrl,
+		eventBroadcaster: record.NewBroadcaster(),
+		cache:            controller.NewCache(ctrl.Filter().WatchNamespaces()),
+		resyncPeriod:     resyncPeriod,
+	}
+	c.cache.OnRelist(ctrl.Reconcile)
+	c.eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	ctrl.SetEventRecorder(c.eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "ingress-mdns"}))
+
+	c.ingressSource = controller.NewIngressSource(c.cache, clientset, ctrl)
+	if ingressAPI != k8snet.SchemeGroupVersion {
+		log.Infof("The cluster does not serve %v Ingresses, watching %v instead", k8snet.SchemeGroupVersion, ingressAPI)
+		c.ingressSource.SetIngressAPI(ingressAPI)
+	}
+	writeStatus, _ := arguments.Bool("--write-status")
+	c.ingressSource.SetWriteStatus(writeStatus)
+	if advertiseSource, _ := arguments.String("--advertise-source"); advertiseSource == "ingress-status" {
+		c.ingressSource.SetStatusAddresses(true)
+	}
+	if readyEndpoints, _ := arguments.Bool("--require-ready-endpoints"); readyEndpoints {
+		c.ingressSource.RequireReadyEndpoints()
+	}
+	if checkCertificates, _ := arguments.Bool("--check-certificates"); checkCertificates {
+		c.ingressSource.CheckCertificates()
+	}
+	ctrl.AddSource(c.ingressSource)
+
+	if gatewayAPI, _ := arguments.Bool("--gateway-api"); gatewayAPI {
+		ctrl.AddSource(controller.NewGatewaySource(c.cache, ctrl))
+	}
+	if istio, _ := arguments.Bool("--istio"); istio {
+		ctrl.AddSource(controller.NewIstioSource(c.cache, ctrl))
+	}
+	if traefik, _ := arguments.Bool("--traefik"); traefik {
+		group, _ := arguments.String("--traefik-group")
+		entryPoints := controller.TraefikEntryPoints{}
+		entryPoints.Cleartext, _ = arguments.String("--traefik-cleartext-entrypoint")
+		entryPoints.TLS, _ = arguments.String("--traefik-tls-entrypoint")
+		ctrl.AddSource(controller.NewTraefikSource(c.cache, ctrl, group, entryPoints))
+	}
+	if contour, _ := arguments.Bool("--contour"); contour {
+		ctrl.AddSource(controller.NewContourSource(c.cache, ctrl))
+	}
+	if dnsEndpoints, _ := arguments.Bool("--dns-endpoints"); dnsEndpoints {
+		ctrl.AddSource(controller.NewDNSEndpointSource(c.cache, ctrl))
+	}
+	if mdnsEntries, _ := arguments.Bool("--mdns-entries"); mdnsEntries {
+		ctrl.AddSource(controller.NewMDNSEntrySource(c.cache, ctrl))
+	}
+	if services, _ := arguments.Bool("--services"); services {
+		value, _ := arguments.String("--service-address")
+		address, err := controller.ParseServiceAddress(value)
+		if err != nil {
+			log.Panicf("Invalid --service-address: %v", err)
+		}
+		ctrl.AddSource(controller.NewServiceSource(c.cache, ctrl, address))
+	}
+	return c
+}
+
+// getIngressAPI returns the first of the Ingress APIs the cluster serves, clusters
+// older than Kubernetes 1.19 only serve the v1beta1 versions
+func getIngressAPI(clientset kubernetes.Interface) (schema.GroupVersion, error) {
+	for _, groupVersion := range controller.IngressAPIs {
+		resources, err := clientset.Discovery().ServerResourcesForGroupVersion(groupVersion.String())
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return groupVersion, fmt.Errorf("Unable to discover the Ingress API: %v", err)
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name == "ingresses" {
+				return groupVersion, nil
+			}
+		}
+	}
+	return schema.GroupVersion{}, fmt.Errorf("The cluster does not serve Ingresses in any of %v", controller.IngressAPIs)
+}
+
+// addReadinessChecks adds the initial sync of the resources watched by the sources to
+// the readiness probe of the manager, named after the resource prefixed with the cluster
+func (c *cluster) addReadinessChecks(mgr manager.Manager) {
+	for resource, synced := range c.cache.Synced() {
+		name := resource
+		if c.name != "" {
+			name = c.name + "-" + resource
+		}
+		check := whileLeading(mgr, readinessCheck(synced, fmt.Sprintf("%v not synced", name)))
+		if err := mgr.AddReadyzCheck(name, check); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+)
+
+// configFromArguments creates a Config from the command line flags
+func configFromArguments(arguments docopt.Opts) *controller.Config {
+	config := &controller.Config{
+		Namespaces:        arguments["--namespace"].([]string),
+		ExcludeNamespaces: arguments["--exclude-namespace"].([]string),
+		HostSuffixes:      arguments["--host-suffix"].([]string),
+		StripSuffix:       arguments["--strip-suffix"].([]string),
+		Interfaces:        arguments["--interface"].([]string),
+		WildcardNames:     arguments["--wildcard-name"].([]string),
+	}
+	config.CleartextPort, _ = arguments.Int("--cleartext-port")
+	config.TLSPort, _ = arguments.Int("--tls-port")
+	config.CleartextServiceType, _ = arguments.String("--cleartext-service-type")
+	config.TLSServiceType, _ = arguments.String("--tls-service-type")
+	config.IncludeSystemNamespaces, _ = arguments.Bool("--include-system-namespaces")
+	config.RequireAnnotation, _ = arguments.Bool("--require-annotation")
+	config.PublishMetadata, _ = arguments.Bool("--publish-metadata")
+	config.WildcardExpand, _ = arguments.String("--wildcard-expand")
+	config.Debounce, _ = arguments.String("--debounce")
+	config.HostnameTemplate, _ = arguments.String("--hostname-template")
+	config.SanitizeHostnames, _ = arguments.Bool("--sanitize-hostnames")
+	config.ConflictPolicy, _ = arguments.String("--conflict-policy")
+	if classPorts, err := arguments.String("--class-ports"); err == nil {
+		for _, value := range strings.Split(classPorts, ",") {
+			config.ClassPorts = append(config.ClassPorts, strings.TrimSpace(value))
+		}
+	}
+	config.Subnet, _ = arguments.String("--subnet")
+	config.AddressFamily, _ = arguments.String("--address-family")
+	config.Backend, _ = arguments.String("--backend")
+	config.TTL, _ = arguments.Int("--ttl")
+	config.PublishReverse, _ = arguments.Bool("--publish-reverse")
+	return config
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// Fields of the log entries reported as tags of the events, the other fields are
+// reported as extra data
+var sentryTags = map[string]bool{"hostname": true, "kind": true, "namespace": true, "name": true, "cluster": true, "resource": true}
+
+// sentryHook reports the logged errors and panics to the store endpoint of a Sentry project
+type sentryHook struct {
+	storeURL   string
+	auth       string
+	serverName string
+	client     *http.Client
+	// Errors waiting to be sent, errors are dropped while it is full
+	events chan map[string]interface{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// setupErrorReporting reports errors and panics to the Sentry project of the DSN,
+// the remaining errors are sent by flush
+func setupErrorReporting(dsn string) *sentryHook {
+	parsed, err := url.Parse(dsn)
+	if err != nil || parsed.User == nil || parsed.Host == "" {
+		log.Panicf("Invalid Sentry DSN %v", dsn)
+	}
+	path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	project := path[len(path)-1]
+	if project == "" {
+		log.Panicf("Invalid Sentry DSN %v without a project", dsn)
+	}
+	prefix := strings.Join(path[:len(path)-1], "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=ingress-mdns/%v, sentry_key=%v", version, parsed.User.Username())
+	if secret, exists := parsed.User.Password(); exists {
+		auth += ", sentry_secret=" + secret
+	}
+	serverName := os.Getenv("NODE_NAME")
+	if serverName == "" {
+		serverName, _ = os.Hostname()
+	}
+	hook := &sentryHook{
+		storeURL:   fmt.Sprintf("%v://%v%v/api/%v/store/", parsed.Scheme, parsed.Host, prefix, project),
+		auth:       auth,
+		serverName: serverName,
+		client:     &http.Client{Timeout: time.Second * 5},
+		events:     make(chan map[string]interface{}, 100),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	log.AddHook(hook)
+	// Panics recovered by the informers of client-go
+	utilruntime.PanicHandlers = append(utilruntime.PanicHandlers, hook.reportPanic)
+	go hook.run()
+	log.Debugf("Reporting errors to %v", hook.storeURL)
+	return hook
+}
+
+// goReportingPanics runs f in a goroutine whose panics are passed to the
+// utilruntime.PanicHandlers, and so reported, before the process crashes
+func goReportingPanics(f func()) {
+	go func() {
+		defer utilruntime.HandleCrash()
+		f()
+	}()
+}
+
+// flush sends the remaining errors, giving up after 5 seconds
+func (h *sentryHook) flush() {
+	close(h.stop)
+	select {
+	case <-h.done:
+	case <-time.After(time.Second * 5):
+		log.Warn("Unable to send the remaining errors")
+	}
+}
+
+// Levels returns the reported log levels
+func (h *sentryHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire reports the log entry, panics are sent right away since the process
+// usually exits with them
+func (h *sentryHook) Fire(entry *log.Entry) error {
+	level := entry.Level.String()
+	if entry.Level == log.PanicLevel {
+		level = "fatal"
+	}
+	event := h.event(level, entry.Message, entry.Time)
+	tags := event["tags"].(map[string]string)
+	extra := map[string]interface{}{}
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if sentryTags[key] {
+			tags[key] = fmt.Sprint(value)
+		} else {
+			extra[key] = value
+		}
+	}
+	event["extra"] = extra
+	if entry.Level <= log.FatalLevel {
+		h.send(event)
+		return nil
+	}
+	select {
+	case h.events <- event:
+	default:
+		// Dropped while the queue is full, logging that would report it again
+	}
+	return nil
+}
+
+// reportPanic sends a panic that was not logged before with the stack of the
+// panicking goroutine, panics of log.Panic are reported by Fire
+func (h *sentryHook) reportPanic(value interface{}) {
+	if _, logged := value.(*log.Entry); logged {
+		return
+	}
+	event := h.event("fatal", fmt.Sprintf("panic: %v", value), time.Now())
+	event["extra"] = map[string]interface{}{"stack": string(debug.Stack())}
+	h.send(event)
+}
+
+// event returns a Sentry event with the build metadata
+func (h *sentryHook) event(level string, message string, timestamp time.Time) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   timestamp.UTC().Format("2006-01-02T15:04:05"),
+		"level":       level,
+		"logger":      "ingress-mdns",
+		"platform":    "go",
+		"message":     message,
+		"release":     version,
+		"server_name": h.serverName,
+		"tags":        map[string]string{"commit": commit},
+	}
+}
+
+// run sends the queued errors until stop is closed, the errors queued by then are still sent
+func (h *sentryHook) run() {
+	defer close(h.done)
+	for {
+		select {
+		case event := <-h.events:
+			h.send(event)
+		case <-h.stop:
+			for {
+				select {
+				case event := <-h.events:
+					h.send(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts the event, failures are written to stderr since logging them
+// would report them again
+func (h *sentryHook) send(event map[string]interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode the error report: %v\n", err)
+		return
+	}
+	request, err := http.NewRequest(http.MethodPost, h.storeURL, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to report the error: %v\n", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Sentry-Auth", h.auth)
+	response, err := h.client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to report the error: %v\n", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "Unable to report the error: %v\n", response.Status)
+	}
+}
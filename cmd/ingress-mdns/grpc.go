@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/api"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// registrationsServer implements the gRPC API, the calls changing the registrations
+// are rejected unless admin is set and ad-hoc registrations unless adHoc is set too
+type registrationsServer struct {
+	api.UnimplementedRegistrationsServer
+	controllers []*controller.Controller
+	admin       bool
+	adHoc       *controller.AdHocRegistrations
+	announcer   announce.Announcer
+}
+
+// The calls of the gRPC API changing the registrations
+var writeMethods = map[string]bool{
+	"/ingressmdns.v1.Registrations/Register":   true,
+	"/ingressmdns.v1.Registrations/Unregister": true,
+	"/ingressmdns.v1.Registrations/Reannounce": true,
+}
+
+// serveGRPC serves the gRPC API on the given address, the calls changing the
+// registrations are only served on the admin address
+func serveGRPC(addr string, adminAddr string, mgr manager.Manager, controllers []*controller.Controller, adHoc *controller.AdHocRegistrations, announcer announce.Announcer) {
+	listenGRPC(addr, &registrationsServer{controllers: controllers, announcer: announcer}, nil)
+	server := &registrationsServer{controllers: controllers, admin: true, adHoc: adHoc, announcer: announcer}
+	listenGRPC(adminAddr, server, grpc.UnaryInterceptor(whileLeadingInterceptor(mgr)))
+}
+
+func listenGRPC(addr string, registrations *registrationsServer, option grpc.ServerOption) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Panicf("Unable to listen on %v: %v", addr, err)
+	}
+	options := []grpc.ServerOption{}
+	if option != nil {
+		options = append(options, option)
+	}
+	server := grpc.NewServer(options...)
+	api.RegisterRegistrationsServer(server, registrations)
+	log.Debugf("Serving gRPC on %v", addr)
+	goReportingPanics(func() {
+		if err := server.Serve(listener); err != nil {
+			log.Errorf("gRPC server failed: %v", err)
+		}
+	})
+}
+
+// whileLeadingInterceptor rejects the calls changing the registrations unless this
+// replica leads, the standby replicas of --leader-elect do not broadcast anything
+func whileLeadingInterceptor(mgr manager.Manager) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if writeMethods[info.FullMethod] {
+			select {
+			case <-mgr.Elected():
+			default:
+				return nil, status.Error(codes.Unavailable, "this replica is not the leader")
+			}
+		}
+		return handler(ctx, request)
+	}
+}
+
+func (s *registrationsServer) ListRegistrations(ctx context.Context, request *api.ListRegistrationsRequest) (*api.ListRegistrationsResponse, error) {
+	response := &api.ListRegistrationsResponse{}
+	for _, ctrl := range s.controllers {
+		for _, registration := range ctrl.Registrations() {
+			response.Registrations = append(response.Registrations, &api.Registration{
+				Hostname:    registration.Hostname,
+				Ips:         registration.IPs,
+				Port:        int32(registration.Port),
+				Tls:         registration.TLS,
+				ServiceType: registration.ServiceType,
+				Cluster:     registration.Cluster,
+				Kind:        registration.Kind,
+				Namespace:   registration.Namespace,
+				Name:        registration.Name,
+				Registered:  timestamppb.New(registration.Registered),
+			})
+		}
+	}
+	return response, nil
+}
+
+func (s *registrationsServer) Register(ctx context.Context, request *api.RegisterRequest) (*api.RegisterResponse, error) {
+	if !s.admin {
+		return nil, status.Error(codes.PermissionDenied, "ad-hoc registrations are only accepted on --grpc-admin-addr")
+	}
+	if s.adHoc == nil {
+		return nil, status.Error(codes.PermissionDenied, "ad-hoc registrations require --admin-api")
+	}
+	adHocRequest := controller.AdHocRequest{
+		Hostname: request.Hostname,
+		IP:       request.Ip,
+		Port:     int(request.Port),
+		TLS:      request.Tls,
+		TXT:      request.Txt,
+	}
+	if request.Ttl != nil {
+		adHocRequest.TTL = request.Ttl.AsDuration().String()
+	}
+	if err := s.adHoc.Add(adHocRequest); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &api.RegisterResponse{}, nil
+}
+
+func (s *registrationsServer) Unregister(ctx context.Context, request *api.UnregisterRequest) (*api.UnregisterResponse, error) {
+	if !s.admin {
+		return nil, status.Error(codes.PermissionDenied, "ad-hoc registrations are only accepted on --grpc-admin-addr")
+	}
+	if s.adHoc == nil {
+		return nil, status.Error(codes.PermissionDenied, "ad-hoc registrations require --admin-api")
+	}
+	if !s.adHoc.Remove(request.Hostname) {
+		return nil, status.Error(codes.NotFound, "no such ad-hoc registration")
+	}
+	return &api.UnregisterResponse{}, nil
+}
+
+func (s *registrationsServer) Reannounce(ctx context.Context, request *api.ReannounceRequest) (*api.ReannounceResponse, error) {
+	if !s.admin {
+		return nil, status.Error(codes.PermissionDenied, "re-announcing is only accepted on --grpc-admin-addr")
+	}
+	log.Info("Re-announcing all hostnames")
+	s.announcer.Reannounce()
+	return &api.ReannounceResponse{}, nil
+}
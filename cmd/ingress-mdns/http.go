@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// readinessCheck fails the readiness probe with the message while check does not pass
+func readinessCheck(check func() bool, message string) healthz.Checker {
+	return func(req *http.Request) error {
+		if !check() {
+			return errors.New(message)
+		}
+		return nil
+	}
+}
+
+// whileLeading only applies the readiness check while this replica leads, the standby
+// replicas of --leader-elect do not start what the leader runs and are always ready
+func whileLeading(mgr manager.Manager, check healthz.Checker) healthz.Checker {
+	return func(req *http.Request) error {
+		select {
+		case <-mgr.Elected():
+			return check(req)
+		default:
+			return nil
+		}
+	}
+}
+
+// interfaceIsUp checks whether the interface with the given index still exists and is up
+func interfaceIsUp(index int) func() bool {
+	return func() bool {
+		iface, err := net.InterfaceByIndex(index)
+		return err == nil && iface.Flags&net.FlagUp != 0
+	}
+}
+
+// serveRegistrations lists the hostnames broadcast for all clusters as JSON
+func serveRegistrations(controllers []*controller.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		registrations := []controller.Registration{}
+		for _, ctrl := range controllers {
+			registrations = append(registrations, ctrl.Registrations()...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(registrations); err != nil {
+			log.Errorf("Unable to write the registrations: %v", err)
+		}
+	}
+}
+
+// serveAdHoc serves /registrations on the given address, where ad-hoc hostnames are
+// registered by POST and unregistered by DELETE ?hostname=. It is kept off the
+// metrics address, which is usually reachable from the whole network.
+func serveAdHoc(addr string, controllers []*controller.Controller, adHoc *controller.AdHocRegistrations) {
+	list := serveRegistrations(controllers)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/registrations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(w, r)
+		case http.MethodPost:
+			request := controller.AdHocRequest{}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request); err != nil {
+				http.Error(w, fmt.Sprintf("invalid registration: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := adHoc.Add(request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if !adHoc.Remove(r.URL.Query().Get("hostname")) {
+				http.Error(w, "no such ad-hoc registration", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	log.Debugf("Serving the ad-hoc registrations on %v", addr)
+	goReportingPanics(func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Ad-hoc registrations server failed: %v", err)
+		}
+	})
+}
+
+// serveWebhook serves the admission webhook over TLS on the given address
+func serveWebhook(addr string, certFile string, keyFile string, webhook http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/validate-ingress", webhook)
+	log.Debugf("Serving the admission webhook on %v", addr)
+	goReportingPanics(func() {
+		if err := http.ListenAndServeTLS(addr, certFile, keyFile, mux); err != nil {
+			log.Errorf("Webhook server failed: %v", err)
+		}
+	})
+}
+
+// serveDebug exposes the pprof profiles on the given address
+func serveDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	log.Debugf("Serving pprof on %v", addr)
+	goReportingPanics(func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Debug server failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// getLeaseIdentity returns the namespace of the pod the leases are kept in and the
+// identity of this replica, its pod name
+func getLeaseIdentity() (string, string) {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		var err error
+		if identity, err = os.Hostname(); err != nil {
+			log.Panicf("Unable to determine the lease identity: %v", err)
+		}
+	}
+	return namespace, identity
+}
+
+// leaderElectionOptions only runs the controllers of the manager while this replica
+// holds the lease in the namespace of the pod, the manager stops once it is lost
+func leaderElectionOptions(leaseName string, leaseDuration time.Duration) manager.Options {
+	namespace, _ := getLeaseIdentity()
+	renewDeadline := leaseDuration * 2 / 3
+	retryPeriod := leaseDuration / 6
+	return manager.Options{
+		LeaderElection:                true,
+		LeaderElectionResourceLock:    "leases",
+		LeaderElectionID:              leaseName,
+		LeaderElectionNamespace:       namespace,
+		LeaderElectionReleaseOnCancel: true,
+		LeaseDuration:                 &leaseDuration,
+		RenewDeadline:                 &renewDeadline,
+		RetryPeriod:                   &retryPeriod,
+	}
+}
+
+// newManager returns the manager running the controllers of the cluster on its cache,
+// the metrics and health probes are only served when the options have an address
+func newManager(c *cluster, options manager.Options) manager.Manager {
+	options.Logger = logr.New(logrusSink{entry: log.NewEntry(log.StandardLogger())})
+	options.NewCache = c.cache.New
+	options.SyncPeriod = &c.resyncPeriod
+	if options.MetricsBindAddress == "" {
+		options.MetricsBindAddress = "0"
+	}
+	if options.HealthProbeBindAddress == "" {
+		options.HealthProbeBindAddress = "0"
+	}
+	mgr, err := manager.New(c.kubeConfig, options)
+	if err != nil {
+		log.Panicf("Unable to create the controller manager: %v", err)
+	}
+	return mgr
+}
+
+// logrusSink writes the logs of controller-runtime to logrus, its info logs are debug logs
+type logrusSink struct {
+	entry *log.Entry
+	name  string
+}
+
+func (s logrusSink) Init(info logr.RuntimeInfo) {}
+
+func (s logrusSink) Enabled(level int) bool {
+	return log.IsLevelEnabled(log.DebugLevel)
+}
+
+func (s logrusSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.withValues(keysAndValues).Debug(msg)
+}
+
+func (s logrusSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.withValues(keysAndValues).WithError(err).Error(msg)
+}
+
+func (s logrusSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return logrusSink{entry: s.withValues(keysAndValues), name: s.name}
+}
+
+func (s logrusSink) WithName(name string) logr.LogSink {
+	if s.name != "" {
+		name = s.name + "." + name
+	}
+	return logrusSink{entry: s.entry.WithField("logger", name), name: name}
+}
+
+func (s logrusSink) withValues(keysAndValues []interface{}) *log.Entry {
+	fields := log.Fields{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return s.entry.WithFields(fields)
+}
@@ -0,0 +1,1156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func main() {
+	usage := `ingress-mdns - Broadcast ingress hostnames via mDNS
+
+Usage: ingress-mdns [options] [--namespace=ns...] [--exclude-namespace=ns...]
+                    [--host-suffix=suffix...] [--strip-suffix=strip...]
+                    [--interface=name...] [--advertise-ip=ip...] [--wildcard-name=name...]
+                    [--relay-peer=addr...]
+       ingress-mdns browse [options] [--namespace=ns...] [--exclude-namespace=ns...]
+                    [--host-suffix=suffix...] [--strip-suffix=strip...]
+                    [--interface=name...] [--advertise-ip=ip...] [--wildcard-name=name...]
+       ingress-mdns manifests [options] [--namespace=ns...] [--exclude-namespace=ns...]
+                    [--host-suffix=suffix...] [--strip-suffix=strip...]
+                    [--interface=name...] [--advertise-ip=ip...] [--wildcard-name=name...]
+       ingress-mdns selftest [options] [--interface=name...] [--advertise-ip=ip...]
+       ingress-mdns relay-listen [options] [--interface=name...]
+       ingress-mdns status [options]
+       ingress-mdns version
+
+Options:
+	--cleartext-port=port  External cleartext port
+	                       of the ingress controller [default: 80]
+	--tls-port=port        External TLS port
+	                       of the ingress controller [default: 443]
+	--class-ports=ports    External cleartext and TLS ports of the ingress
+	                       controllers by ingress class, overriding the ports
+	                       above, e.g. nginx=80:443,traefik=8000:8443
+	--cleartext-service-type=type
+	                       DNS-SD service type of cleartext hosts [default: _http._tcp]
+	--tls-service-type=type
+	                       DNS-SD service type of TLS hosts [default: _https._tcp]
+	--namespace=ns         Only broadcast hostnames from this namespace,
+	                       can be repeated
+	--exclude-namespace=ns Never broadcast hostnames from this namespace,
+	                       can be repeated
+	--include-system-namespaces
+	                       Also broadcast hostnames from kube-system, kube-public
+	                       and kube-node-lease, which are left out unless given
+	                       with --namespace
+	--host-suffix=suffix   Broadcast hosts ending in this suffix, optionally
+	                       mapped to another suffix in the .local domain with
+	                       e.g. .kube=.local, can be repeated [default: .local]
+	--strip-suffix=strip   Whether the matched host suffix is replaced (true)
+	                       or kept, e.g. grafana.kube as grafana.kube.local
+	                       (false), for all suffixes or a single one like
+	                       .kube=false, can be repeated
+	--require-annotation   Only broadcast hostnames of objects annotated with
+	                       ingress-mdns.secoya.io/broadcast: "true"
+	--wildcard-expand=mode Broadcast wildcard hosts like *.apps.local as one
+	                       hostname per backend Service (backends), per
+	                       name given with --wildcard-name (static) or not
+	                       at all (none) [default: none]
+	--wildcard-name=name   Name the wildcard is replaced with when expanding
+	                       wildcard hosts statically, can be repeated
+	--debounce=dur         Coalesce the changes of an object within this window,
+	                       e.g. 2s, to avoid re-registering hostnames of objects
+	                       that are updated in rapid succession [default: 0s]
+	--hostname-template=tmpl
+	                       Rewrite the broadcast names with a Go template, e.g.
+	                       {{.Host}}-{{.Namespace}}, the fields are .Host,
+	                       .Namespace, .IngressName and .ClusterName
+	--sanitize-hostnames   Replace characters that are not allowed in DNS names
+	                       with dashes instead of not broadcasting the hostname
+	--conflict-policy=policy
+	                       Probe the network before registering a hostname and
+	                       on a conflict register it anyway (announce), not at
+	                       all (skip) or as hostname-2 (rename), none registers
+	                       without probing [default: none]
+	--publish-metadata     Add the kind, namespace, name and class of the object
+	                       to the TXT record
+	--write-status         Patch the broadcast state onto the Ingresses as the
+	                       ingress-mdns.secoya.io/status annotation, e.g.
+	                       broadcast=true,ip=192.168.1.20,port=443
+	--require-ready-endpoints
+	                       Only broadcast the hosts of an Ingress while the
+	                       Services they route to have ready endpoints
+	--check-certificates   Warn about TLS hostnames whose Secret does not exist or
+	                       whose certificate does not cover the .local hostname
+	--gateway-api          Also broadcast hostnames of Gateway API HTTPRoutes
+	--istio                Also broadcast hostnames of Istio VirtualServices bound
+	                       to a Gateway, advertised on the ports of the ingress
+	                       controller, i.e. the istio-ingressgateway Service
+	--traefik              Also broadcast hostnames of Traefik IngressRoutes
+	--traefik-group=group  API group of the IngressRoutes, traefik.io or
+	                       traefik.containo.us [default: traefik.io]
+	--traefik-cleartext-entrypoint=name
+	                       Traefik entry point of the cleartext port [default: web]
+	--traefik-tls-entrypoint=name
+	                       Traefik entry point of the TLS port [default: websecure]
+	--contour              Also broadcast the virtual hosts of Contour HTTPProxies
+	--dns-endpoints        Also broadcast hostnames of external-dns DNSEndpoints
+	--mdns-entries         Also broadcast the hostnames of MDNSEntries,
+	                       see deploy/mdnsentry-crd.yaml
+	--services             Also broadcast Services annotated with
+	                       ingress-mdns.secoya.io/hostname on their first port,
+	                       headless Services with a hostname per ready pod
+	--service-address=addr Broadcast the Services with the load balancer IPs
+	                       (load-balancer), their NodePort on the advertised IPs
+	                       (node-port) or their cluster IP (cluster-ip)
+	                       [default: load-balancer]
+	--resync-period=dur    Re-list all watched objects after this period to catch
+	                       missed changes, never when 0 [default: 30s]
+	--config=path          YAML config file, changes are applied at runtime
+	--broadcast-config=name
+	                       Apply the spec of this cluster-scoped
+	                       MDNSBroadcastConfig on top of the flags and the
+	                       config file at runtime, see
+	                       deploy/mdnsbroadcastconfig-crd.yaml
+	--http-addr=addr       Serve Prometheus metrics and /registrations on this
+	                       address, e.g. :9090
+	--health-addr=addr     Serve the /healthz and /readyz probes on this
+	                       address, e.g. :9091
+	--admin-api            Accept ad-hoc registrations via POST and DELETE
+	                       on /registrations of --admin-addr and the
+	                       Register and Unregister calls of the gRPC API
+	--admin-addr=addr      Serve the ad-hoc registrations of --admin-api on
+	                       this address [default: localhost:9582]
+	--grpc-addr=addr       Serve the gRPC API of pkg/api on this address,
+	                       e.g. :9581, the calls changing the registrations
+	                       are only served on --grpc-admin-addr
+	--grpc-admin-addr=addr
+	                       Serve the complete gRPC API with --grpc-addr on
+	                       this address [default: localhost:9583]
+	--debug-addr=addr      Serve the pprof profiles on /debug/pprof/ on this
+	                       address, e.g. localhost:6060
+	--otlp-endpoint=addr   Export traces of the registrations to this OTLP gRPC
+	                       endpoint, e.g. otel-collector:4317
+	--sentry-dsn=dsn       Report failed registrations, watch errors and panics
+	                       to this Sentry project, $SENTRY_DSN is used too
+	--kubeconfig=path      Connect to the cluster of this kubeconfig instead of
+	                       the cluster the pod runs in, $KUBECONFIG is used too
+	--context=name         Context of the kubeconfig, its current context when
+	                       left out
+	--cluster-name=name    Also publish the hostnames as host.name.local, for
+	                       several local clusters on the same network
+	--cluster-name-only    Only publish the hostnames as host.name.local
+	--contexts=contexts    Broadcast the hostnames of the clusters of these comma
+	                       separated kubeconfig contexts instead of the cluster
+	                       the pod runs in, e.g. dev,staging=192.168.1.11 to
+	                       resolve the hostnames of staging to that IP
+	--webhook-addr=addr    Serve a validating admission webhook for Ingresses
+	                       on /validate-ingress on this address, e.g. :8443
+	--webhook-cert=path    TLS certificate of the webhook [default: /etc/webhook/tls.crt]
+	--webhook-key=path     TLS key of the webhook [default: /etc/webhook/tls.key]
+	--webhook-deny         Reject Ingresses whose hostnames are already broadcast
+	                       for another Ingress instead of only warning
+	--interface=name       Broadcast on this interface instead of the interfaces
+	                       of the node's InternalIPs, can be repeated. auto
+	                       selects the interface carrying the default route
+	--subnet=cidr          Let --interface=auto select the interface with an
+	                       IP in this subnet instead, e.g. 192.168.1.0/24
+	--advertise-source=src
+	                       Let hostnames resolve to the IPs of the broadcast
+	                       interface (host-ip), the load balancer IPs of the
+	                       controller service (service-lb), the load balancer
+	                       IPs in the status of each Ingress (ingress-status)
+	                       or the IPs given with --advertise-ip (static)
+	                       [default: host-ip]
+	--advertise-ip=ip      IP hostnames resolve to with --advertise-source=static,
+	                       can be repeated
+	--controller-service=namespace/name
+	                       The Service of the ingress controller, its ports
+	                       named http and https are advertised
+	--node-port            Advertise the NodePorts of --controller-service, with
+	                       the default --advertise-source=host-ip each replica of
+	                       a DaemonSet resolves the hostnames to its node
+	--address-family=af    Publish A records (ipv4), AAAA records (ipv6)
+	                       or both (dual) [default: dual]
+	--dns-addr=addr        Also serve the address records over unicast DNS on
+	                       this address, e.g. :53
+	--dns-zone=zone        Zone served over unicast DNS and exported to the
+	                       file, e.g. internal for queries like
+	                       grafana.internal [default: local]
+	--export-file=path     Keep a file with the IPs of the hostnames in
+	                       the zone up to date
+	--export-format=format Write the file as a hosts file for the addn-hosts
+	                       option of dnsmasq (hosts) or as the records of a BIND
+	                       zone for $INCLUDE (zone) [default: hosts]
+	--export-reload-pid-file=path
+	                       Send SIGHUP to the process in this pid file after
+	                       writing --export-file, e.g. /var/run/dnsmasq.pid
+	--rfc2136-server=addr  Also push the address records to this DNS server
+	                       via RFC 2136 dynamic updates, e.g. 10.0.0.53:53
+	--rfc2136-zone=zone    Zone updated via RFC 2136, e.g. mdns.example.com
+	--tsig-key=name        Name of the TSIG key signing the dynamic updates
+	--tsig-algorithm=alg   Algorithm of the TSIG key [default: hmac-sha256]
+	--tsig-secret-file=path
+	                       File holding the base64 encoded TSIG secret
+	--publish-reverse      Answer reverse lookups of the advertised IPs
+	                       with the hostnames resolving to them
+	--ttl=seconds          TTL of the published records, address records
+	                       never exceed 120 seconds [default: 3200]
+	--announce-rate=pps    Send at most this many multicast packets per second,
+	                       unlimited when 0, zeroconf backend only [default: 0]
+	--query-log=qps        Log at most this many queries per second for the
+	                       hostnames with the client's address, for auditing
+	                       which clients resolve them, zeroconf backend only
+	--reannounce-interval=dur
+	                       Periodically broadcast all records again,
+	                       disabled when 0 [default: 0s]
+	--leader-elect         Only broadcast from the replica holding the lease,
+	                       for running multiple replicas
+	--shard                Split the hostnames between the replicas by
+	                       consistent hashing, every replica only broadcasts
+	                       its shard, for clusters with thousands of hostnames
+	--lease-name=name      Name of the leader election lease, the prefix of the
+	                       member leases with --shard [default: ingress-mdns]
+	--lease-duration=dur   Time after which a standby replica takes over
+	                       when the leader stops renewing the lease, or a
+	                       replica's shard is taken over with --shard
+	                       [default: 15s]
+	--shutdown-grace=dur   How long to wait for the goodbye packets of all
+	                       hostnames to be sent when stopping [default: 5s]
+	--backend=backend      The mDNS implementation to publish hostnames with,
+	                       zeroconf, avahi, resolved or dns-sd
+	                       [default: zeroconf]
+	--watchdog-interval=dur
+	                       Periodically resolve a sample of the registered
+	                       hostnames via mDNS, disabled when 0 [default: 0s]
+	--watchdog-sample=n    Number of hostnames resolved by
+	                       each watchdog probe [default: 5]
+	--watchdog-reannounce  Re-announce all hostnames when the watchdog
+	                       cannot resolve one of them
+	--health-probe=mode    Only register hostnames whose target accepts TCP
+	                       connections (tcp) or answers HTTP requests for the
+	                       hostname (http) on its port, hostnames whose target
+	                       stops responding are withdrawn until it recovers
+	--health-probe-interval=dur
+	                       How often the targets are probed again [default: 30s]
+	--relay-peer=addr      Also send the announcements and answers of the first
+	                       interface as unicast packets to this address, e.g. a
+	                       WireGuard peer running relay-listen, can be repeated
+	--listen=addr          Address relay-listen receives the packets on
+	                       [default: :5354]
+	--llmnr                Also answer LLMNR queries for the hostnames, with and
+	                       without .local, for Windows clients without Bonjour
+	--netbios              Also answer NetBIOS name queries on port 137 for the
+	                       hostnames, truncated to 15 characters
+	--ws-discovery         Also announce the HTTP endpoints of the hostnames via
+	                       WS-Discovery for the Windows network view
+	--reflect=ifaces       Relay mDNS queries and responses between these comma
+	                       separated interfaces, e.g. eth0,wg0, so clients on
+	                       the second segment resolve the hostnames as well
+	--monitor-conflicts    Watch the mDNS traffic for other responders
+	                       answering for the broadcast hostnames
+	--timeout=dur          How long browse, selftest and the watchdog wait
+	                       for mDNS responses, the health probe for the targets
+	                       and status for the running instance [default: 3s]
+	--addr=addr            HTTP address of the instance queried by status
+	                       [default: localhost:9580]
+	--image=image          Image of the manifests
+	                       [default: cr.orbit.dev/dev/ingress-mdns:v2.0.0]
+	--install-namespace=ns Namespace of the manifests [default: default]
+	--daemonset            Generate a DaemonSet instead of a Deployment, implied
+	                       by --node-port
+	--log-format=format    Log as text or json [default: text]
+  --debug                Print debugging information
+	-h, --help             show this help
+
+Commands:
+	browse                 Browse the network for the DNS-SD service types and
+	                       check which of the hostnames of the Ingresses in the
+	                       cluster can be resolved, for debugging multicast
+	                       connectivity from a laptop or from within the pod
+	manifests              Print the ServiceAccount, the RBAC rules needed by the
+	                       given options and a Deployment or DaemonSet running
+	                       ingress-mdns with them
+	relay-listen           Multicast the packets sent by --relay-peer on the
+	                       local interface, the one carrying the default route
+	                       unless --interface is given
+	selftest               Register a throwaway hostname and query it back over
+	                       multicast on each interface, exits with 1 when it
+	                       cannot be resolved or its service type is not
+	                       enumerated, e.g. because the pod does not run with
+	                       hostNetwork or the CNI drops multicast
+	status                 Print the hostnames broadcast by a running instance
+	                       with the address of its HTTP listener
+	version                Print the version, commit and build date
+
+Notes:
+	Unless --interface is given, the hostnames are broadcast on the interfaces
+	with the InternalIPs of the Node named by the environment variable
+	$NODE_NAME. The Node is watched, when its IPs change the hostnames are
+	re-registered and when they move to another interface ingress-mdns exits
+	to be restarted on it. Without $NODE_NAME, $HOST_IP selects the interfaces,
+	it may contain a comma-separated list of IPs.
+	The avahi backend requires access to the system D-Bus socket of the node,
+	it manages TTLs and announcements on its own.
+	The resolved backend registers DNS-SD services with the mDNS responder of
+	systemd-resolved through the system D-Bus socket of the node, the services
+	point at the hostname of the node since resolved does not publish address
+	records for other names.
+	The dns-sd backend runs dns-sd -P for each service, for running ingress-mdns
+	with --kubeconfig on macOS where mDNSResponder owns the mDNS port.
+	Changes to the load balancer IPs and ports of --controller-service
+	re-register all hostnames.
+	The leader election lease is created in the namespace in $POD_NAMESPACE.
+	With --contexts the controller service and the lease are looked up in the
+	first cluster, the kubeconfig is read from --kubeconfig, $KUBECONFIG or
+	~/.kube/config.
+	Objects annotated with ingress-mdns.secoya.io/broadcast: "false" are never broadcast.
+	The TXT record is path=/ unless the object is annotated with comma separated
+	key=value pairs, e.g. ingress-mdns.secoya.io/txt: "path=/app,team=payments".
+	Additional names for the hosts of an object can be given with e.g.
+	ingress-mdns.secoya.io/aliases: "grafana,monitoring"
+	Ingresses annotated with e.g. ingress-mdns.secoya.io/port: "8443" or
+	"http=8080,https=8443" are advertised on those ports.
+	The admission webhook checks against the hostnames broadcast by the replica
+	receiving the request, standby replicas of --leader-elect admit everything.
+	SIGHUP re-reads the config file and re-registers all hostnames, e.g. after
+	network problems or a restart of the avahi-daemon.
+	Registrations are recorded as MDNSRegistered and MDNSFailed events on the
+	objects, see kubectl describe ingress.`
+
+	arguments, _ := docopt.ParseDoc(usage)
+	debug, _ := arguments.Bool("--debug")
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+	logFormat, _ := arguments.String("--log-format")
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Panicf("Unknown log format %v", logFormat)
+	}
+	log.Debug(arguments)
+
+	if showVersion, _ := arguments.Bool("version"); showVersion {
+		runVersion()
+		return
+	}
+	if relayListen, _ := arguments.Bool("relay-listen"); relayListen {
+		runRelayListen(arguments)
+		return
+	}
+	if status, _ := arguments.Bool("status"); status {
+		runStatus(arguments)
+		return
+	}
+	if selftest, _ := arguments.Bool("selftest"); selftest {
+		runSelftest(arguments)
+		return
+	}
+	if browse, _ := arguments.Bool("browse"); browse {
+		runBrowse(arguments)
+		return
+	}
+	if manifests, _ := arguments.Bool("manifests"); manifests {
+		runManifests(arguments, os.Args[1:])
+		return
+	}
+
+	log.WithFields(log.Fields{"version": version, "commit": commit, "buildDate": buildDate}).Info("Starting ingress-mdns")
+	metrics.SetBuildInfo(version, commit, buildDate, runtime.Version())
+
+	if otlpEndpoint, err := arguments.String("--otlp-endpoint"); err == nil {
+		defer setupTracing(otlpEndpoint)()
+	}
+	sentryDSN, err := arguments.String("--sentry-dsn")
+	if err != nil {
+		sentryDSN = os.Getenv("SENTRY_DSN")
+	}
+	if sentryDSN != "" {
+		hook := setupErrorReporting(sentryDSN)
+		defer func() {
+			if value := recover(); value != nil {
+				hook.reportPanic(value)
+				hook.flush()
+				panic(value)
+			}
+			hook.flush()
+		}()
+	}
+
+	// The controller service and the leader election lease are in the first cluster
+	clusterConfigs := getClusterConfigs(arguments)
+	clientset, err := kubernetes.NewForConfig(clusterConfigs[0].kubeConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	flagConfig := configFromArguments(arguments)
+	config := flagConfig
+	configPath, configErr := arguments.String("--config")
+	if configErr == nil {
+		if config, err = controller.LoadConfigFile(configPath, flagConfig); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+
+	resyncPeriodValue, _ := arguments.String("--resync-period")
+	resyncPeriod, err := time.ParseDuration(resyncPeriodValue)
+	if err != nil || resyncPeriod < 0 {
+		log.Panicf("Invalid --resync-period %v", resyncPeriodValue)
+	}
+	fileConfig := config
+	var broadcastConfig *controller.BroadcastConfig
+	if name, err := arguments.String("--broadcast-config"); err == nil {
+		dynamicClient, err := dynamic.NewForConfig(clusterConfigs[0].kubeConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		// The spec is applied for the whole lifetime of the process, but only
+		// reloaded by the leader
+		broadcastConfig = controller.NewBroadcastConfig(dynamicClient, name, config, resyncPeriod)
+		broadcastStop := make(chan struct{})
+		defer close(broadcastStop)
+		broadcastConfig.Run(broadcastStop)
+		log.Debugf("Waiting for MDNSBroadcastConfig %v", name)
+		cache.WaitForCacheSync(broadcastStop, broadcastConfig.HasSynced)
+		config = broadcastConfig.Config()
+	}
+	var node *controller.NodeAddresses
+	hostIPs := getEnvHostIPs()
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" && len(config.Interfaces) == 0 {
+		// The Node is followed for the whole lifetime of the process
+		node = controller.NewNodeAddresses(clientset, nodeName, resyncPeriod)
+		nodeStop := make(chan struct{})
+		defer close(nodeStop)
+		node.Run(nodeStop)
+		log.Debugf("Waiting for the IPs of node %v", nodeName)
+		cache.WaitForCacheSync(nodeStop, node.HasSynced)
+		hostIPs = node.IPs()
+	}
+	broadcastInterfaces := getBroadcastInterfaces(config, hostIPs)
+	var controllerService *controller.ControllerService
+	if service, err := arguments.String("--controller-service"); err == nil {
+		if controllerService, err = controller.NewControllerService(clientset, service, resyncPeriod); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if nodePort, _ := arguments.Bool("--node-port"); nodePort {
+		if controllerService == nil {
+			log.Panic("--node-port requires --controller-service")
+		}
+		controllerService.UseNodePorts(true)
+	}
+	addresses := getAddressSource(arguments, controllerService)
+	announceRateValue, _ := arguments.String("--announce-rate")
+	announceRate, err := strconv.ParseFloat(announceRateValue, 64)
+	if err != nil {
+		log.Panicf("Invalid --announce-rate: %v", err)
+	}
+	announcer := newAnnouncer(config, broadcastInterfaces, addresses, announceRate)
+	// Only the zeroconf responder needs to rejoin the multicast groups itself
+	zeroconfAnnouncer, _ := announcer.(*announce.ZeroconfAnnouncer)
+	if peers := getRelayPeers(arguments); len(peers) > 0 {
+		if zeroconfAnnouncer == nil {
+			log.Panic("--relay-peer requires the zeroconf backend")
+		}
+		zeroconfAnnouncer.RelayTo(peers)
+	}
+	if queryLogValue, err := arguments.String("--query-log"); err == nil {
+		queryLog, err := strconv.ParseFloat(queryLogValue, 64)
+		if err != nil || queryLog <= 0 {
+			log.Panicf("Invalid --query-log %v", queryLogValue)
+		}
+		if zeroconfAnnouncer == nil {
+			log.Panic("--query-log requires the zeroconf backend")
+		}
+		zeroconfAnnouncer.LogQueries(queryLog)
+	}
+	if dnsAddr, err := arguments.String("--dns-addr"); err == nil {
+		family, _ := announce.ParseAddressFamily(config.AddressFamily)
+		zone, _ := arguments.String("--dns-zone")
+		ttl := uint32(config.TTL)
+		if ttl > 120 {
+			ttl = 120
+		}
+		announcer = announce.NewUnicastDNS(announcer, dnsAddr, zone, broadcastInterfaces, addresses, family, ttl)
+	}
+	if llmnr, _ := arguments.Bool("--llmnr"); llmnr {
+		family, _ := announce.ParseAddressFamily(config.AddressFamily)
+		if announcer, err = announce.NewLLMNR(announcer, broadcastInterfaces, addresses, family); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if netbios, _ := arguments.Bool("--netbios"); netbios {
+		if announcer, err = announce.NewNetBIOS(announcer, broadcastInterfaces, addresses); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if wsDiscovery, _ := arguments.Bool("--ws-discovery"); wsDiscovery {
+		if announcer, err = announce.NewWSDiscovery(announcer, broadcastInterfaces); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if exportFile, err := arguments.String("--export-file"); err == nil {
+		announcer = newFileExport(arguments, announcer, exportFile, config, broadcastInterfaces, addresses)
+	}
+	if dnsServer, err := arguments.String("--rfc2136-server"); err == nil {
+		announcer = newDynamicDNS(arguments, announcer, dnsServer, config, broadcastInterfaces, addresses)
+	}
+	watchdogIntervalValue, _ := arguments.String("--watchdog-interval")
+	watchdogInterval, err := time.ParseDuration(watchdogIntervalValue)
+	if err != nil || watchdogInterval < 0 {
+		log.Panicf("Invalid --watchdog-interval %v", watchdogIntervalValue)
+	}
+	timeoutValue, _ := arguments.String("--timeout")
+	timeout, err := time.ParseDuration(timeoutValue)
+	if err != nil {
+		log.Panicf("Invalid --timeout: %v", err)
+	}
+	var watchdog *announce.Watchdog
+	if watchdogInterval > 0 {
+		sample, err := arguments.Int("--watchdog-sample")
+		if err != nil || sample <= 0 {
+			log.Panicf("Invalid --watchdog-sample: %v", arguments["--watchdog-sample"])
+		}
+		watchdogReannounce, _ := arguments.Bool("--watchdog-reannounce")
+		watchdog = announce.NewWatchdog(announcer, broadcastInterfaces, sample, timeout, watchdogReannounce)
+		announcer = watchdog
+	}
+	var healthProbe *announce.HealthProbe
+	healthProbeIntervalValue, _ := arguments.String("--health-probe-interval")
+	healthProbeInterval, err := time.ParseDuration(healthProbeIntervalValue)
+	if err != nil || healthProbeInterval <= 0 {
+		log.Panicf("Invalid --health-probe-interval %v", healthProbeIntervalValue)
+	}
+	if modeValue, err := arguments.String("--health-probe"); err == nil {
+		mode, err := announce.ParseProbeMode(modeValue)
+		if err != nil {
+			log.Panicf("Invalid --health-probe: %v", err)
+		}
+		family, _ := announce.ParseAddressFamily(config.AddressFamily)
+		healthProbe = announce.NewHealthProbe(announcer, mode, broadcastInterfaces, addresses, family, timeout)
+		announcer = healthProbe
+	}
+	// Several objects and clusters may register the same hostname
+	announcer = announce.NewRefCounted(announcer)
+	shutdownGraceValue, _ := arguments.String("--shutdown-grace")
+	shutdownGrace, err := time.ParseDuration(shutdownGraceValue)
+	if err != nil {
+		log.Panicf("Invalid --shutdown-grace: %v", err)
+	}
+	defer shutdownAnnouncer(announcer, shutdownGrace)
+
+	clusters := []*cluster{}
+	controllers := []*controller.Controller{}
+	for _, clusterConfig := range clusterConfigs {
+		c := newCluster(arguments, clusterConfig, announcer, broadcastInterfaces, addresses, config, resyncPeriod)
+		defer c.eventBroadcaster.Shutdown()
+		clusters = append(clusters, c)
+		controllers = append(controllers, c.ctrl)
+	}
+	if controllerService != nil {
+		controllerService.OnChange(func(cleartextPort int, tlsPort int) {
+			for _, ctrl := range controllers {
+				ctrl.SetServicePorts(cleartextPort, tlsPort)
+			}
+		})
+	}
+
+	sigs := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	var stopOnce sync.Once
+	shutdown := func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	reannounceIntervalValue, _ := arguments.String("--reannounce-interval")
+	reannounceInterval, err := time.ParseDuration(reannounceIntervalValue)
+	if err != nil {
+		log.Panicf("Invalid --reannounce-interval: %v", err)
+	}
+
+	monitorConflicts, _ := arguments.Bool("--monitor-conflicts")
+	var reflector *announce.Reflector
+	if reflectValue, err := arguments.String("--reflect"); err == nil {
+		reflectInterfaces := []net.Interface{}
+		for _, name := range strings.Split(reflectValue, ",") {
+			iface, err := net.InterfaceByName(strings.TrimSpace(name))
+			if err != nil {
+				log.Panicf("Invalid --reflect: interface %v not found: %v", name, err)
+			}
+			reflectInterfaces = append(reflectInterfaces, *iface)
+		}
+		if reflector, err = announce.NewReflector(reflectInterfaces); err != nil {
+			log.Panicf("Invalid --reflect: %v", err)
+		}
+	}
+	run := func(stop <-chan struct{}) {
+		if reannounceInterval > 0 {
+			goReportingPanics(func() { reannounce(announcer, reannounceInterval, stop) })
+		}
+		if watchdog != nil {
+			goReportingPanics(func() { watchdog.Run(watchdogInterval, stop) })
+		}
+		if healthProbe != nil {
+			goReportingPanics(func() { healthProbe.Run(healthProbeInterval, stop) })
+		}
+		if reflector != nil {
+			goReportingPanics(func() { reflector.Run(stop) })
+		}
+		goReportingPanics(func() {
+			announce.MonitorInterfaces(broadcastInterfaces, func(iface net.Interface, change announce.InterfaceChange) {
+				handleInterfaceChange(iface, change, zeroconfAnnouncer, controllers, shutdown)
+			}, stop)
+		})
+		if monitorConflicts {
+			for _, ctrl := range controllers {
+				if err := ctrl.MonitorConflicts(stop); err != nil {
+					log.Errorf("Unable to monitor conflicts: %v", err)
+				}
+			}
+		}
+		reload := func(config *controller.Config) {
+			for _, ctrl := range controllers {
+				ctrl.Reload(config)
+			}
+		}
+		// The config file is the base the MDNSBroadcastConfig is applied to
+		reloadFile := reload
+		if broadcastConfig != nil {
+			broadcastConfig.OnChange(reload)
+			reloadFile = broadcastConfig.SetBase
+		}
+		if configErr == nil {
+			if err := controller.WatchConfigFile(configPath, flagConfig, fileConfig, reloadFile, stop); err != nil {
+				log.Errorf("Unable to watch config file: %v", err)
+			}
+		}
+		goReportingPanics(func() { reregisterOnHangup(controllers, configPath, configErr == nil, flagConfig, reloadFile, stop) })
+		if controllerService != nil {
+			goReportingPanics(func() { controllerService.Run(stop) })
+		}
+	}
+
+	var adHoc *controller.AdHocRegistrations
+	if adminAPI, _ := arguments.Bool("--admin-api"); adminAPI {
+		adHoc = controller.NewAdHocRegistrations(controllers[0])
+		controllers[0].AddSource(adHoc)
+		adminAddr, _ := arguments.String("--admin-addr")
+		serveAdHoc(adminAddr, controllers, adHoc)
+	}
+	if debugAddr, err := arguments.String("--debug-addr"); err == nil {
+		serveDebug(debugAddr)
+	}
+	if webhookAddr, err := arguments.String("--webhook-addr"); err == nil {
+		certFile, _ := arguments.String("--webhook-cert")
+		keyFile, _ := arguments.String("--webhook-key")
+		webhookDeny, _ := arguments.Bool("--webhook-deny")
+		serveWebhook(webhookAddr, certFile, keyFile, controller.NewIngressWebhook(clusters[0].ingressSource, webhookDeny))
+	}
+
+	goReportingPanics(func() { handleUserSignals(controllers, announcer, stop) })
+
+	goReportingPanics(func() {
+		sig := <-sigs
+		log.Debugf("%v", sig)
+		shutdown()
+	})
+	if node != nil {
+		node.OnChange(func(ips []net.IP) {
+			ifaces, err := getInterfacesByIPs(ips)
+			if err != nil {
+				log.Errorf("Keeping the current interfaces: %v", err)
+				return
+			}
+			if !sameInterfaces(ifaces, broadcastInterfaces) {
+				// The announcers are bound to their interfaces, the restarted pod binds to the new ones
+				log.Warn("The IPs of the node moved to other interfaces, unregistering all hostnames and exiting")
+				shutdown()
+				return
+			}
+			for _, ctrl := range controllers {
+				ctrl.Reregister()
+			}
+		})
+	}
+
+	leaderElect, _ := arguments.Bool("--leader-elect")
+	leaseName, _ := arguments.String("--lease-name")
+	leaseDurationValue, _ := arguments.String("--lease-duration")
+	leaseDuration, err := time.ParseDuration(leaseDurationValue)
+	if err != nil {
+		log.Panicf("Invalid --lease-duration: %v", err)
+	}
+	if shard, _ := arguments.Bool("--shard"); shard {
+		if leaderElect {
+			log.Panic("--shard cannot be combined with --leader-elect")
+		}
+		namespace, identity := getLeaseIdentity()
+		shards := controller.NewShards(clientset, namespace, leaseName, identity, leaseDuration)
+		for _, ctrl := range controllers {
+			ctrl.SetShards(shards)
+		}
+		shards.OnChange(func() {
+			for _, ctrl := range controllers {
+				ctrl.Reconcile()
+			}
+		})
+		shards.Run(stop)
+		log.Infof("Broadcasting the shard of %v in group %v of %v members", identity, leaseName, len(shards.Members()))
+	}
+	// The controllers of the sources and everything else the leader does run in the
+	// manager of the first cluster, which also serves the metrics and health probes.
+	// The managers of the other clusters are started by the leader.
+	options := manager.Options{}
+	if leaderElect {
+		options = leaderElectionOptions(leaseName, leaseDuration)
+	}
+	options.MetricsBindAddress, _ = arguments.String("--http-addr")
+	options.HealthProbeBindAddress, _ = arguments.String("--health-addr")
+	mgr := newManager(clusters[0], options)
+	managers := []manager.Manager{mgr}
+	for _, c := range clusters[1:] {
+		managers = append(managers, newManager(c, manager.Options{}))
+	}
+	for index, c := range clusters {
+		if err := c.ctrl.SetupWithManager(managers[index]); err != nil {
+			log.Panicf("Unable to set up the controllers: %v", err)
+		}
+		c.addReadinessChecks(mgr)
+	}
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		log.Panic(err.Error())
+	}
+	for _, iface := range broadcastInterfaces {
+		check := readinessCheck(interfaceIsUp(iface.Index), fmt.Sprintf("interface %v is down", iface.Name))
+		if err := mgr.AddReadyzCheck("interface-"+iface.Name, check); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if controllerService != nil {
+		check := whileLeading(mgr, readinessCheck(controllerService.HasSynced, "controller service not synced"))
+		if err := mgr.AddReadyzCheck("controller-service", check); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if _, err := arguments.String("--http-addr"); err == nil {
+		if err := mgr.AddMetricsExtraHandler("/registrations", serveRegistrations(controllers)); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	if grpcAddr, err := arguments.String("--grpc-addr"); err == nil {
+		grpcAdminAddr, _ := arguments.String("--grpc-admin-addr")
+		serveGRPC(grpcAddr, grpcAdminAddr, mgr, controllers, adHoc, announcer)
+	}
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if leaderElect {
+			log.Infof("Acquired lease %v, starting to broadcast", leaseName)
+		}
+		var clustersDone sync.WaitGroup
+		for _, clusterManager := range managers[1:] {
+			clusterManager := clusterManager
+			clustersDone.Add(1)
+			goReportingPanics(func() {
+				defer clustersDone.Done()
+				if err := clusterManager.Start(ctx); err != nil {
+					log.Warnf("Stopped broadcasting a cluster: %v", err)
+					shutdown()
+				}
+			})
+		}
+		run(ctx.Done())
+		<-ctx.Done()
+		clustersDone.Wait()
+		return nil
+	}))
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	if leaderElect {
+		namespace, _ := getLeaseIdentity()
+		log.Infof("Waiting to acquire lease %v/%v", namespace, leaseName)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	managerDone := make(chan struct{})
+	goReportingPanics(func() {
+		defer close(managerDone)
+		// Returns an error once the lease is lost
+		if err := mgr.Start(ctx); err != nil {
+			log.Warnf("Stopped broadcasting: %v", err)
+		}
+		shutdown()
+	})
+	<-stop
+	// Releases the lease once the controllers stopped
+	cancel()
+	<-managerDone
+}
+
+// shutdownAnnouncer unregisters all hostnames so their goodbye packets clear the
+// caches of the clients, giving up once grace has passed
+func shutdownAnnouncer(announcer announce.Announcer, grace time.Duration) {
+	done := make(chan struct{})
+	goReportingPanics(func() {
+		announcer.Shutdown()
+		close(done)
+	})
+	select {
+	case <-done:
+		log.Info("Unregistered all hostnames")
+	case <-time.After(grace):
+		log.Warnf("Not all goodbye packets were sent within %v", grace)
+	}
+}
+
+func reannounce(announcer announce.Announcer, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Debugf("Re-announcing all hostnames")
+			announcer.Reannounce()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleInterfaceChange rejoins the multicast groups of an interface that came back
+// up and re-registers all hostnames when its IPs changed. Recreated interfaces get
+// another index the announcers are not bound to, ingress-mdns exits to be restarted.
+func handleInterfaceChange(iface net.Interface, change announce.InterfaceChange, zeroconfAnnouncer *announce.ZeroconfAnnouncer, controllers []*controller.Controller, shutdown func()) {
+	logger := log.WithField("interface", iface.Name)
+	switch change {
+	case announce.InterfaceDown:
+		logger.Warn("Interface went down, the hostnames are broadcast again once it is up")
+	case announce.InterfaceRemoved:
+		logger.Warn("Interface was removed, the hostnames are broadcast again once it is back")
+	case announce.InterfaceReplaced:
+		logger.Warn("Interface was recreated, unregistering all hostnames and exiting")
+		shutdown()
+	case announce.InterfaceUp, announce.InterfaceAddressesChanged:
+		if zeroconfAnnouncer != nil {
+			if err := zeroconfAnnouncer.Rejoin(iface); err != nil {
+				logger.Errorf("Unable to rejoin the mDNS group: %v", err)
+			}
+		}
+		if change == announce.InterfaceAddressesChanged {
+			// The records of the hostnames hold the IPs of the interface
+			for _, ctrl := range controllers {
+				ctrl.Reregister()
+			}
+		}
+	}
+}
+
+// handleUserSignals logs the registered hostnames on SIGUSR1 and re-announces
+// all of them on SIGUSR2
+func handleUserSignals(controllers []*controller.Controller, announcer announce.Announcer, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGUSR2 {
+				log.Info("Re-announcing all hostnames")
+				announcer.Reannounce()
+				continue
+			}
+			count := 0
+			for _, ctrl := range controllers {
+				for _, registration := range ctrl.Registrations() {
+					log.WithFields(log.Fields{
+						"hostname":   registration.Hostname,
+						"ips":        strings.Join(registration.IPs, ","),
+						"port":       registration.Port,
+						"tls":        registration.TLS,
+						"cluster":    registration.Cluster,
+						"kind":       registration.Kind,
+						"namespace":  registration.Namespace,
+						"name":       registration.Name,
+						"registered": registration.Registered.Format(time.RFC3339),
+					}).Info("Registered hostname")
+					count++
+				}
+			}
+			log.Infof("%v hostnames registered", count)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reregisterOnHangup re-reads the config file, applies it with reload and re-registers
+// all hostnames on SIGHUP
+func reregisterOnHangup(controllers []*controller.Controller, configPath string, hasConfigFile bool, flagConfig *controller.Config, reload func(*controller.Config), stop <-chan struct{}) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-hangups:
+			var config *controller.Config
+			if hasConfigFile {
+				var err error
+				if config, err = controller.LoadConfigFile(configPath, flagConfig); err != nil {
+					log.Errorf("Not reloading config: %v", err)
+				}
+			}
+			if config != nil {
+				reload(config)
+			}
+			for _, ctrl := range controllers {
+				ctrl.Reregister()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func newAnnouncer(config *controller.Config, ifaces []net.Interface, addresses announce.AddressSource, announceRate float64) announce.Announcer {
+	family, err := announce.ParseAddressFamily(config.AddressFamily)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	switch config.Backend {
+	case "zeroconf":
+		if config.TTL <= 0 {
+			log.Panicf("Invalid ttl: %v", config.TTL)
+		}
+		announcer := announce.NewZeroconfAnnouncer(ifaces, addresses, family, uint32(config.TTL))
+		announcer.PublishReverse(config.PublishReverse)
+		announcer.RateLimit(announceRate)
+		return announcer
+	case "avahi":
+		announcer, err := announce.NewAvahiAnnouncer(ifaces, addresses, family)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		announcer.PublishReverse(config.PublishReverse)
+		return announcer
+	case "resolved":
+		announcer, err := announce.NewResolvedAnnouncer()
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		return announcer
+	case "dns-sd":
+		announcer, err := announce.NewDNSSDAnnouncer(ifaces, addresses, family)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		return announcer
+	}
+	log.Panicf("Unknown backend %v", config.Backend)
+	panic("")
+}
+
+// newFileExport wraps the announcer to write the hostnames to the file
+func newFileExport(arguments docopt.Opts, announcer announce.Announcer, path string, config *controller.Config, ifaces []net.Interface, addresses announce.AddressSource) announce.Announcer {
+	formatValue, _ := arguments.String("--export-format")
+	format, err := announce.ParseExportFormat(formatValue)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	zone, _ := arguments.String("--dns-zone")
+	pidFile, _ := arguments.String("--export-reload-pid-file")
+	family, _ := announce.ParseAddressFamily(config.AddressFamily)
+	ttl := uint32(config.TTL)
+	if ttl > 120 {
+		ttl = 120
+	}
+	return announce.NewFileExport(announcer, path, format, zone, pidFile, ifaces, addresses, family, ttl)
+}
+
+// newDynamicDNS wraps the announcer to push the address records to the DNS server
+func newDynamicDNS(arguments docopt.Opts, announcer announce.Announcer, server string, config *controller.Config, ifaces []net.Interface, addresses announce.AddressSource) announce.Announcer {
+	zone, err := arguments.String("--rfc2136-zone")
+	if err != nil {
+		log.Panic("--rfc2136-server requires --rfc2136-zone")
+	}
+	var key *announce.TSIGKey
+	if keyName, err := arguments.String("--tsig-key"); err == nil {
+		secretFile, err := arguments.String("--tsig-secret-file")
+		if err != nil {
+			log.Panic("--tsig-key requires --tsig-secret-file")
+		}
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			log.Panicf("Unable to read the TSIG secret: %v", err)
+		}
+		algorithm, _ := arguments.String("--tsig-algorithm")
+		key = &announce.TSIGKey{Name: keyName, Algorithm: algorithm, Secret: strings.TrimSpace(string(secret))}
+	}
+	family, _ := announce.ParseAddressFamily(config.AddressFamily)
+	ttl := uint32(config.TTL)
+	if ttl > 120 {
+		ttl = 120
+	}
+	return announce.NewDynamicDNS(announcer, server, zone, key, ifaces, addresses, family, ttl)
+}
+
+// getAddressSource selects the IPs the hostnames resolve to
+func getAddressSource(arguments docopt.Opts, controllerService *controller.ControllerService) announce.AddressSource {
+	advertiseSource, _ := arguments.String("--advertise-source")
+	switch advertiseSource {
+	case "host-ip":
+		return announce.InterfaceAddresses{}
+	case "ingress-status":
+		// Only Ingresses have a status to take the IPs from, the other sources use the host IPs
+		return announce.InterfaceAddresses{}
+	case "service-lb":
+		if controllerService == nil {
+			log.Panic("--advertise-source=service-lb requires --controller-service")
+		}
+		return controllerService
+	case "static":
+		advertiseIPs := arguments["--advertise-ip"].([]string)
+		if len(advertiseIPs) == 0 {
+			log.Panic("--advertise-source=static requires --advertise-ip")
+		}
+		addresses, err := announce.ParseStaticAddresses(advertiseIPs)
+		if err != nil {
+			log.Panicf("Invalid --advertise-ip: %v", err)
+		}
+		return addresses
+	}
+	log.Panicf("Unknown advertise source %v", advertiseSource)
+	panic("")
+}
+
+// getBroadcastInterfaces returns the interfaces given with --interface or otherwise
+// the interfaces with the IPs of the node
+func getBroadcastInterfaces(config *controller.Config, hostIPs []net.IP) []net.Interface {
+	ifaces := []net.Interface{}
+	if config.Subnet != "" && !contains(config.Interfaces, "auto") {
+		log.Panic("--subnet requires --interface=auto")
+	}
+	if len(config.Interfaces) > 0 {
+		for _, name := range config.Interfaces {
+			if name == "auto" {
+				iface, err := getAutoInterface(config.Subnet)
+				if err != nil {
+					log.Panic(err.Error())
+				}
+				log.Infof("Selected interface %v", iface.Name)
+				ifaces = append(ifaces, iface)
+				continue
+			}
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				log.Panicf("Interface %v not found: %v", name, err)
+			}
+			ifaces = append(ifaces, *iface)
+		}
+		return ifaces
+	}
+	if len(hostIPs) == 0 {
+		log.Panic("Neither --interface, $NODE_NAME nor $HOST_IP is set")
+	}
+	ifaces, err := getInterfacesByIPs(hostIPs)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	return ifaces
+}
+
+// getInterfacesByIPs returns the interfaces the IPs are assigned to
+func getInterfacesByIPs(ips []net.IP) ([]net.Interface, error) {
+	ifaces := []net.Interface{}
+	indices := map[int]bool{}
+	for _, ip := range ips {
+		iface, err := getInterfaceByIP(ip)
+		if err != nil {
+			return nil, err
+		}
+		if !indices[iface.Index] {
+			indices[iface.Index] = true
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces, nil
+}
+
+// getAutoInterface returns the interface with an IP in the subnet, or the one
+// carrying the default route when the subnet is empty
+func getAutoInterface(subnet string) (net.Interface, error) {
+	if subnet != "" {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return net.Interface{}, fmt.Errorf("Invalid --subnet: %v", err)
+		}
+		ifaces, _ := net.Interfaces()
+		for _, iface := range ifaces {
+			ips, err := announce.InterfaceIPs(iface)
+			if err != nil {
+				return net.Interface{}, err
+			}
+			for _, ip := range ips {
+				if network.Contains(ip) {
+					return iface, nil
+				}
+			}
+		}
+		return net.Interface{}, fmt.Errorf("No interface has an IP in %v", subnet)
+	}
+	// Connecting a UDP socket only looks up the route, no packets are sent
+	for _, target := range []string{"192.0.2.1:9", "[2001:db8::1]:9"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		return getInterfaceByIP(localIP)
+	}
+	return net.Interface{}, fmt.Errorf("No default route found")
+}
+
+func getInterfaceByIP(broadcastIP net.IP) (net.Interface, error) {
+	ifaces, _ := net.Interfaces()
+	ifaceIPs := []string{}
+	for _, iface := range ifaces {
+		ips, err := announce.InterfaceIPs(iface)
+		if err != nil {
+			return net.Interface{}, err
+		}
+		for _, ip := range ips {
+			if net.IP.Equal(ip, broadcastIP) {
+				log.Debugf("Found interface %v", iface.Name)
+				return iface, nil
+			}
+			ifaceIPs = append(ifaceIPs, ip.String())
+		}
+	}
+	return net.Interface{}, fmt.Errorf("No interface with IP %v was found, available IPs are:\n%v", broadcastIP, strings.Join(ifaceIPs, "\n"))
+}
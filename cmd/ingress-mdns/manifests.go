@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	docopt "github.com/docopt/docopt-go"
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// Options of the manifests command that are not passed on to the container
+var manifestOptions = []string{"--image", "--install-namespace", "--daemonset"}
+
+// runManifests prints the ServiceAccount, RBAC and Deployment or DaemonSet
+// for running ingress-mdns with the given options
+func runManifests(arguments docopt.Opts, args []string) {
+	namespace, _ := arguments.String("--install-namespace")
+	labels := map[string]string{"app.kubernetes.io/name": "ingress-mdns"}
+	meta := func(name string, namespace string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels}
+	}
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: "ingress-mdns"}}
+	objects := []runtime.Object{
+		&v1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: meta("ingress-mdns", namespace),
+		},
+	}
+	// The rules by namespace, "" for the ClusterRole
+	roleNamespaces := []string{}
+	roles := map[string][]rbacv1.PolicyRule{}
+	addRole := func(namespace string, rules []rbacv1.PolicyRule) {
+		if len(rules) == 0 {
+			return
+		}
+		if _, exists := roles[namespace]; !exists {
+			roleNamespaces = append(roleNamespaces, namespace)
+		}
+		roles[namespace] = append(roles[namespace], rules...)
+	}
+
+	clusterRules, namespacedRules := getRules(arguments)
+	watchNamespaces := arguments["--namespace"].([]string)
+	if len(watchNamespaces) == 0 {
+		addRole("", append(clusterRules, namespacedRules...))
+	} else {
+		addRole("", clusterRules)
+		for _, watchNamespace := range watchNamespaces {
+			addRole(watchNamespace, namespacedRules)
+		}
+	}
+	leaderElect, _ := arguments.Bool("--leader-elect")
+	if leaderElect {
+		addRole(namespace, []rbacv1.PolicyRule{{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs:     []string{"get", "create", "update"},
+		}})
+	}
+	if shard, _ := arguments.Bool("--shard"); shard {
+		// The member leases of the replicas are listed to find the other members
+		addRole(namespace, []rbacv1.PolicyRule{{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs:     []string{"get", "list", "create", "update", "delete"},
+		}})
+	}
+	if service, err := arguments.String("--controller-service"); err == nil {
+		parts := strings.SplitN(service, "/", 2)
+		if len(parts) != 2 {
+			log.Panicf("Invalid --controller-service %v, expected namespace/name", service)
+		}
+		serviceNamespace, serviceName := parts[0], parts[1]
+		// The Service is watched with a field selector on its name
+		addRole(serviceNamespace, []rbacv1.PolicyRule{{
+			APIGroups:     []string{""},
+			Resources:     []string{"services"},
+			ResourceNames: []string{serviceName},
+			Verbs:         []string{"get", "list", "watch"},
+		}})
+	}
+
+	for _, roleNamespace := range roleNamespaces {
+		kind := "Role"
+		if roleNamespace == "" {
+			kind = "ClusterRole"
+		}
+		objects = append(objects,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: kind},
+				ObjectMeta: meta("ingress-mdns", roleNamespace),
+				Rules:      roles[roleNamespace],
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: kind + "Binding"},
+				ObjectMeta: meta("ingress-mdns", roleNamespace),
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: kind, Name: "ingress-mdns"},
+				Subjects:   subjects,
+			},
+		)
+	}
+
+	pod := getPodSpec(arguments, containerArgs(args))
+	daemonSet, _ := arguments.Bool("--daemonset")
+	if nodePort, _ := arguments.Bool("--node-port"); nodePort {
+		daemonSet = true
+	}
+	selector := &metav1.LabelSelector{MatchLabels: labels}
+	template := v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}, Spec: pod}
+	if daemonSet {
+		objects = append(objects, &appsv1.DaemonSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "DaemonSet"},
+			ObjectMeta: meta("ingress-mdns", namespace),
+			Spec:       appsv1.DaemonSetSpec{Selector: selector, Template: template},
+		})
+	} else {
+		replicas := int32(1)
+		if leaderElect {
+			replicas = 2
+		}
+		// The pods bind to fixed ports on the host network,
+		// make sure the old pod is killed before updating to a new one
+		maxUnavailable := intstr.FromString("100%")
+		objects = append(objects, &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+			ObjectMeta: meta("ingress-mdns", namespace),
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Strategy: appsv1.DeploymentStrategy{
+					RollingUpdate: &appsv1.RollingUpdateDeployment{MaxUnavailable: &maxUnavailable},
+				},
+				Selector: selector,
+				Template: template,
+			},
+		})
+	}
+
+	documents := []string{}
+	for _, object := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+		if err != nil {
+			log.Panicf("Unable to generate the manifests: %v", err)
+		}
+		// Drop the fields the API server fills in
+		unstructured.RemoveNestedField(content, "status")
+		unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+		unstructured.RemoveNestedField(content, "spec", "template", "metadata", "creationTimestamp")
+		document, err := yaml.Marshal(content)
+		if err != nil {
+			log.Panicf("Unable to generate the manifests: %v", err)
+		}
+		documents = append(documents, string(document))
+	}
+	fmt.Print("---\n" + strings.Join(documents, "---\n"))
+}
+
+// getRules returns the rules needed to watch the enabled sources, the rules for
+// resources that are only watched in the namespaces given with --namespace are
+// returned separately
+func getRules(arguments docopt.Opts) ([]rbacv1.PolicyRule, []rbacv1.PolicyRule) {
+	watch := []string{"list", "watch"}
+	// The Node selects the broadcast interfaces, browse and selftest get it once
+	clusterRules := []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get", "list", "watch"}},
+	}
+	ingressVerbs := watch
+	if writeStatus, _ := arguments.Bool("--write-status"); writeStatus {
+		ingressVerbs = []string{"list", "watch", "patch"}
+	}
+	namespacedRules := []rbacv1.PolicyRule{
+		// extensions only serves Ingresses on clusters older than Kubernetes 1.19
+		{APIGroups: []string{"networking.k8s.io", "extensions"}, Resources: []string{"ingresses"}, Verbs: ingressVerbs},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+	}
+	services, _ := arguments.Bool("--services")
+	if services {
+		namespacedRules = append(namespacedRules, rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"services"}, Verbs: watch})
+	}
+	if readyEndpoints, _ := arguments.Bool("--require-ready-endpoints"); services || readyEndpoints {
+		namespacedRules = append(namespacedRules, rbacv1.PolicyRule{APIGroups: []string{"discovery.k8s.io"}, Resources: []string{"endpointslices"}, Verbs: watch})
+	}
+	if checkCertificates, _ := arguments.Bool("--check-certificates"); checkCertificates {
+		namespacedRules = append(namespacedRules, rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: watch})
+	}
+	// Custom resources are watched in all namespaces
+	if gatewayAPI, _ := arguments.Bool("--gateway-api"); gatewayAPI {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"gateway.networking.k8s.io"}, Resources: []string{"gateways", "httproutes"}, Verbs: watch})
+	}
+	if istio, _ := arguments.Bool("--istio"); istio {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"networking.istio.io"}, Resources: []string{"gateways", "virtualservices"}, Verbs: watch})
+	}
+	if traefik, _ := arguments.Bool("--traefik"); traefik {
+		group, _ := arguments.String("--traefik-group")
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{group}, Resources: []string{"ingressroutes"}, Verbs: watch})
+	}
+	if contour, _ := arguments.Bool("--contour"); contour {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"projectcontour.io"}, Resources: []string{"httpproxies"}, Verbs: watch})
+	}
+	if dnsEndpoints, _ := arguments.Bool("--dns-endpoints"); dnsEndpoints {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"externaldns.k8s.io"}, Resources: []string{"dnsendpoints"}, Verbs: watch})
+	}
+	if mdnsEntries, _ := arguments.Bool("--mdns-entries"); mdnsEntries {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"ingress-mdns.secoya.io"}, Resources: []string{"mdnsentries"}, Verbs: watch})
+	}
+	if _, err := arguments.String("--broadcast-config"); err == nil {
+		clusterRules = append(clusterRules, rbacv1.PolicyRule{APIGroups: []string{"ingress-mdns.secoya.io"}, Resources: []string{"mdnsbroadcastconfigs"}, Verbs: watch})
+	}
+	return clusterRules, namespacedRules
+}
+
+// getPodSpec returns the pod running ingress-mdns on the host network with the args
+func getPodSpec(arguments docopt.Opts, args []string) v1.PodSpec {
+	image, _ := arguments.String("--image")
+	terminationGracePeriod := int64(60)
+	readOnly := true
+	fieldEnv := func(name string, path string) v1.EnvVar {
+		return v1.EnvVar{Name: name, ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: path}}}
+	}
+	container := v1.Container{
+		Name:  "ingress-mdns",
+		Image: image,
+		Args:  args,
+		Env: []v1.EnvVar{
+			fieldEnv("NODE_NAME", "spec.nodeName"),
+			fieldEnv("POD_NAME", "metadata.name"),
+			fieldEnv("POD_NAMESPACE", "metadata.namespace"),
+		},
+		SecurityContext: &v1.SecurityContext{ReadOnlyRootFilesystem: &readOnly},
+		VolumeMounts:    []v1.VolumeMount{{Name: "tmp", MountPath: "/tmp"}},
+	}
+	volumes := []v1.Volume{{Name: "tmp", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	if healthAddr, err := arguments.String("--health-addr"); err == nil {
+		_, portValue, err := net.SplitHostPort(healthAddr)
+		if err != nil {
+			log.Panicf("Invalid --health-addr: %v", err)
+		}
+		port, err := strconv.Atoi(portValue)
+		if err != nil {
+			log.Panicf("Invalid --health-addr port %v", portValue)
+		}
+		probe := func(path string) *v1.Probe {
+			return &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: path, Port: intstr.FromInt(port)}}}
+		}
+		container.LivenessProbe = probe("/healthz")
+		container.ReadinessProbe = probe("/readyz")
+	}
+	if backend, _ := arguments.String("--backend"); backend == "avahi" || backend == "resolved" {
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: "dbus", MountPath: "/var/run/dbus"})
+		volumes = append(volumes, v1.Volume{Name: "dbus", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/var/run/dbus"}}})
+	}
+	return v1.PodSpec{
+		HostNetwork:                   true,
+		DNSPolicy:                     v1.DNSClusterFirstWithHostNet,
+		ServiceAccountName:            "ingress-mdns",
+		TerminationGracePeriodSeconds: &terminationGracePeriod,
+		Containers:                    []v1.Container{container},
+		Volumes:                       volumes,
+	}
+}
+
+// containerArgs returns the command line arguments following the manifests command
+// without the options that only apply to the manifests
+func containerArgs(args []string) []string {
+	filtered := []string{}
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if arg == "manifests" {
+			continue
+		}
+		name := strings.SplitN(arg, "=", 2)[0]
+		if contains(manifestOptions, name) {
+			if name == arg && name != "--daemonset" {
+				// The value is given as the next argument
+				index++
+			}
+			continue
+		}
+		filtered = append(filtered, arg)
+	}
+	return filtered
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// getEnvHostIPs returns the comma separated IPs of $HOST_IP
+func getEnvHostIPs() []net.IP {
+	ips := []net.IP{}
+	for _, value := range strings.Split(os.Getenv("HOST_IP"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			ips = append(ips, net.ParseIP(value))
+		}
+	}
+	return ips
+}
+
+// getHostIPs looks up the InternalIPs of the Node in $NODE_NAME once, for the
+// subcommands running in the pod, or returns the IPs of $HOST_IP without it
+func getHostIPs(arguments docopt.Opts) []net.IP {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return getEnvHostIPs()
+	}
+	clientset, err := kubernetes.NewForConfig(getClusterConfigs(arguments)[0].kubeConfig)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		log.Panicf("Unable to get node %v: %v", nodeName, err)
+	}
+	return controller.GetNodeIPs(node)
+}
+
+// sameInterfaces returns whether both lists contain the same interfaces
+func sameInterfaces(ifaces []net.Interface, others []net.Interface) bool {
+	if len(ifaces) != len(others) {
+		return false
+	}
+	for _, iface := range ifaces {
+		found := false
+		for _, other := range others {
+			if other.Index == iface.Index {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// getRelayPeers parses the addresses given with --relay-peer
+func getRelayPeers(arguments docopt.Opts) []*net.UDPAddr {
+	peers := []*net.UDPAddr{}
+	for _, value := range arguments["--relay-peer"].([]string) {
+		peer, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			log.Panicf("Invalid --relay-peer %v: %v", value, err)
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// runRelayListen receives the packets relayed by --relay-peer and multicasts them
+// on the local interfaces, so the mDNS responder of the machine caches the records
+func runRelayListen(arguments docopt.Opts) {
+	config := configFromArguments(arguments)
+	var ifaces []net.Interface
+	if len(config.Interfaces) > 0 {
+		ifaces = getBroadcastInterfaces(config, nil)
+	} else {
+		iface, err := getAutoInterface("")
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		ifaces = []net.Interface{iface}
+	}
+	listenAddr, _ := arguments.String("--listen")
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		log.Panicf("Invalid --listen: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Panicf("Unable to listen on %v: %v", listenAddr, err)
+	}
+	defer conn.Close()
+	// Responders ignore responses that are not sent from the mDNS port
+	injectConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 0), Port: mdnsGroup.Port})
+	if err != nil {
+		log.Panicf("Unable to bind the mDNS port: %v", err)
+	}
+	defer injectConn.Close()
+	inject := ipv4.NewPacketConn(injectConn)
+	if err := inject.SetMulticastLoopback(true); err != nil {
+		log.Panicf("Unable to enable multicast loopback: %v", err)
+	}
+	names := []string{}
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	log.Infof("Relaying the packets received on %v to %v", conn.LocalAddr(), names)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Unable to receive relayed packets: %v", err)
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			log.Debugf("Ignoring a packet from %v that is not an mDNS response", from)
+			continue
+		}
+		for _, iface := range ifaces {
+			if _, err := inject.WriteTo(buf[:n], &ipv4.ControlMessage{IfIndex: iface.Index}, mdnsGroup); err != nil {
+				log.Errorf("Unable to multicast the packet of %v on %v: %v", from, iface.Name, err)
+			}
+		}
+		log.Debugf("Relayed %v records from %v", len(msg.Answer), from)
+	}
+}
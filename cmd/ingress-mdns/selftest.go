@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSelftest registers a throwaway hostname with the configured backend and checks
+// that it can be resolved via multicast on the broadcast interfaces, exits with 1 when
+// it cannot
+func runSelftest(arguments docopt.Opts) {
+	config := configFromArguments(arguments)
+	timeoutValue, _ := arguments.String("--timeout")
+	timeout, err := time.ParseDuration(timeoutValue)
+	if err != nil {
+		log.Panicf("Invalid --timeout: %v", err)
+	}
+	ifaces := getBrowseInterfaces(arguments, config)
+	if len(ifaces) == 0 {
+		log.Panic("No multicast interfaces found")
+	}
+	var addresses announce.AddressSource = announce.InterfaceAddresses{}
+	if advertiseIPs := arguments["--advertise-ip"].([]string); len(advertiseIPs) > 0 {
+		if addresses, err = announce.ParseStaticAddresses(advertiseIPs); err != nil {
+			log.Panicf("Invalid --advertise-ip: %v", err)
+		}
+	}
+	announcer := newAnnouncer(config, ifaces, addresses, 0)
+
+	local := announce.LocalHostname{Hostname: fmt.Sprintf("ingress-mdns-selftest-%08x", rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())}
+	service := config.Service(local)
+	if err := announcer.Register(local, service); err != nil {
+		announcer.Shutdown()
+		log.Panicf("Unable to register %v: %v", local.Hostname, err)
+	}
+	names := []string{}
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	fmt.Printf("Registered %v.local on %v\n", local.Hostname, strings.Join(names, ", "))
+
+	failed := false
+	for _, iface := range ifaces {
+		ips := announce.Resolve([]net.Interface{iface}, local.Hostname+".local.", timeout)
+		if len(ips) == 0 {
+			fmt.Printf("FAIL %v: no response within %v\n", iface.Name, timeout)
+			failed = true
+			continue
+		}
+		fmt.Printf("PASS %v: resolved to %v\n", iface.Name, strings.Join(ips, ", "))
+		// Generic DNS-SD browsers only find the hostnames when the service type is
+		// enumerated by the meta-query
+		types := announce.ServiceTypes(iface, timeout)
+		serviceType := service.Type + ".local."
+		for _, value := range types {
+			if strings.EqualFold(value, serviceType) {
+				serviceType = ""
+			}
+		}
+		if serviceType != "" {
+			fmt.Printf("FAIL %v: %v is not listed by _services._dns-sd._udp.local\n", iface.Name, service.Type)
+			failed = true
+			continue
+		}
+		fmt.Printf("PASS %v: service types %v\n", iface.Name, strings.Join(types, ", "))
+	}
+	announcer.Shutdown()
+	if failed {
+		fmt.Println("Multicast does not reach the responder, check that the pod runs with " +
+			"hostNetwork: true, that --interface or $NODE_NAME select the node's interface " +
+			"and that the CNI or firewall does not drop traffic to 224.0.0.251:5353")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	docopt "github.com/docopt/docopt-go"
+	"github.com/secoya/ingress-mdns/pkg/controller"
+	log "github.com/sirupsen/logrus"
+)
+
+// runStatus prints the hostnames broadcast by the instance serving --addr
+func runStatus(arguments docopt.Opts) {
+	addr, _ := arguments.String("--addr")
+	timeoutValue, _ := arguments.String("--timeout")
+	timeout, err := time.ParseDuration(timeoutValue)
+	if err != nil {
+		log.Panicf("Invalid --timeout: %v", err)
+	}
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Get(strings.TrimSuffix(url, "/") + "/registrations")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to query %v: %v\n", addr, err)
+		os.Exit(1)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Unable to query %v: %v\n", addr, response.Status)
+		os.Exit(1)
+	}
+	registrations := []controller.Registration{}
+	if err := json.NewDecoder(response.Body).Decode(&registrations); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse the registrations of %v: %v\n", addr, err)
+		os.Exit(1)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "HOSTNAME\tIPS\tPORT\tTLS\tOBJECT\tAGE")
+	for _, registration := range registrations {
+		object := registration.Kind + "/" + registration.Name
+		if registration.Namespace != "" {
+			object = registration.Kind + "/" + registration.Namespace + "/" + registration.Name
+		}
+		if registration.Cluster != "" {
+			object = registration.Cluster + ":" + object
+		}
+		ips := strings.Join(registration.IPs, ",")
+		if ips == "" {
+			ips = "-"
+		}
+		fmt.Fprintf(writer, "%v.local\t%v\t%v\t%v\t%v\t%v\n", registration.Hostname, ips, registration.Port,
+			registration.TLS, object, formatAge(time.Since(registration.Registered)))
+	}
+	writer.Flush()
+}
+
+// formatAge rounds the duration like kubectl does, e.g. 45s, 12m or 3d
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < time.Hour*48:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
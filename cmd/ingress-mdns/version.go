@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build metadata, set with e.g.
+// go build -ldflags "-X main.version=v2.1.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// runVersion prints the build metadata
+func runVersion() {
+	fmt.Printf("ingress-mdns %v\ncommit: %v\nbuilt: %v\ngo: %v\n", version, commit, buildDate, runtime.Version())
+}
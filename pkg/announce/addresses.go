@@ -0,0 +1,69 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressSource determines the IPs hostnames resolve to on an interface
+type AddressSource interface {
+	Addresses(iface net.Interface) ([]net.IP, error)
+}
+
+// InterfaceAddresses advertises the IPs of the interface the hostnames are broadcast on
+type InterfaceAddresses struct{}
+
+// Addresses returns the IPs of the interface
+func (InterfaceAddresses) Addresses(iface net.Interface) ([]net.IP, error) {
+	return InterfaceIPs(iface)
+}
+
+// StaticAddresses advertises the same IPs on every interface
+type StaticAddresses []net.IP
+
+// Addresses returns the static IPs
+func (s StaticAddresses) Addresses(iface net.Interface) ([]net.IP, error) {
+	return s, nil
+}
+
+// ParseStaticAddresses parses the IPs given with --advertise-ip
+func ParseStaticAddresses(values []string) (StaticAddresses, error) {
+	ips := StaticAddresses{}
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP %v", value)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// hostnameAddresses returns the IPs of the hostname on the interface
+func hostnameAddresses(local LocalHostname, addresses AddressSource, iface net.Interface) ([]net.IP, error) {
+	if local.IPs == "" {
+		return addresses.Addresses(iface)
+	}
+	return ParseStaticAddresses(strings.Split(local.IPs, ","))
+}
+
+// InterfaceIPs returns the IPs assigned to the interface
+func InterfaceIPs(iface net.Interface) ([]net.IP, error) {
+	ifaceIPs := []net.IP{}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get addresses of interface %v: %v", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		var ifaceIP net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ifaceIP = v.IP
+		case *net.IPAddr:
+			ifaceIP = v.IP
+		}
+		ifaceIPs = append(ifaceIPs, ifaceIP)
+	}
+	return ifaceIPs, nil
+}
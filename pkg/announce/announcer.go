@@ -0,0 +1,317 @@
+// Package announce publishes hostnames on the local network via mDNS
+package announce
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	"github.com/secoya/ingress-mdns/pkg/zeroconf"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// LocalHostname An Ingress hostname in the .local domain
+type LocalHostname struct {
+	TLS      bool
+	Hostname string
+	// Port overrides the cleartext/TLS port of the ingress controller when set
+	Port int
+	// TXT holds the comma separated entries of the TXT record when set
+	TXT string
+	// IPs holds the comma separated IPs the hostname resolves to, overriding the address source when set
+	IPs string
+	// ServiceTypes holds comma separated DNS-SD service types the hostname is advertised as in addition
+	ServiceTypes string
+	// Subtypes holds comma separated DNS-SD subtypes, either of all types (_printer) or of one
+	// (_printer._sub._http._tcp)
+	Subtypes string
+}
+
+// Announcer publishes hostnames on the local network
+type Announcer interface {
+	// Register starts broadcasting the hostname as the given service
+	Register(local LocalHostname, service Service) error
+	// Unregister stops broadcasting the hostname, unknown hostnames are ignored
+	Unregister(local LocalHostname)
+	// Reannounce broadcasts the records of all registered hostnames again
+	Reannounce()
+	// Shutdown unregisters all hostnames
+	Shutdown()
+}
+
+// Service describes how a hostname is advertised via DNS-SD
+type Service struct {
+	// Type is the DNS-SD service type, e.g. _http._tcp
+	Type string
+	// Types are advertised in addition to Type on the same port, e.g. _grafana._tcp
+	Types []string
+	Port  int
+	// Text holds the entries of the TXT record
+	Text []string
+	// Subtypes holds the subtypes each type is published under, e.g. _printer
+	Subtypes map[string][]string
+}
+
+// AllTypes returns Type followed by the additional types
+func (s Service) AllTypes() []string {
+	return append([]string{s.Type}, s.Types...)
+}
+
+// WithSubtypes returns the service type followed by its comma separated subtypes,
+// e.g. _http._tcp,_printer as understood by zeroconf and dns-sd
+func (s Service) WithSubtypes(serviceType string) string {
+	return strings.Join(append([]string{serviceType}, s.Subtypes[serviceType]...), ",")
+}
+
+// AddressFamily selects which IP versions are published
+type AddressFamily string
+
+// The supported address families
+const (
+	IPv4      AddressFamily = "ipv4"
+	IPv6      AddressFamily = "ipv6"
+	DualStack AddressFamily = "dual"
+)
+
+// ParseAddressFamily validates an address family
+func ParseAddressFamily(value string) (AddressFamily, error) {
+	switch family := AddressFamily(value); family {
+	case IPv4, IPv6, DualStack:
+		return family, nil
+	}
+	return "", fmt.Errorf("Unknown address family %v", value)
+}
+
+// Filter returns the IPs that belong to the address family
+func (f AddressFamily) Filter(ips []net.IP) []net.IP {
+	filtered := []net.IP{}
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil
+		if f == DualStack || (f == IPv4 && isIPv4) || (f == IPv6 && !isIPv4) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// ZeroconfAnnouncer runs a zeroconf server for each registered hostname and interface,
+// so every interface only advertises its own addresses. All servers share the
+// multicast connections of a single responder.
+type ZeroconfAnnouncer struct {
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	ttl       uint32
+	reverse   bool
+	// Shared by all servers so bulk registrations do not burst packets
+	limiter *rate.Limiter
+	// Sent a unicast copy of the packets of the first interface
+	peers []*net.UDPAddr
+	// Limits the logged queries, no queries are logged when nil
+	queryLog *rate.Limiter
+
+	lock sync.Mutex
+	// Created with the first registration and shut down with the last server
+	responder *zeroconf.Responder
+	servers   map[LocalHostname][]*zeroconf.Server
+}
+
+// NewZeroconfAnnouncer creates an announcer broadcasting on the given interfaces
+func NewZeroconfAnnouncer(ifaces []net.Interface, addresses AddressSource, family AddressFamily, ttl uint32) *ZeroconfAnnouncer {
+	return &ZeroconfAnnouncer{
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		ttl:       ttl,
+		servers:   map[LocalHostname][]*zeroconf.Server{},
+	}
+}
+
+// RateLimit caps the multicast packets sent by all servers combined,
+// unlimited when packetsPerSecond is 0
+func (a *ZeroconfAnnouncer) RateLimit(packetsPerSecond float64) {
+	if packetsPerSecond <= 0 {
+		a.limiter = nil
+		return
+	}
+	burst := int(packetsPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	a.limiter = rate.NewLimiter(rate.Limit(packetsPerSecond), burst)
+}
+
+// LogQueries logs the queries for the registered hostnames with the client's
+// address, at most queriesPerSecond, it must be called before any hostname is registered
+func (a *ZeroconfAnnouncer) LogQueries(queriesPerSecond float64) {
+	burst := int(queriesPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	a.queryLog = rate.NewLimiter(rate.Limit(queriesPerSecond), burst)
+}
+
+// RelayTo additionally sends the announcements and answers of the first interface
+// as unicast packets to the peers, it must be called before any hostname is registered
+func (a *ZeroconfAnnouncer) RelayTo(peers []*net.UDPAddr) {
+	a.peers = peers
+}
+
+// PublishReverse makes the servers answer reverse lookups of the advertised IPs
+func (a *ZeroconfAnnouncer) PublishReverse(enabled bool) {
+	a.reverse = enabled
+}
+
+// Register starts the zeroconf servers for the hostname
+func (a *ZeroconfAnnouncer) Register(local LocalHostname, service Service) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	responder, err := a.getResponder()
+	if err != nil {
+		return err
+	}
+	servers := []*zeroconf.Server{}
+	for _, iface := range a.ifaces {
+		ips, err := hostnameAddresses(local, a.addresses, iface)
+		if err != nil {
+			shutdownServers(servers)
+			a.shutdownIdleResponder()
+			return err
+		}
+		ifaceIPs := []string{}
+		for _, ip := range a.family.Filter(ips) {
+			ifaceIPs = append(ifaceIPs, ip.String())
+		}
+		for _, serviceType := range service.AllTypes() {
+			server, err := zeroconf.NewSharedServer(
+				responder,
+				local.Hostname,
+				service.WithSubtypes(serviceType),
+				"local.",
+				service.Port,
+				local.Hostname,
+				ifaceIPs,
+				service.Text,
+				[]net.Interface{iface},
+			)
+			if err != nil {
+				shutdownServers(servers)
+				a.shutdownIdleResponder()
+				return fmt.Errorf("Unable to register %v as %v on %v: %v", local.Hostname, serviceType, iface.Name, err)
+			}
+			server.TTL(a.ttl)
+			server.PublishReverse(a.reverse)
+			server.RateLimit(a.limiter)
+			server.Start()
+			servers = append(servers, server)
+		}
+	}
+	a.servers[local] = servers
+	metrics.RegisteredHostnames.Inc()
+	return nil
+}
+
+// Unregister shuts down the zeroconf servers of the hostname
+func (a *ZeroconfAnnouncer) Unregister(local LocalHostname) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if servers, exists := a.servers[local]; exists {
+		shutdownServers(servers)
+		delete(a.servers, local)
+		metrics.RegisteredHostnames.Dec()
+		a.forgetQueries(local.Hostname)
+	}
+	a.shutdownIdleResponder()
+}
+
+// forgetQueries removes the query count of the hostname once neither its cleartext
+// nor its TLS service is registered, must be called with the lock held
+func (a *ZeroconfAnnouncer) forgetQueries(hostname string) {
+	for local := range a.servers {
+		if local.Hostname == hostname {
+			return
+		}
+	}
+	metrics.ForgetQueries(hostname)
+}
+
+// Reannounce makes all zeroconf servers announce their records
+func (a *ZeroconfAnnouncer) Reannounce() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, servers := range a.servers {
+		for _, server := range servers {
+			server.Announce()
+		}
+	}
+}
+
+// Rejoin joins the multicast groups on the interface again and announces all
+// records, e.g. after the link came back up
+func (a *ZeroconfAnnouncer) Rejoin(iface net.Interface) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.responder == nil {
+		return nil
+	}
+	if err := a.responder.Rejoin(iface); err != nil {
+		return err
+	}
+	for _, servers := range a.servers {
+		for _, server := range servers {
+			server.Announce()
+		}
+	}
+	return nil
+}
+
+// Shutdown shuts down all zeroconf servers
+func (a *ZeroconfAnnouncer) Shutdown() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for local, servers := range a.servers {
+		log.WithField("hostname", local.Hostname).Info("Unregistering hostname")
+		shutdownServers(servers)
+		delete(a.servers, local)
+		metrics.RegisteredHostnames.Dec()
+	}
+	a.shutdownIdleResponder()
+}
+
+// getResponder returns the responder of the servers, joining the multicast groups
+// of the published IP versions when there is none yet, must be called with the lock held
+func (a *ZeroconfAnnouncer) getResponder() (*zeroconf.Responder, error) {
+	if a.responder == nil {
+		responder, err := zeroconf.NewResponder(a.ifaces, a.family != IPv6, a.family != IPv4)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to listen for mDNS queries: %v", err)
+		}
+		responder.RateLimit(a.limiter)
+		responder.RelayTo(a.peers)
+		if a.queryLog != nil {
+			responder.LogQueries(a.queryLog)
+		}
+		a.responder = responder
+	}
+	return a.responder, nil
+}
+
+// shutdownIdleResponder closes the connections of the responder once no hostname
+// is registered anymore, must be called with the lock held
+func (a *ZeroconfAnnouncer) shutdownIdleResponder() {
+	if a.responder != nil && len(a.servers) == 0 {
+		if err := a.responder.Shutdown(); err != nil {
+			log.Errorf("Unable to send all goodbye packets: %v", err)
+		}
+		a.responder = nil
+	}
+}
+
+func shutdownServers(servers []*zeroconf.Server) {
+	for _, server := range servers {
+		server.Shutdown()
+	}
+}
@@ -0,0 +1,230 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	avahiService          = "org.freedesktop.Avahi"
+	avahiServerInterface  = "org.freedesktop.Avahi.Server"
+	avahiEntryGroupPrefix = "org.freedesktop.Avahi.EntryGroup"
+
+	// AVAHI_PROTO_* from avahi-common/address.h
+	avahiProtoInet   int32 = 0
+	avahiProtoInet6  int32 = 1
+	avahiProtoUnspec int32 = -1
+
+	// AVAHI_PUBLISH_NO_REVERSE from avahi-common/defs.h
+	avahiPublishNoReverse uint32 = 32
+)
+
+// AvahiAnnouncer publishes hostnames through the avahi-daemon running on the node.
+// The address records of a hostname are kept in an entry group that is shared
+// by all services of that hostname, since avahi rejects duplicate address records.
+type AvahiAnnouncer struct {
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	conn      *dbus.Conn
+	server    dbus.BusObject
+
+	lock          sync.Mutex
+	groups        map[LocalHostname]dbus.BusObject
+	addressGroups map[string]*avahiAddressGroup
+	// Hostnames publishing the reverse record of an IP, avahi rejects duplicate reverse records
+	reverseOwners map[string]string
+	reverse       bool
+}
+
+type avahiAddressGroup struct {
+	group dbus.BusObject
+	refs  int
+}
+
+// NewAvahiAnnouncer connects to avahi-daemon via the system D-Bus
+func NewAvahiAnnouncer(ifaces []net.Interface, addresses AddressSource, family AddressFamily) (*AvahiAnnouncer, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the system bus: %v", err)
+	}
+	server := conn.Object(avahiService, "/")
+	var version string
+	if err := server.Call(avahiServerInterface+".GetVersionString", 0).Store(&version); err != nil {
+		return nil, fmt.Errorf("Unable to reach avahi-daemon: %v", err)
+	}
+	log.Debugf("Connected to %v", version)
+	return &AvahiAnnouncer{
+		ifaces:        ifaces,
+		addresses:     addresses,
+		family:        family,
+		conn:          conn,
+		server:        server,
+		groups:        map[LocalHostname]dbus.BusObject{},
+		addressGroups: map[string]*avahiAddressGroup{},
+		reverseOwners: map[string]string{},
+	}, nil
+}
+
+// Register adds an entry group for the service of the hostname and commits it
+func (a *AvahiAnnouncer) Register(local LocalHostname, service Service) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.retainAddresses(local); err != nil {
+		return err
+	}
+	group, err := a.newEntryGroup()
+	if err != nil {
+		a.releaseAddresses(local.Hostname)
+		return err
+	}
+	if err := a.addService(group, local, service); err != nil {
+		group.Call(avahiEntryGroupPrefix+".Free", 0)
+		a.releaseAddresses(local.Hostname)
+		return err
+	}
+	a.groups[local] = group
+	metrics.RegisteredHostnames.Inc()
+	return nil
+}
+
+// PublishReverse makes avahi publish the reverse records of the IPs, an IP shared
+// by several hostnames resolves to the first one registered
+func (a *AvahiAnnouncer) PublishReverse(enabled bool) {
+	a.reverse = enabled
+}
+
+func (a *AvahiAnnouncer) newEntryGroup() (dbus.BusObject, error) {
+	var path dbus.ObjectPath
+	if err := a.server.Call(avahiServerInterface+".EntryGroupNew", 0).Store(&path); err != nil {
+		return nil, fmt.Errorf("Unable to create avahi entry group: %v", err)
+	}
+	return a.conn.Object(avahiService, path), nil
+}
+
+// retainAddresses publishes the address records of the hostname unless they already are
+func (a *AvahiAnnouncer) retainAddresses(local LocalHostname) error {
+	hostname := local.Hostname
+	if addresses, exists := a.addressGroups[hostname]; exists {
+		addresses.refs++
+		return nil
+	}
+	group, err := a.newEntryGroup()
+	if err != nil {
+		return err
+	}
+	host := hostname + ".local"
+	reverseIPs := map[string]bool{}
+	for _, iface := range a.ifaces {
+		ips, err := hostnameAddresses(local, a.addresses, iface)
+		if err != nil {
+			group.Call(avahiEntryGroupPrefix+".Free", 0)
+			return err
+		}
+		for _, ip := range a.family.Filter(ips) {
+			protocol := avahiProtoInet6
+			if ip.To4() != nil {
+				protocol = avahiProtoInet
+			}
+			flags := avahiPublishNoReverse
+			if _, owned := a.reverseOwners[ip.String()]; a.reverse && !owned && !reverseIPs[ip.String()] {
+				flags = 0
+				reverseIPs[ip.String()] = true
+			}
+			call := group.Call(avahiEntryGroupPrefix+".AddAddress", 0, int32(iface.Index), protocol, flags, host, ip.String())
+			if call.Err != nil {
+				group.Call(avahiEntryGroupPrefix+".Free", 0)
+				return fmt.Errorf("Unable to add address %v for %v: %v", ip, host, call.Err)
+			}
+		}
+	}
+	if call := group.Call(avahiEntryGroupPrefix+".Commit", 0); call.Err != nil {
+		group.Call(avahiEntryGroupPrefix+".Free", 0)
+		return fmt.Errorf("Unable to commit address entry group for %v: %v", host, call.Err)
+	}
+	a.addressGroups[hostname] = &avahiAddressGroup{group: group, refs: 1}
+	for ip := range reverseIPs {
+		a.reverseOwners[ip] = hostname
+	}
+	return nil
+}
+
+// releaseAddresses withdraws the address records once no service of the hostname is left
+func (a *AvahiAnnouncer) releaseAddresses(hostname string) {
+	addresses, exists := a.addressGroups[hostname]
+	if !exists {
+		return
+	}
+	addresses.refs--
+	if addresses.refs == 0 {
+		addresses.group.Call(avahiEntryGroupPrefix+".Free", 0)
+		delete(a.addressGroups, hostname)
+		for ip, owner := range a.reverseOwners {
+			if owner == hostname {
+				delete(a.reverseOwners, ip)
+			}
+		}
+	}
+}
+
+func (a *AvahiAnnouncer) addService(group dbus.BusObject, local LocalHostname, service Service) error {
+	host := local.Hostname + ".local"
+	txt := [][]byte{}
+	for _, entry := range service.Text {
+		txt = append(txt, []byte(entry))
+	}
+	for _, iface := range a.ifaces {
+		for _, serviceType := range service.AllTypes() {
+			call := group.Call(avahiEntryGroupPrefix+".AddService", 0,
+				int32(iface.Index), avahiProtoUnspec, uint32(0), local.Hostname, serviceType, "local", host, uint16(service.Port), txt)
+			if call.Err != nil {
+				return fmt.Errorf("Unable to add service %v for %v on %v: %v", serviceType, host, iface.Name, call.Err)
+			}
+			for _, subtype := range service.Subtypes[serviceType] {
+				call := group.Call(avahiEntryGroupPrefix+".AddServiceSubtype", 0,
+					int32(iface.Index), avahiProtoUnspec, uint32(0), local.Hostname, serviceType, "local", subtype+"._sub."+serviceType)
+				if call.Err != nil {
+					return fmt.Errorf("Unable to add subtype %v for %v on %v: %v", subtype, host, iface.Name, call.Err)
+				}
+			}
+		}
+	}
+	if call := group.Call(avahiEntryGroupPrefix+".Commit", 0); call.Err != nil {
+		return fmt.Errorf("Unable to commit entry group for %v: %v", host, call.Err)
+	}
+	return nil
+}
+
+// Unregister frees the entry group of the hostname
+func (a *AvahiAnnouncer) Unregister(local LocalHostname) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if group, exists := a.groups[local]; exists {
+		group.Call(avahiEntryGroupPrefix+".Free", 0)
+		delete(a.groups, local)
+		a.releaseAddresses(local.Hostname)
+		metrics.RegisteredHostnames.Dec()
+	}
+}
+
+// Reannounce does nothing, avahi-daemon announces and refreshes the records on its own
+func (a *AvahiAnnouncer) Reannounce() {}
+
+// Shutdown frees all entry groups and closes the D-Bus connection
+func (a *AvahiAnnouncer) Shutdown() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for local, group := range a.groups {
+		log.WithField("hostname", local.Hostname).Info("Unregistering hostname")
+		group.Call(avahiEntryGroupPrefix+".Free", 0)
+		delete(a.groups, local)
+		a.releaseAddresses(local.Hostname)
+		metrics.RegisteredHostnames.Dec()
+	}
+	a.conn.Close()
+}
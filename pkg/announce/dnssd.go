@@ -0,0 +1,120 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNSSDAnnouncer publishes hostnames by running a dns-sd -P proxy registration per
+// service, for developers running ingress-mdns on macOS where mDNSResponder owns
+// port 5353. dns-sd publishes a single address record per registration, the first
+// IP of the first interface is used.
+type DNSSDAnnouncer struct {
+	path      string
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+
+	lock      sync.Mutex
+	processes map[LocalHostname]*exec.Cmd
+}
+
+// NewDNSSDAnnouncer looks up the dns-sd binary in $PATH
+func NewDNSSDAnnouncer(ifaces []net.Interface, addresses AddressSource, family AddressFamily) (*DNSSDAnnouncer, error) {
+	path, err := exec.LookPath("dns-sd")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find dns-sd: %v", err)
+	}
+	return &DNSSDAnnouncer{
+		path:      path,
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		processes: map[LocalHostname]*exec.Cmd{},
+	}, nil
+}
+
+// Register starts the dns-sd process registering the service of the hostname
+func (d *DNSSDAnnouncer) Register(local LocalHostname, service Service) error {
+	ip, err := d.firstIP(local)
+	if err != nil {
+		return err
+	}
+	host := local.Hostname + ".local"
+	if len(service.Types) > 0 {
+		// A proxy registration of dns-sd only takes a single service type
+		log.WithField("hostname", local.Hostname).Warnf("dns-sd only registers %v, not %v", service.Type, strings.Join(service.Types, ", "))
+	}
+	args := []string{"-P", local.Hostname, service.WithSubtypes(service.Type), "local", strconv.Itoa(service.Port), host, ip.String()}
+	args = append(args, service.Text...)
+	cmd := exec.Command(d.path, args...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to run dns-sd for %v: %v", host, err)
+	}
+	go func() {
+		// Reaps the process, it only exits by itself when mDNSResponder is not available
+		if err := cmd.Wait(); err != nil && !d.stopped(local, cmd) {
+			log.WithField("hostname", local.Hostname).Errorf("dns-sd exited: %v", err)
+		}
+	}()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.processes[local] = cmd
+	metrics.RegisteredHostnames.Inc()
+	return nil
+}
+
+// firstIP returns the IP the hostname is published with
+func (d *DNSSDAnnouncer) firstIP(local LocalHostname) (net.IP, error) {
+	for _, iface := range d.ifaces {
+		ips, err := hostnameAddresses(local, d.addresses, iface)
+		if err != nil {
+			return nil, err
+		}
+		if ips = d.family.Filter(ips); len(ips) > 0 {
+			return ips[0], nil
+		}
+	}
+	return nil, fmt.Errorf("No IP to publish for %v", local.Hostname)
+}
+
+// stopped checks whether the process was stopped by Unregister or Shutdown
+func (d *DNSSDAnnouncer) stopped(local LocalHostname, cmd *exec.Cmd) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.processes[local] != cmd
+}
+
+// Unregister stops the dns-sd process of the hostname, which withdraws the registration
+func (d *DNSSDAnnouncer) Unregister(local LocalHostname) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if cmd, exists := d.processes[local]; exists {
+		delete(d.processes, local)
+		cmd.Process.Signal(os.Interrupt)
+		metrics.RegisteredHostnames.Dec()
+	}
+}
+
+// Reannounce does nothing, mDNSResponder announces the records on its own
+func (d *DNSSDAnnouncer) Reannounce() {}
+
+// Shutdown stops all dns-sd processes
+func (d *DNSSDAnnouncer) Shutdown() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for local, cmd := range d.processes {
+		log.WithField("hostname", local.Hostname).Info("Unregistering hostname")
+		delete(d.processes, local)
+		cmd.Process.Signal(os.Interrupt)
+		metrics.RegisteredHostnames.Dec()
+	}
+}
@@ -0,0 +1,223 @@
+package announce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportFormat selects the file format the hostnames are exported in
+type ExportFormat string
+
+// The supported export formats
+const (
+	// ExportHosts writes a hosts file, e.g. for the addn-hosts option of dnsmasq
+	ExportHosts ExportFormat = "hosts"
+	// ExportZone writes the address records of a BIND zone, to be $INCLUDEd in the zone file
+	ExportZone ExportFormat = "zone"
+)
+
+// ParseExportFormat validates an export format
+func ParseExportFormat(value string) (ExportFormat, error) {
+	switch format := ExportFormat(value); format {
+	case ExportHosts, ExportZone:
+		return format, nil
+	}
+	return "", fmt.Errorf("Unknown export format %v", value)
+}
+
+// FileExport keeps a file with the IPs of the hostnames registered with the wrapped
+// announcer up to date, for bridging the hostnames into conventional DNS. The file
+// is replaced atomically and the process in the pid file is sent SIGHUP to reread it.
+type FileExport struct {
+	Announcer
+	path      string
+	format    ExportFormat
+	zone      string
+	pidFile   string
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	ttl       uint32
+
+	lock sync.Mutex
+	// The registered services of each hostname
+	hostnames map[string][]LocalHostname
+	// Coalesces the changes within a second into a single write
+	pending *time.Timer
+}
+
+// NewFileExport writes the hostnames of the zone, e.g. local, to path
+func NewFileExport(
+	announcer Announcer,
+	path string,
+	format ExportFormat,
+	zone string,
+	pidFile string,
+	ifaces []net.Interface,
+	addresses AddressSource,
+	family AddressFamily,
+	ttl uint32,
+) *FileExport {
+	e := &FileExport{
+		Announcer: announcer,
+		path:      path,
+		format:    format,
+		zone:      dns.Fqdn(strings.Trim(zone, ".")),
+		pidFile:   pidFile,
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		ttl:       ttl,
+		hostnames: map[string][]LocalHostname{},
+	}
+	// Entries of a previous run are stale
+	e.write()
+	return e
+}
+
+// Register registers the hostname with the wrapped announcer and exports it
+func (e *FileExport) Register(local LocalHostname, service Service) error {
+	if err := e.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	e.hostnames[hostname] = append(e.hostnames[hostname], local)
+	e.changed()
+	return nil
+}
+
+// Unregister removes the hostname from the file once none of its services are left
+func (e *FileExport) Unregister(local LocalHostname) {
+	e.Announcer.Unregister(local)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	remaining := []LocalHostname{}
+	for _, registered := range e.hostnames[hostname] {
+		if registered != local {
+			remaining = append(remaining, registered)
+		}
+	}
+	if len(remaining) > 0 {
+		e.hostnames[hostname] = remaining
+		return
+	}
+	delete(e.hostnames, hostname)
+	e.changed()
+}
+
+// Shutdown empties the file and shuts down the wrapped announcer
+func (e *FileExport) Shutdown() {
+	e.lock.Lock()
+	e.hostnames = map[string][]LocalHostname{}
+	if e.pending != nil {
+		e.pending.Stop()
+	}
+	e.lock.Unlock()
+	e.write()
+	e.Announcer.Shutdown()
+}
+
+// changed schedules a write unless one is pending, the lock must be held
+func (e *FileExport) changed() {
+	if e.pending == nil {
+		e.pending = time.AfterFunc(time.Second, e.write)
+	}
+}
+
+// write replaces the file with the current hostnames and signals the pid file
+func (e *FileExport) write() {
+	e.lock.Lock()
+	e.pending = nil
+	lines := []string{}
+	for hostname, locals := range e.hostnames {
+		name := hostname + "." + e.zone
+		// The first service of a hostname decides the IPs it resolves to
+		for _, record := range hostnameRecords(name, dns.TypeANY, locals[0], e.ifaces, e.addresses, e.family, e.ttl) {
+			lines = append(lines, e.formatRecord(hostname, name, record))
+		}
+	}
+	e.lock.Unlock()
+	sort.Strings(lines)
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if e.format == ExportZone {
+		content = fmt.Sprintf("; Generated by ingress-mdns\n$TTL %v\n%v", e.ttl, content)
+	}
+	if err := writeFileAtomic(e.path, []byte(content)); err != nil {
+		log.Errorf("Unable to export the hostnames: %v", err)
+		return
+	}
+	log.Debugf("Exported %v records to %v", len(lines), e.path)
+	if e.pidFile != "" {
+		if err := hangup(e.pidFile); err != nil {
+			log.Errorf("Unable to signal the reload of %v: %v", e.path, err)
+		}
+	}
+}
+
+// formatRecord returns the line of the address record in the export format
+func (e *FileExport) formatRecord(hostname string, name string, record dns.RR) string {
+	var ip net.IP
+	switch r := record.(type) {
+	case *dns.A:
+		ip = r.A
+	case *dns.AAAA:
+		ip = r.AAAA
+	}
+	if e.format == ExportZone {
+		return fmt.Sprintf("%v\tIN\t%v\t%v", hostname, dns.TypeToString[record.Header().Rrtype], ip)
+	}
+	return fmt.Sprintf("%v\t%v", ip, strings.TrimSuffix(name, "."))
+}
+
+// writeFileAtomic writes the file next to path and renames it, so readers never see
+// a partially written file
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hangup sends SIGHUP to the process in the pid file, e.g. /var/run/dnsmasq.pid
+func hangup(pidFile string) error {
+	content, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("Invalid pid file %v: %v", pidFile, err)
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
@@ -0,0 +1,232 @@
+package announce
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProbeMode selects how the targets of the hostnames are probed
+type ProbeMode string
+
+// The supported probe modes
+const (
+	// ProbeTCP connects to the port of the hostname
+	ProbeTCP ProbeMode = "tcp"
+	// ProbeHTTP sends a request with the hostname as Host header, responses below
+	// 500 count as healthy
+	ProbeHTTP ProbeMode = "http"
+)
+
+// ParseProbeMode validates a probe mode
+func ParseProbeMode(value string) (ProbeMode, error) {
+	switch mode := ProbeMode(value); mode {
+	case ProbeTCP, ProbeHTTP:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown probe mode %v", value)
+}
+
+// HealthProbe only registers hostnames with the wrapped announcer while one of their
+// IPs responds on the port of the hostname. The hostnames are probed again
+// periodically, hostnames that stop responding are unregistered until they recover.
+type HealthProbe struct {
+	Announcer
+	mode      ProbeMode
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	timeout   time.Duration
+
+	lock      sync.Mutex
+	hostnames map[LocalHostname]*probedHostname
+}
+
+// probedHostname is a hostname registered with the probe and whether it is
+// currently registered with the wrapped announcer
+type probedHostname struct {
+	service Service
+	healthy bool
+}
+
+// NewHealthProbe probes the IPs of the hostnames, the advertised ones when they do
+// not have their own, giving up after timeout
+func NewHealthProbe(announcer Announcer, mode ProbeMode, ifaces []net.Interface, addresses AddressSource, family AddressFamily, timeout time.Duration) *HealthProbe {
+	return &HealthProbe{
+		Announcer: announcer,
+		mode:      mode,
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		timeout:   timeout,
+		hostnames: map[LocalHostname]*probedHostname{},
+	}
+}
+
+// Register probes the hostname and registers it with the wrapped announcer when it
+// responds, it fails otherwise so the registration is retried
+func (h *HealthProbe) Register(local LocalHostname, service Service) error {
+	if err := h.probe(local, service); err != nil {
+		return fmt.Errorf("Target does not respond: %v", err)
+	}
+	if err := h.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.hostnames[local] = &probedHostname{service: service, healthy: true}
+	h.updateMetric()
+	return nil
+}
+
+// Unregister stops probing the hostname and unregisters it unless it was withdrawn
+func (h *HealthProbe) Unregister(local LocalHostname) {
+	h.lock.Lock()
+	probed, exists := h.hostnames[local]
+	delete(h.hostnames, local)
+	h.updateMetric()
+	h.lock.Unlock()
+	if !exists || probed.healthy {
+		h.Announcer.Unregister(local)
+	}
+}
+
+// Shutdown stops probing all hostnames and shuts down the wrapped announcer
+func (h *HealthProbe) Shutdown() {
+	h.lock.Lock()
+	h.hostnames = map[LocalHostname]*probedHostname{}
+	h.updateMetric()
+	h.lock.Unlock()
+	h.Announcer.Shutdown()
+}
+
+// Run probes the registered hostnames every interval until stop is closed
+func (h *HealthProbe) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.probeAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probeAll withdraws the hostnames that stopped responding and registers the
+// withdrawn ones that respond again
+func (h *HealthProbe) probeAll() {
+	h.lock.Lock()
+	hostnames := map[LocalHostname]probedHostname{}
+	for local, probed := range h.hostnames {
+		hostnames[local] = *probed
+	}
+	h.lock.Unlock()
+	for local, probed := range hostnames {
+		err := h.probe(local, probed.service)
+		healthy := err == nil
+		if healthy == probed.healthy {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"hostname": local.Hostname, "port": probed.service.Port})
+		h.lock.Lock()
+		current, exists := h.hostnames[local]
+		if !exists || current.healthy != probed.healthy {
+			// Unregistered or changed while it was probed
+			h.lock.Unlock()
+			continue
+		}
+		if healthy {
+			if err := h.Announcer.Register(local, probed.service); err != nil {
+				logger.Errorf("Unable to register the recovered hostname: %v", err)
+				h.lock.Unlock()
+				continue
+			}
+			logger.Info("Target responds again, registered the hostname")
+		} else {
+			h.Announcer.Unregister(local)
+			logger.Warnf("Target stopped responding, unregistered the hostname: %v", err)
+		}
+		current.healthy = healthy
+		h.updateMetric()
+		h.lock.Unlock()
+	}
+}
+
+// probe checks whether any IP of the hostname responds on its port
+func (h *HealthProbe) probe(local LocalHostname, service Service) error {
+	ips := []net.IP{}
+	for _, iface := range h.ifaces {
+		ifaceIPs, err := hostnameAddresses(local, h.addresses, iface)
+		if err != nil {
+			return err
+		}
+		ips = append(ips, h.family.Filter(ifaceIPs)...)
+	}
+	var lastErr error = fmt.Errorf("No IPs to probe")
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(service.Port))
+		if lastErr = h.probeAddress(address, local); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// probeAddress connects to the address or sends it an HTTP request for the hostname
+func (h *HealthProbe) probeAddress(address string, local LocalHostname) error {
+	if h.mode == ProbeTCP {
+		conn, err := net.DialTimeout("tcp", address, h.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	scheme := "http"
+	if local.TLS {
+		scheme = "https"
+	}
+	request, err := http.NewRequest(http.MethodGet, scheme+"://"+address+"/", nil)
+	if err != nil {
+		return err
+	}
+	request.Host = local.Hostname + ".local"
+	client := &http.Client{
+		Timeout: h.timeout,
+		Transport: &http.Transport{
+			// The certificate is checked by the browsers, the probe only checks reachability
+			TLSClientConfig: &tls.Config{ServerName: request.Host, InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("Responded with %v", response.Status)
+	}
+	return nil
+}
+
+// updateMetric publishes the number of withdrawn hostnames, must be called with the lock held
+func (h *HealthProbe) updateMetric() {
+	unhealthy := 0
+	for _, probed := range h.hostnames {
+		if !probed.healthy {
+			unhealthy++
+		}
+	}
+	metrics.UnhealthyHostnames.Set(float64(unhealthy))
+}
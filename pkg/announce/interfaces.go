@@ -0,0 +1,123 @@
+package announce
+
+import (
+	"net"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often the interfaces are checked when link changes can not be subscribed to
+	interfacePollInterval = time.Second * 5
+	// How long further link changes are collected before the interfaces are checked
+	interfaceSettleDelay = time.Millisecond * 500
+)
+
+// InterfaceChange describes how a broadcast interface changed
+type InterfaceChange string
+
+// The reported interface changes
+const (
+	InterfaceDown InterfaceChange = "down"
+	InterfaceUp   InterfaceChange = "up"
+	// The IPs of the interface changed
+	InterfaceAddressesChanged InterfaceChange = "addresses"
+	// The interface was removed, or recreated with another index
+	InterfaceRemoved  InterfaceChange = "removed"
+	InterfaceReplaced InterfaceChange = "replaced"
+)
+
+// interfaceState is what is compared to detect changes of an interface
+type interfaceState struct {
+	iface  *net.Interface
+	up     bool
+	ips    []string
+	exists bool
+}
+
+func getInterfaceState(name string) interfaceState {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return interfaceState{}
+	}
+	state := interfaceState{iface: iface, up: iface.Flags&net.FlagUp != 0, exists: true}
+	if ips, err := InterfaceIPs(*iface); err == nil {
+		for _, ip := range ips {
+			state.ips = append(state.ips, ip.String())
+		}
+	}
+	return state
+}
+
+// MonitorInterfaces calls onChange whenever the link state or the IPs of one of
+// the interfaces change until stop is closed. Link changes are received through
+// netlink where supported, the interfaces are polled otherwise.
+func MonitorInterfaces(ifaces []net.Interface, onChange func(iface net.Interface, change InterfaceChange), stop <-chan struct{}) {
+	states := map[string]interfaceState{}
+	for _, iface := range ifaces {
+		states[iface.Name] = getInterfaceState(iface.Name)
+	}
+	changes := make(chan struct{}, 1)
+	if err := subscribeLinkChanges(changes, stop); err != nil {
+		log.Debugf("Polling the interfaces for changes: %v", err)
+	}
+	ticker := time.NewTicker(interfacePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changes:
+			// Links usually change in several steps, e.g. down, up and a new address
+			select {
+			case <-time.After(interfaceSettleDelay):
+			case <-stop:
+				return
+			}
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, iface := range ifaces {
+			previous := states[iface.Name]
+			current := getInterfaceState(iface.Name)
+			states[iface.Name] = current
+			for _, change := range compareInterfaceStates(iface.Index, previous, current) {
+				changed := iface
+				if current.iface != nil {
+					changed = *current.iface
+				}
+				log.WithField("interface", iface.Name).Infof("Interface changed: %v", change)
+				onChange(changed, change)
+			}
+		}
+	}
+}
+
+// compareInterfaceStates returns the changes between two states of the interface
+// that had the index when the monitor was started
+func compareInterfaceStates(index int, previous interfaceState, current interfaceState) []InterfaceChange {
+	switch {
+	case previous.exists && !current.exists:
+		return []InterfaceChange{InterfaceRemoved}
+	case !current.exists:
+		return nil
+	case current.iface.Index != index:
+		if previous.exists && previous.iface.Index == current.iface.Index {
+			// Already reported
+			return nil
+		}
+		return []InterfaceChange{InterfaceReplaced}
+	}
+	changes := []InterfaceChange{}
+	if previous.up && !current.up {
+		changes = append(changes, InterfaceDown)
+	}
+	if !previous.up && current.up {
+		changes = append(changes, InterfaceUp)
+	}
+	if !reflect.DeepEqual(previous.ips, current.ips) {
+		changes = append(changes, InterfaceAddressesChanged)
+	}
+	return changes
+}
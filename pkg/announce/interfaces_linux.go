@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package announce
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// subscribeLinkChanges sends to changes whenever a link or an address of any
+// interface changes according to netlink, until stop is closed
+func subscribeLinkChanges(changes chan<- struct{}, stop <-chan struct{}) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	address := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, address); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	go func() {
+		<-stop
+		// Wakes up the blocked Recvfrom
+		unix.Shutdown(fd, unix.SHUT_RDWR)
+	}()
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err != nil && err != unix.EINTR && err != unix.ENOBUFS {
+				return
+			}
+			if n == 0 && err == nil {
+				return
+			}
+			// The messages are not parsed, the interfaces are compared afterwards
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
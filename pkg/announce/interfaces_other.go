@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package announce
+
+import (
+	"fmt"
+)
+
+// subscribeLinkChanges is only supported through netlink on Linux
+func subscribeLinkChanges(changes chan<- struct{}, stop <-chan struct{}) error {
+	return fmt.Errorf("Link changes are only received on Linux")
+}
@@ -0,0 +1,208 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	llmnrGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 252), Port: 5355}
+	llmnrGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::1:3"), Port: 5355}
+)
+
+// TTL of the LLMNR answers recommended by RFC 4795
+const llmnrTTL = 30
+
+// LLMNR answers Link-Local Multicast Name Resolution queries for the hostnames
+// registered with the wrapped announcer, so Windows clients without Bonjour resolve
+// them. Both the single label, e.g. grafana, and grafana.local are answered.
+type LLMNR struct {
+	Announcer
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	ipv4conn  *ipv4.PacketConn
+	ipv6conn  *ipv6.PacketConn
+	closed    chan struct{}
+
+	lock sync.RWMutex
+	// The registered services of each hostname
+	hostnames map[string][]LocalHostname
+}
+
+// NewLLMNR joins the LLMNR groups of the address family on the interfaces and starts
+// answering queries
+func NewLLMNR(announcer Announcer, ifaces []net.Interface, addresses AddressSource, family AddressFamily) (*LLMNR, error) {
+	l := &LLMNR{
+		Announcer: announcer,
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		closed:    make(chan struct{}),
+		hostnames: map[string][]LocalHostname{},
+	}
+	if family != IPv6 {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 0), Port: llmnrGroupIPv4.Port})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to listen for LLMNR queries: %v", err)
+		}
+		l.ipv4conn = ipv4.NewPacketConn(conn)
+		l.ipv4conn.SetControlMessage(ipv4.FlagInterface, true)
+		for _, iface := range ifaces {
+			if err := l.ipv4conn.JoinGroup(&iface, &net.UDPAddr{IP: llmnrGroupIPv4.IP}); err != nil {
+				log.Warnf("Unable to join the LLMNR group on %v: %v", iface.Name, err)
+			}
+		}
+		go l.recv(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := l.ipv4conn.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, from, err
+			}
+			return n, cm.IfIndex, from, err
+		}, func(buf []byte, ifIndex int, to net.Addr) error {
+			_, err := l.ipv4conn.WriteTo(buf, &ipv4.ControlMessage{IfIndex: ifIndex}, to)
+			return err
+		})
+	}
+	if family != IPv4 {
+		conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.ParseIP("ff02::"), Port: llmnrGroupIPv6.Port})
+		if err != nil {
+			if l.ipv4conn != nil {
+				close(l.closed)
+				l.ipv4conn.Close()
+			}
+			return nil, fmt.Errorf("Unable to listen for LLMNR queries: %v", err)
+		}
+		l.ipv6conn = ipv6.NewPacketConn(conn)
+		l.ipv6conn.SetControlMessage(ipv6.FlagInterface, true)
+		for _, iface := range ifaces {
+			if err := l.ipv6conn.JoinGroup(&iface, &net.UDPAddr{IP: llmnrGroupIPv6.IP}); err != nil {
+				log.Warnf("Unable to join the LLMNR group on %v: %v", iface.Name, err)
+			}
+		}
+		go l.recv(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := l.ipv6conn.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, from, err
+			}
+			return n, cm.IfIndex, from, err
+		}, func(buf []byte, ifIndex int, to net.Addr) error {
+			_, err := l.ipv6conn.WriteTo(buf, &ipv6.ControlMessage{IfIndex: ifIndex}, to)
+			return err
+		})
+	}
+	log.Info("Answering LLMNR queries")
+	return l, nil
+}
+
+// Register registers the hostname with the wrapped announcer and starts answering for it
+func (l *LLMNR) Register(local LocalHostname, service Service) error {
+	if err := l.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	l.hostnames[hostname] = append(l.hostnames[hostname], local)
+	return nil
+}
+
+// Unregister stops answering for the hostname once none of its services are left
+func (l *LLMNR) Unregister(local LocalHostname) {
+	l.Announcer.Unregister(local)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	remaining := []LocalHostname{}
+	for _, registered := range l.hostnames[hostname] {
+		if registered != local {
+			remaining = append(remaining, registered)
+		}
+	}
+	if len(remaining) > 0 {
+		l.hostnames[hostname] = remaining
+	} else {
+		delete(l.hostnames, hostname)
+	}
+}
+
+// Shutdown closes the LLMNR connections and shuts down the wrapped announcer
+func (l *LLMNR) Shutdown() {
+	close(l.closed)
+	if l.ipv4conn != nil {
+		l.ipv4conn.Close()
+	}
+	if l.ipv6conn != nil {
+		l.ipv6conn.Close()
+	}
+	l.Announcer.Shutdown()
+}
+
+// recv answers the queries received on one connection until it is closed
+func (l *LLMNR) recv(read func(buf []byte) (int, int, net.Addr, error), write func(buf []byte, ifIndex int, to net.Addr) error) {
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, from, err := read(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+				continue
+			}
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil || query.Response || query.Opcode != dns.OpcodeQuery || len(query.Question) != 1 {
+			continue
+		}
+		resp := l.answer(query, ifIndex)
+		if resp == nil {
+			continue
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			log.Debugf("Unable to pack LLMNR answer: %v", err)
+			continue
+		}
+		// Answers are always sent as unicast to the querier
+		if err := write(packed, ifIndex, from); err != nil {
+			log.Debugf("Unable to answer LLMNR query of %v: %v", from, err)
+		}
+	}
+}
+
+// answer returns the response to the query with the IPs of the interface it was
+// received on, nil when the name is not registered so other responders may answer
+func (l *LLMNR) answer(query *dns.Msg, ifIndex int) *dns.Msg {
+	q := query.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA && q.Qtype != dns.TypeANY) {
+		return nil
+	}
+	hostname := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(q.Name), "."), ".local")
+	l.lock.RLock()
+	locals, exists := l.hostnames[hostname]
+	l.lock.RUnlock()
+	if !exists {
+		return nil
+	}
+	ifaces := []net.Interface{}
+	for _, iface := range l.ifaces {
+		if iface.Index == ifIndex {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = hostnameRecords(q.Name, q.Qtype, locals[0], ifaces, l.addresses, l.family, llmnrTTL)
+	return resp
+}
@@ -0,0 +1,72 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+// Answer is an address record of an mDNS response seen on the network
+type Answer struct {
+	// Name is the fully qualified name, e.g. grafana.local.
+	Name string
+	IP   net.IP
+	// From is the IP of the responder
+	From net.IP
+}
+
+// MonitorAnswers listens for the mDNS responses on the interfaces and calls onAnswer
+// with each of their address records until stop is closed
+func MonitorAnswers(ifaces []net.Interface, onAnswer func(Answer), stop <-chan struct{}) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 0), Port: mdnsGroup.Port})
+	if err != nil {
+		return fmt.Errorf("Unable to listen for mDNS responses: %v", err)
+	}
+	packetConn := ipv4.NewPacketConn(conn)
+	joined := 0
+	for _, iface := range ifaces {
+		if err := packetConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroup.IP}); err != nil {
+			log.Debugf("Unable to monitor mDNS responses on %v: %v", iface.Name, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		conn.Close()
+		return fmt.Errorf("Unable to join the mDNS group on any interface")
+	}
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	go func() {
+		packet := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(packet)
+			if err != nil {
+				select {
+				case <-stop:
+					return
+				default:
+					continue
+				}
+			}
+			msg := new(dns.Msg)
+			if err := msg.Unpack(packet[:n]); err != nil || !msg.Response {
+				continue
+			}
+			for _, record := range append(msg.Answer, msg.Extra...) {
+				switch r := record.(type) {
+				case *dns.A:
+					onAnswer(Answer{Name: r.Hdr.Name, IP: r.A, From: from.IP})
+				case *dns.AAAA:
+					onAnswer(Answer{Name: r.Hdr.Name, IP: r.AAAA, From: from.IP})
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,222 @@
+package announce
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	netbiosPort = 137
+	// NetBIOS names are 15 characters followed by a suffix byte
+	netbiosNameLength = 15
+	// The suffixes of workstation and file server names
+	netbiosWorkstation = 0x00
+	netbiosServer      = 0x20
+	netbiosTypeNB      = 0x0020
+	netbiosClassIN     = 0x0001
+	netbiosTTL         = 300
+)
+
+// NetBIOS answers NetBIOS name service queries for the hostnames registered with the
+// wrapped announcer, for legacy Windows tooling. The names are truncated to 15
+// characters, hostnames truncated to a name already in use are not answered.
+type NetBIOS struct {
+	Announcer
+	ifaces    []net.Interface
+	addresses AddressSource
+	conn      *ipv4.PacketConn
+	closed    chan struct{}
+
+	lock sync.RWMutex
+	// The hostname each NetBIOS name belongs to with its registered services
+	names map[string][]LocalHostname
+}
+
+// NewNetBIOS starts answering the name queries broadcast to port 137
+func NewNetBIOS(announcer Announcer, ifaces []net.Interface, addresses AddressSource) (*NetBIOS, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: netbiosPort})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for NetBIOS name queries: %v", err)
+	}
+	n := &NetBIOS{
+		Announcer: announcer,
+		ifaces:    ifaces,
+		addresses: addresses,
+		conn:      ipv4.NewPacketConn(conn),
+		closed:    make(chan struct{}),
+		names:     map[string][]LocalHostname{},
+	}
+	n.conn.SetControlMessage(ipv4.FlagInterface, true)
+	go n.recv()
+	log.Info("Answering NetBIOS name queries")
+	return n, nil
+}
+
+// NetBIOSName returns the NetBIOS name of the hostname, upper case and truncated
+func NetBIOSName(hostname string) string {
+	name := strings.ToUpper(hostname)
+	if len(name) > netbiosNameLength {
+		name = name[:netbiosNameLength]
+	}
+	return name
+}
+
+// Register registers the hostname with the wrapped announcer and answers for its
+// NetBIOS name unless another hostname has it
+func (n *NetBIOS) Register(local LocalHostname, service Service) error {
+	if err := n.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	name := NetBIOSName(local.Hostname)
+	locals := n.names[name]
+	if len(locals) > 0 && !strings.EqualFold(locals[0].Hostname, local.Hostname) {
+		log.Warnf("Not answering the NetBIOS name %v for %v, it belongs to %v", name, local.Hostname, locals[0].Hostname)
+		return nil
+	}
+	if len(locals) == 0 {
+		log.Infof("Answering the NetBIOS name %v for %v", name, local.Hostname)
+	}
+	n.names[name] = append(locals, local)
+	return nil
+}
+
+// Unregister stops answering for the NetBIOS name once none of its services are left
+func (n *NetBIOS) Unregister(local LocalHostname) {
+	n.Announcer.Unregister(local)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	name := NetBIOSName(local.Hostname)
+	remaining := []LocalHostname{}
+	for _, registered := range n.names[name] {
+		if registered != local {
+			remaining = append(remaining, registered)
+		}
+	}
+	if len(remaining) > 0 {
+		n.names[name] = remaining
+	} else {
+		delete(n.names, name)
+	}
+}
+
+// Shutdown closes the NetBIOS connection and shuts down the wrapped announcer
+func (n *NetBIOS) Shutdown() {
+	close(n.closed)
+	n.conn.Close()
+	n.Announcer.Shutdown()
+}
+
+// recv answers the name queries until the connection is closed
+func (n *NetBIOS) recv() {
+	buf := make([]byte, 1500)
+	for {
+		size, cm, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			default:
+				continue
+			}
+		}
+		if cm == nil {
+			continue
+		}
+		resp := n.answer(buf[:size], cm.IfIndex)
+		if resp == nil {
+			continue
+		}
+		if _, err := n.conn.WriteTo(resp, nil, from); err != nil {
+			log.Debugf("Unable to answer NetBIOS query of %v: %v", from, err)
+		}
+	}
+}
+
+// answer returns the positive name query response with the IPv4 addresses of the
+// interface the query was received on, nil when the name is not ours
+func (n *NetBIOS) answer(query []byte, ifIndex int) []byte {
+	// Header, length byte, encoded name, scope terminator, type and class
+	if len(query) < 12+1+32+1+4 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	questions := binary.BigEndian.Uint16(query[4:6])
+	// Only name queries (opcode 0) that are requests
+	if flags&0x8000 != 0 || (flags>>11)&0xf != 0 || questions != 1 || query[12] != 32 {
+		return nil
+	}
+	name, suffix, ok := decodeNetBIOSName(query[13:45])
+	if !ok || query[45] != 0 || (suffix != netbiosWorkstation && suffix != netbiosServer) {
+		return nil
+	}
+	if binary.BigEndian.Uint16(query[46:48]) != netbiosTypeNB || binary.BigEndian.Uint16(query[48:50]) != netbiosClassIN {
+		return nil
+	}
+	n.lock.RLock()
+	locals, exists := n.names[name]
+	n.lock.RUnlock()
+	if !exists {
+		return nil
+	}
+	ips := []net.IP{}
+	for _, iface := range n.ifaces {
+		if iface.Index != ifIndex {
+			continue
+		}
+		ifaceIPs, err := hostnameAddresses(locals[0], n.addresses, iface)
+		if err != nil {
+			log.Debugf("Unable to get the addresses of %v: %v", iface.Name, err)
+			return nil
+		}
+		ips = IPv4.Filter(ifaceIPs)
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	resp := make([]byte, 0, 62+6*len(ips))
+	resp = append(resp, query[0:2]...)
+	// Response, authoritative answer, recursion desired copied from the query
+	resp = appendUint16(resp, 0x8400|(flags&0x0100))
+	resp = appendUint16(resp, 0)
+	resp = appendUint16(resp, 1)
+	resp = appendUint16(resp, 0)
+	resp = appendUint16(resp, 0)
+	resp = append(resp, query[12:46]...)
+	resp = appendUint16(resp, netbiosTypeNB)
+	resp = appendUint16(resp, netbiosClassIN)
+	resp = append(resp, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(resp[len(resp)-4:], netbiosTTL)
+	resp = appendUint16(resp, uint16(6*len(ips)))
+	for _, ip := range ips {
+		// Unique name of a B-node
+		resp = appendUint16(resp, 0)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+// decodeNetBIOSName decodes the first level encoding of RFC 1001 into the name
+// without its padding and the suffix
+func decodeNetBIOSName(encoded []byte) (string, byte, bool) {
+	decoded := make([]byte, 16)
+	for i := range decoded {
+		high, low := encoded[2*i]-'A', encoded[2*i+1]-'A'
+		if high > 15 || low > 15 {
+			return "", 0, false
+		}
+		decoded[i] = high<<4 | low
+	}
+	return strings.ToUpper(strings.TrimRight(string(decoded[:netbiosNameLength]), " ")), decoded[netbiosNameLength], true
+}
+
+func appendUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value>>8), byte(value))
+}
@@ -0,0 +1,122 @@
+package announce
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Resolve returns the IPs of the mDNS name on any of the interfaces
+func Resolve(ifaces []net.Interface, name string, timeout time.Duration) []string {
+	records := []dns.RR{}
+	for _, iface := range ifaces {
+		records = append(records, Query(iface, []uint16{dns.TypeA, dns.TypeAAAA}, name, timeout, true)...)
+		if ips := AddressesOf(records, name); len(ips) > 0 {
+			return ips
+		}
+	}
+	return []string{}
+}
+
+// AddressesOf returns the distinct IPs of the A and AAAA records of the name
+func AddressesOf(records []dns.RR, name string) []string {
+	ips := []string{}
+	for _, record := range records {
+		if !strings.EqualFold(record.Header().Name, name) {
+			continue
+		}
+		var ip string
+		switch r := record.(type) {
+		case *dns.A:
+			ip = r.A.String()
+		case *dns.AAAA:
+			ip = r.AAAA.String()
+		default:
+			continue
+		}
+		if !containsString(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// ServiceTypes returns the distinct service types listed on the interface in answers
+// to the _services._dns-sd._udp meta-query, e.g. _http._tcp.local.
+func ServiceTypes(iface net.Interface, timeout time.Duration) []string {
+	types := []string{}
+	for _, record := range Query(iface, []uint16{dns.TypePTR}, "_services._dns-sd._udp.local.", timeout, false) {
+		if ptr, ok := record.(*dns.PTR); ok && !containsString(types, ptr.Ptr) {
+			types = append(types, ptr.Ptr)
+		}
+	}
+	return types
+}
+
+// Query sends a query asking for unicast responses and collects the answers until
+// the timeout, or until the first response when first is set
+func Query(iface net.Interface, qtypes []uint16, name string, timeout time.Duration, first bool) []dns.RR {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		log.Errorf("Unable to open a socket for querying %v: %v", name, err)
+		return nil
+	}
+	defer conn.Close()
+	if err := ipv4.NewPacketConn(conn).SetMulticastInterface(&iface); err != nil {
+		log.Debugf("Unable to query on interface %v: %v", iface.Name, err)
+		return nil
+	}
+	query := new(dns.Msg)
+	query.Id = uint16(rand.Intn(1 << 16))
+	for _, qtype := range qtypes {
+		// The top bit of the class is the unicast-response bit, the responses are
+		// only received on the port the query was sent from
+		query.Question = append(query.Question, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET | 1<<15})
+	}
+	buf, err := query.Pack()
+	if err != nil {
+		log.Errorf("Unable to pack the query for %v: %v", name, err)
+		return nil
+	}
+	if _, err := conn.WriteToUDP(buf, mdnsGroup); err != nil {
+		log.Debugf("Unable to send the query for %v on %v: %v", name, iface.Name, err)
+		return nil
+	}
+	records := []dns.RR{}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	packet := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			// The deadline was reached
+			return records
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(packet[:n]); err != nil {
+			log.Debugf("Unable to parse the response from %v: %v", from, err)
+			continue
+		}
+		log.Debugf("%v answered %v on %v", from, name, iface.Name)
+		records = append(records, resp.Answer...)
+		records = append(records, resp.Extra...)
+		if first && len(resp.Answer) > 0 {
+			return records
+		}
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package announce
+
+import (
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RefCounted lets several objects register the same hostname with the wrapped announcer,
+// e.g. Ingresses splitting the paths of a host across namespaces, or the same host in
+// several clusters. The hostname is only unregistered once all of them unregistered it.
+// Owners registering the hostname with another port, TXT record or IPs do not start
+// a second registration, the registration of the most recent owner is broadcast.
+type RefCounted struct {
+	Announcer
+
+	lock sync.Mutex
+	// Registrations of the owners of each hostname, the broadcast one is the last
+	owners map[hostnameKey][]ownerRegistration
+}
+
+// hostnameKey identifies a hostname regardless of how it is advertised
+type hostnameKey struct {
+	hostname string
+	tls      bool
+}
+
+// ownerRegistration is a registration of a hostname by refs owners
+type ownerRegistration struct {
+	local   LocalHostname
+	service Service
+	refs    int
+}
+
+// NewRefCounted counts the registrations of the hostnames of the announcer
+func NewRefCounted(announcer Announcer) *RefCounted {
+	return &RefCounted{
+		Announcer: announcer,
+		owners:    map[hostnameKey][]ownerRegistration{},
+	}
+}
+
+// Register registers the hostname with the wrapped announcer. A hostname that is
+// already registered is registered anew when the registration changed, e.g. another
+// port, the broadcast registration registered again only counts another owner.
+func (r *RefCounted) Register(local LocalHostname, service Service) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := hostnameKey{hostname: local.Hostname, tls: local.TLS}
+	owners := r.owners[key]
+	if len(owners) > 0 {
+		if last := &owners[len(owners)-1]; last.local == local && reflect.DeepEqual(last.service, service) {
+			last.refs++
+			return nil
+		}
+	}
+	registration := ownerRegistration{local: local, service: service, refs: 1}
+	others := []ownerRegistration{}
+	for _, owner := range owners {
+		if owner.local == local {
+			registration.refs += owner.refs
+		} else {
+			others = append(others, owner)
+		}
+	}
+	if len(owners) == 0 {
+		if err := r.Announcer.Register(local, service); err != nil {
+			return err
+		}
+	} else if err := r.replace(owners[len(owners)-1].local, local, service); err != nil {
+		log.WithField("hostname", local.Hostname).Warnf("Hostname is no longer broadcast for %v other objects until it is registered again", countRefs(owners))
+		return err
+	}
+	r.owners[key] = append(others, registration)
+	return nil
+}
+
+// Unregister unregisters the hostname from the wrapped announcer once it was
+// unregistered as often as it was registered. The registration of the most
+// recent remaining owner takes over when the broadcast one is unregistered.
+func (r *RefCounted) Unregister(local LocalHostname) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := hostnameKey{hostname: local.Hostname, tls: local.TLS}
+	owners := r.owners[key]
+	index := -1
+	for i, owner := range owners {
+		if owner.local == local {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+	logger := log.WithField("hostname", local.Hostname)
+	if owners[index].refs > 1 {
+		owners[index].refs--
+		logger.Debugf("Hostname is still registered for %v other objects", countRefs(owners)-1)
+		return
+	}
+	remaining := append(append([]ownerRegistration{}, owners[:index]...), owners[index+1:]...)
+	if len(remaining) == 0 {
+		delete(r.owners, key)
+		r.Announcer.Unregister(local)
+		return
+	}
+	r.owners[key] = remaining
+	logger.Debugf("Hostname is still registered for %v other objects", countRefs(remaining))
+	if index < len(owners)-1 {
+		return
+	}
+	next := remaining[len(remaining)-1]
+	if err := r.replace(local, next.local, next.service); err != nil {
+		logger.Errorf("Unable to broadcast the hostname for the remaining objects: %v", err)
+	}
+}
+
+// replace broadcasts local instead of previous. It is registered before previous is
+// withdrawn, so the records both have in common are not sent goodbye packets, unless
+// the wrapped announcer refuses a second service of the same name like avahi does.
+func (r *RefCounted) replace(previous LocalHostname, local LocalHostname, service Service) error {
+	if previous != local {
+		if err := r.Announcer.Register(local, service); err == nil {
+			r.Announcer.Unregister(previous)
+			return nil
+		}
+	}
+	r.Announcer.Unregister(previous)
+	return r.Announcer.Register(local, service)
+}
+
+// Shutdown forgets all registrations and shuts down the wrapped announcer
+func (r *RefCounted) Shutdown() {
+	r.lock.Lock()
+	r.owners = map[hostnameKey][]ownerRegistration{}
+	r.lock.Unlock()
+	r.Announcer.Shutdown()
+}
+
+// countRefs returns the number of owners of the registrations
+func countRefs(owners []ownerRegistration) int {
+	refs := 0
+	for _, owner := range owners {
+		refs += owner.refs
+	}
+	return refs
+}
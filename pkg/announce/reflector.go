@@ -0,0 +1,181 @@
+package announce
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// How long reflected packets are remembered, so the copies received on the other
+// interfaces are not reflected back
+const reflectedMemory = time.Second
+
+var mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+
+// Reflector relays the mDNS queries and responses received on one interface to all
+// others, so clients on a second segment, e.g. a VPN or bridge, resolve the hostnames
+// broadcast on the first one. The answers of the local responder are relayed as well.
+type Reflector struct {
+	ifaces   []net.Interface
+	ipv4conn *ipv4.PacketConn
+	ipv6conn *ipv6.PacketConn
+
+	lock sync.Mutex
+	// When packets were last sent by their hash
+	reflected map[uint64]time.Time
+}
+
+// NewReflector joins the mDNS groups on the interfaces, at least two are needed
+func NewReflector(ifaces []net.Interface) (*Reflector, error) {
+	if len(ifaces) < 2 {
+		return nil, fmt.Errorf("At least two interfaces are needed to reflect between")
+	}
+	r := &Reflector{ifaces: ifaces, reflected: map[uint64]time.Time{}}
+	if conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 0), Port: mdnsGroup.Port}); err == nil {
+		r.ipv4conn = ipv4.NewPacketConn(conn)
+		r.ipv4conn.SetControlMessage(ipv4.FlagInterface, true)
+		joined := 0
+		for _, iface := range ifaces {
+			if err := r.ipv4conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroup.IP}); err != nil {
+				log.Debugf("Unable to reflect IPv4 on %v: %v", iface.Name, err)
+				continue
+			}
+			joined++
+		}
+		if joined < 2 {
+			r.ipv4conn.Close()
+			r.ipv4conn = nil
+		}
+	}
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.ParseIP("ff02::"), Port: mdnsGroupIPv6.Port}); err == nil {
+		r.ipv6conn = ipv6.NewPacketConn(conn)
+		r.ipv6conn.SetControlMessage(ipv6.FlagInterface, true)
+		joined := 0
+		for _, iface := range ifaces {
+			if err := r.ipv6conn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6.IP}); err != nil {
+				log.Debugf("Unable to reflect IPv6 on %v: %v", iface.Name, err)
+				continue
+			}
+			joined++
+		}
+		if joined < 2 {
+			r.ipv6conn.Close()
+			r.ipv6conn = nil
+		}
+	}
+	if r.ipv4conn == nil && r.ipv6conn == nil {
+		return nil, fmt.Errorf("Unable to join the mDNS group on at least two of the interfaces")
+	}
+	return r, nil
+}
+
+// Run relays the packets until stop is closed
+func (r *Reflector) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	if r.ipv4conn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.relay(stop, func(buf []byte) (int, int, error) {
+				n, cm, _, err := r.ipv4conn.ReadFrom(buf)
+				if cm == nil {
+					return n, 0, err
+				}
+				return n, cm.IfIndex, err
+			}, func(buf []byte, ifIndex int) error {
+				_, err := r.ipv4conn.WriteTo(buf, &ipv4.ControlMessage{IfIndex: ifIndex}, mdnsGroup)
+				return err
+			})
+		}()
+	}
+	if r.ipv6conn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.relay(stop, func(buf []byte) (int, int, error) {
+				n, cm, _, err := r.ipv6conn.ReadFrom(buf)
+				if cm == nil {
+					return n, 0, err
+				}
+				return n, cm.IfIndex, err
+			}, func(buf []byte, ifIndex int) error {
+				_, err := r.ipv6conn.WriteTo(buf, &ipv6.ControlMessage{IfIndex: ifIndex}, mdnsGroupIPv6)
+				return err
+			})
+		}()
+	}
+	<-stop
+	if r.ipv4conn != nil {
+		r.ipv4conn.Close()
+	}
+	if r.ipv6conn != nil {
+		r.ipv6conn.Close()
+	}
+	wg.Wait()
+}
+
+// relay sends every packet read on one of the interfaces to the other interfaces
+func (r *Reflector) relay(stop <-chan struct{}, read func(buf []byte) (int, int, error), write func(buf []byte, ifIndex int) error) {
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, err := read(buf)
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
+		if ifIndex == 0 || !r.hasInterface(ifIndex) || !r.remember(buf[:n]) {
+			continue
+		}
+		for _, iface := range r.ifaces {
+			if iface.Index == ifIndex {
+				continue
+			}
+			if err := write(buf[:n], iface.Index); err != nil {
+				log.Debugf("Unable to reflect a packet to %v: %v", iface.Name, err)
+				continue
+			}
+			metrics.CountReflectedPacket(iface.Name)
+		}
+	}
+}
+
+func (r *Reflector) hasInterface(ifIndex int) bool {
+	for _, iface := range r.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// remember records the packet as reflected, it returns false when it was reflected
+// recently, i.e. it is a copy of one of our own packets
+func (r *Reflector) remember(packet []byte) bool {
+	hash := fnv.New64a()
+	hash.Write(packet)
+	key := hash.Sum64()
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for other, sent := range r.reflected {
+		if now.Sub(sent) > reflectedMemory {
+			delete(r.reflected, other)
+		}
+	}
+	if _, exists := r.reflected[key]; exists {
+		return false
+	}
+	r.reflected[key] = now
+	return true
+}
@@ -0,0 +1,126 @@
+package announce
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	resolvedService          = "org.freedesktop.resolve1"
+	resolvedPath             = "/org/freedesktop/resolve1"
+	resolvedManagerInterface = "org.freedesktop.resolve1.Manager"
+)
+
+// ResolvedAnnouncer publishes hostnames as DNS-SD services through the mDNS responder
+// of systemd-resolved on the node, so ingress-mdns does not compete with it for port 5353.
+// resolved only publishes the address records of the node's own hostname, the services
+// point at it and hostnames with their own IPs cannot be registered.
+type ResolvedAnnouncer struct {
+	conn    *dbus.Conn
+	manager dbus.BusObject
+
+	lock sync.Mutex
+	// Paths of the services of each hostname, one per service type
+	services map[LocalHostname][]dbus.ObjectPath
+}
+
+// NewResolvedAnnouncer connects to systemd-resolved via the system D-Bus
+func NewResolvedAnnouncer() (*ResolvedAnnouncer, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the system bus: %v", err)
+	}
+	manager := conn.Object(resolvedService, resolvedPath)
+	mdns, err := manager.GetProperty(resolvedManagerInterface + ".MulticastDNS")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to reach systemd-resolved: %v", err)
+	}
+	if value, _ := mdns.Value().(string); value != "yes" {
+		conn.Close()
+		return nil, fmt.Errorf("The mDNS responder of systemd-resolved is disabled, set MulticastDNS=yes in resolved.conf")
+	}
+	return &ResolvedAnnouncer{
+		conn:     conn,
+		manager:  manager,
+		services: map[LocalHostname][]dbus.ObjectPath{},
+	}, nil
+}
+
+// Register publishes a service of the hostname per service type via RegisterService
+func (r *ResolvedAnnouncer) Register(local LocalHostname, service Service) error {
+	if local.IPs != "" {
+		return fmt.Errorf("systemd-resolved cannot publish the IPs %v of %v, only those of the node", local.IPs, local.Hostname)
+	}
+	txt := map[string][]byte{}
+	for _, entry := range service.Text {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			txt[parts[0]] = nil
+			continue
+		}
+		txt[parts[0]] = []byte(parts[1])
+	}
+	if len(service.Subtypes) > 0 {
+		log.WithField("hostname", local.Hostname).Warn("systemd-resolved cannot publish subtypes, only the service types")
+	}
+	paths := []dbus.ObjectPath{}
+	for _, serviceType := range service.AllTypes() {
+		// The id names the service on the bus, the name template is the instance name
+		// with % escaped since resolved expands specifiers like %H in it
+		id := strings.ReplaceAll(fmt.Sprintf("ingress-mdns-%v-%v", local.Hostname, strings.Trim(serviceType, "_.")), "._", "-")
+		var path dbus.ObjectPath
+		call := r.manager.Call(resolvedManagerInterface+".RegisterService", 0,
+			id, strings.ReplaceAll(local.Hostname, "%", "%%"), serviceType, uint16(service.Port), uint16(0), uint16(0), []map[string][]byte{txt})
+		if err := call.Store(&path); err != nil {
+			r.unregisterServices(local, paths)
+			return fmt.Errorf("Unable to register %v as %v with systemd-resolved: %v", local.Hostname, serviceType, err)
+		}
+		paths = append(paths, path)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.services[local] = paths
+	metrics.RegisteredHostnames.Inc()
+	return nil
+}
+
+// Unregister withdraws the service of the hostname
+func (r *ResolvedAnnouncer) Unregister(local LocalHostname) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if paths, exists := r.services[local]; exists {
+		r.unregisterServices(local, paths)
+		delete(r.services, local)
+		metrics.RegisteredHostnames.Dec()
+	}
+}
+
+func (r *ResolvedAnnouncer) unregisterServices(local LocalHostname, paths []dbus.ObjectPath) {
+	for _, path := range paths {
+		if call := r.manager.Call(resolvedManagerInterface+".UnregisterService", 0, path); call.Err != nil {
+			log.WithField("hostname", local.Hostname).Errorf("Unable to unregister service from systemd-resolved: %v", call.Err)
+		}
+	}
+}
+
+// Reannounce does nothing, systemd-resolved announces the records on its own
+func (r *ResolvedAnnouncer) Reannounce() {}
+
+// Shutdown unregisters all services and closes the D-Bus connection
+func (r *ResolvedAnnouncer) Shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for local, paths := range r.services {
+		log.WithField("hostname", local.Hostname).Info("Unregistering hostname")
+		r.unregisterServices(local, paths)
+		delete(r.services, local)
+		metrics.RegisteredHostnames.Dec()
+	}
+	r.conn.Close()
+}
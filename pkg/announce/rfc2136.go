@@ -0,0 +1,158 @@
+package announce
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// TSIGKey authenticates dynamic updates, see RFC 8945
+type TSIGKey struct {
+	Name string
+	// Algorithm is e.g. hmac-sha256
+	Algorithm string
+	// Secret is the base64 encoded key
+	Secret string
+}
+
+// DynamicDNS pushes the address records of the hostnames registered with the wrapped
+// announcer to a DNS server via RFC 2136 updates, for clients on routed subnets that
+// multicast does not reach
+type DynamicDNS struct {
+	Announcer
+	server    string
+	zone      string
+	key       *TSIGKey
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	ttl       uint32
+	client    *dns.Client
+
+	lock sync.Mutex
+	// The registered services of each hostname
+	hostnames map[string][]LocalHostname
+}
+
+// NewDynamicDNS sends the updates of the zone, e.g. mdns.example.com, to the server,
+// signed with the key unless it is nil
+func NewDynamicDNS(
+	announcer Announcer,
+	server string,
+	zone string,
+	key *TSIGKey,
+	ifaces []net.Interface,
+	addresses AddressSource,
+	family AddressFamily,
+	ttl uint32,
+) *DynamicDNS {
+	d := &DynamicDNS{
+		Announcer: announcer,
+		server:    server,
+		zone:      dns.Fqdn(strings.Trim(zone, ".")),
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		ttl:       ttl,
+		client:    &dns.Client{Net: "tcp", Timeout: time.Second * 5},
+		hostnames: map[string][]LocalHostname{},
+	}
+	if key != nil {
+		d.key = &TSIGKey{
+			Name:      dns.Fqdn(strings.ToLower(key.Name)),
+			Algorithm: dns.Fqdn(strings.ToLower(key.Algorithm)),
+			Secret:    key.Secret,
+		}
+		d.client.TsigSecret = map[string]string{d.key.Name: key.Secret}
+	}
+	return d
+}
+
+// Register registers the hostname with the wrapped announcer and pushes its address
+// records, the first service of a hostname decides the IPs it resolves to
+func (d *DynamicDNS) Register(local LocalHostname, service Service) error {
+	if err := d.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	if len(d.hostnames[hostname]) == 0 {
+		if err := d.update(hostname, &local); err != nil {
+			d.Announcer.Unregister(local)
+			return err
+		}
+	}
+	d.hostnames[hostname] = append(d.hostnames[hostname], local)
+	return nil
+}
+
+// Unregister deletes the address records once none of the services of the hostname are left
+func (d *DynamicDNS) Unregister(local LocalHostname) {
+	d.Announcer.Unregister(local)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	remaining := []LocalHostname{}
+	for _, registered := range d.hostnames[hostname] {
+		if registered != local {
+			remaining = append(remaining, registered)
+		}
+	}
+	if len(remaining) > 0 {
+		d.hostnames[hostname] = remaining
+		return
+	}
+	delete(d.hostnames, hostname)
+	if err := d.update(hostname, nil); err != nil {
+		log.WithField("hostname", local.Hostname).Errorf("Unable to delete the address records: %v", err)
+	}
+}
+
+// Shutdown deletes the address records of all hostnames and shuts down the wrapped announcer
+func (d *DynamicDNS) Shutdown() {
+	d.lock.Lock()
+	for hostname := range d.hostnames {
+		if err := d.update(hostname, nil); err != nil {
+			log.WithField("hostname", hostname).Errorf("Unable to delete the address records: %v", err)
+		}
+		delete(d.hostnames, hostname)
+	}
+	d.lock.Unlock()
+	d.Announcer.Shutdown()
+}
+
+// update replaces the A and AAAA records of the hostname with its current IPs,
+// they are only deleted when local is nil
+func (d *DynamicDNS) update(hostname string, local *LocalHostname) error {
+	name := hostname + "." + d.zone
+	msg := new(dns.Msg)
+	msg.SetUpdate(d.zone)
+	msg.RemoveRRset([]dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}},
+	})
+	if local != nil {
+		records := hostnameRecords(name, dns.TypeANY, *local, d.ifaces, d.addresses, d.family, d.ttl)
+		if len(records) == 0 {
+			return fmt.Errorf("No IPs to publish for %v", name)
+		}
+		msg.Insert(records)
+	}
+	if d.key != nil {
+		msg.SetTsig(d.key.Name, d.key.Algorithm, 300, time.Now().Unix())
+	}
+	resp, _, err := d.client.Exchange(msg, d.server)
+	if err != nil {
+		return fmt.Errorf("Unable to update %v on %v: %v", name, d.server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Update of %v was refused by %v: %v", name, d.server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
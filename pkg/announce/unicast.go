@@ -0,0 +1,157 @@
+package announce
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// UnicastDNS serves the address records of the hostnames registered with the wrapped
+// announcer over unicast DNS, for clients that do not resolve arbitrary names via mDNS
+type UnicastDNS struct {
+	Announcer
+	ifaces    []net.Interface
+	addresses AddressSource
+	family    AddressFamily
+	zone      string
+	ttl       uint32
+	servers   []*dns.Server
+
+	lock sync.RWMutex
+	// The registered services of each hostname
+	hostnames map[string][]LocalHostname
+}
+
+// NewUnicastDNS starts a DNS server on addr answering queries for names in the zone,
+// e.g. local or internal
+func NewUnicastDNS(
+	announcer Announcer,
+	addr string,
+	zone string,
+	ifaces []net.Interface,
+	addresses AddressSource,
+	family AddressFamily,
+	ttl uint32,
+) *UnicastDNS {
+	u := &UnicastDNS{
+		Announcer: announcer,
+		ifaces:    ifaces,
+		addresses: addresses,
+		family:    family,
+		zone:      dns.Fqdn(strings.Trim(zone, ".")),
+		ttl:       ttl,
+		hostnames: map[string][]LocalHostname{},
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: addr, Net: network, Handler: dns.HandlerFunc(u.serveDNS)}
+		u.servers = append(u.servers, server)
+		go func() {
+			log.Infof("Serving unicast DNS for zone %v on %v/%v", u.zone, server.Addr, server.Net)
+			if err := server.ListenAndServe(); err != nil {
+				log.Errorf("Unicast DNS server on %v/%v failed: %v", server.Addr, server.Net, err)
+			}
+		}()
+	}
+	return u
+}
+
+// Register registers the hostname with the wrapped announcer and starts serving it
+func (u *UnicastDNS) Register(local LocalHostname, service Service) error {
+	if err := u.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	u.hostnames[hostname] = append(u.hostnames[hostname], local)
+	return nil
+}
+
+// Unregister stops serving the hostname once none of its services are left
+func (u *UnicastDNS) Unregister(local LocalHostname) {
+	u.Announcer.Unregister(local)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	remaining := []LocalHostname{}
+	for _, registered := range u.hostnames[hostname] {
+		if registered != local {
+			remaining = append(remaining, registered)
+		}
+	}
+	if len(remaining) > 0 {
+		u.hostnames[hostname] = remaining
+	} else {
+		delete(u.hostnames, hostname)
+	}
+}
+
+// Shutdown stops the DNS servers and the wrapped announcer
+func (u *UnicastDNS) Shutdown() {
+	for _, server := range u.servers {
+		server.Shutdown()
+	}
+	u.Announcer.Shutdown()
+}
+
+func (u *UnicastDNS) serveDNS(w dns.ResponseWriter, query *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Authoritative = true
+	for _, q := range query.Question {
+		name := strings.ToLower(q.Name)
+		if !dns.IsSubDomain(u.zone, name) {
+			resp.Rcode = dns.RcodeRefused
+			continue
+		}
+		hostname := strings.TrimSuffix(strings.TrimSuffix(name, u.zone), ".")
+		u.lock.RLock()
+		locals, exists := u.hostnames[hostname]
+		u.lock.RUnlock()
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+			continue
+		}
+		resp.Answer = append(resp.Answer, u.addressRecords(q, locals[0])...)
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		log.Debugf("Unable to answer DNS query: %v", err)
+	}
+}
+
+// addressRecords returns the A or AAAA records of the hostname answering the question
+func (u *UnicastDNS) addressRecords(q dns.Question, local LocalHostname) []dns.RR {
+	return hostnameRecords(q.Name, q.Qtype, local, u.ifaces, u.addresses, u.family, u.ttl)
+}
+
+// hostnameRecords returns the distinct A and AAAA records of the IPs of the hostname on
+// the interfaces, only those of qtype unless it is ANY
+func hostnameRecords(name string, qtype uint16, local LocalHostname, ifaces []net.Interface, addresses AddressSource, family AddressFamily, ttl uint32) []dns.RR {
+	records := []dns.RR{}
+	seen := map[string]bool{}
+	for _, iface := range ifaces {
+		ips, err := hostnameAddresses(local, addresses, iface)
+		if err != nil {
+			log.Debugf("Unable to get the addresses of %v: %v", iface.Name, err)
+			continue
+		}
+		for _, ip := range family.Filter(ips) {
+			if seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+			if ip4 := ip.To4(); ip4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+				header.Rrtype = dns.TypeA
+				records = append(records, &dns.A{Hdr: header, A: ip4})
+			} else if ip4 == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+				header.Rrtype = dns.TypeAAAA
+				records = append(records, &dns.AAAA{Hdr: header, AAAA: ip})
+			}
+		}
+	}
+	return records
+}
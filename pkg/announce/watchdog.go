@@ -0,0 +1,114 @@
+package announce
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Watchdog periodically resolves a sample of the hostnames registered with the wrapped
+// announcer via mDNS, catching responders that silently stopped answering
+type Watchdog struct {
+	Announcer
+	ifaces  []net.Interface
+	sample  int
+	timeout time.Duration
+	// Re-announce all hostnames when a sampled hostname cannot be resolved
+	reannounce bool
+
+	lock sync.Mutex
+	// Number of registered services of each hostname
+	hostnames map[string]int
+}
+
+// NewWatchdog resolves up to sample of the registered hostnames on each probe, waiting
+// timeout for the responses
+func NewWatchdog(announcer Announcer, ifaces []net.Interface, sample int, timeout time.Duration, reannounce bool) *Watchdog {
+	return &Watchdog{
+		Announcer:  announcer,
+		ifaces:     ifaces,
+		sample:     sample,
+		timeout:    timeout,
+		reannounce: reannounce,
+		hostnames:  map[string]int{},
+	}
+}
+
+// Register registers the hostname with the wrapped announcer and adds it to the sampled hostnames
+func (w *Watchdog) Register(local LocalHostname, service Service) error {
+	if err := w.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.hostnames[strings.ToLower(local.Hostname)]++
+	return nil
+}
+
+// Unregister stops sampling the hostname once none of its services are left
+func (w *Watchdog) Unregister(local LocalHostname) {
+	w.Announcer.Unregister(local)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	hostname := strings.ToLower(local.Hostname)
+	if w.hostnames[hostname] <= 1 {
+		delete(w.hostnames, hostname)
+		return
+	}
+	w.hostnames[hostname]--
+}
+
+// Run probes the registered hostnames every interval until stop is closed
+func (w *Watchdog) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.probe()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probe resolves a random sample of the registered hostnames
+func (w *Watchdog) probe() {
+	w.lock.Lock()
+	hostnames := []string{}
+	for hostname := range w.hostnames {
+		hostnames = append(hostnames, hostname)
+	}
+	w.lock.Unlock()
+	rand.Shuffle(len(hostnames), func(i, j int) { hostnames[i], hostnames[j] = hostnames[j], hostnames[i] })
+	if len(hostnames) > w.sample {
+		hostnames = hostnames[:w.sample]
+	}
+	unresolvable := 0
+	for _, hostname := range hostnames {
+		if len(Resolve(w.ifaces, hostname+".local.", w.timeout)) > 0 {
+			metrics.CountWatchdogProbe(true)
+			continue
+		}
+		// The hostname may have been unregistered while it was resolved
+		w.lock.Lock()
+		_, registered := w.hostnames[hostname]
+		w.lock.Unlock()
+		if !registered {
+			continue
+		}
+		metrics.CountWatchdogProbe(false)
+		log.WithField("hostname", hostname).Warnf("Registered hostname cannot be resolved via mDNS within %v", w.timeout)
+		unresolvable++
+	}
+	metrics.WatchdogUnresolvable.Set(float64(unresolvable))
+	if unresolvable > 0 && w.reannounce {
+		log.Info("Re-announcing all hostnames")
+		w.Announcer.Reannounce()
+	}
+}
@@ -0,0 +1,288 @@
+package announce
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+var wsDiscoveryGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 3702}
+
+const (
+	wsdNamespace = "http://schemas.xmlsoap.org/ws/2005/04/discovery"
+	// Multicast messages are addressed to the discovery URN, responses anonymously
+	wsdTo        = "urn:schemas-xmlsoap-org:ws:2005:04:discovery"
+	wsaAnonymous = "http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous"
+	// Type the endpoints are announced as
+	wsdType = "wsdp:Device"
+)
+
+// wsdEnvelope is the part of received SOAP messages that is needed to answer them
+type wsdEnvelope struct {
+	Header struct {
+		Action    string `xml:"Action"`
+		MessageID string `xml:"MessageID"`
+	} `xml:"Header"`
+	Body struct {
+		Probe *struct {
+			Types string `xml:"Types"`
+		} `xml:"Probe"`
+		Resolve *struct {
+			Address string `xml:"EndpointReference>Address"`
+		} `xml:"Resolve"`
+	} `xml:"Body"`
+}
+
+// wsdEndpoint is a registered HTTP endpoint
+type wsdEndpoint struct {
+	address string
+	xaddrs  string
+}
+
+// WSDiscovery announces the HTTP endpoints of the hostnames registered with the
+// wrapped announcer via WS-Discovery, for the Windows network view and industrial
+// clients. Hello and Bye messages are multicast when hostnames are registered and
+// unregistered, Probe and Resolve messages are answered.
+type WSDiscovery struct {
+	Announcer
+	ifaces     []net.Interface
+	conn       *ipv4.PacketConn
+	closed     chan struct{}
+	instanceID int64
+
+	lock          sync.Mutex
+	messageNumber int
+	endpoints     map[LocalHostname]wsdEndpoint
+}
+
+// NewWSDiscovery joins the WS-Discovery group on the interfaces and starts answering probes
+func NewWSDiscovery(announcer Announcer, ifaces []net.Interface) (*WSDiscovery, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: wsDiscoveryGroup.Port})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for WS-Discovery probes: %v", err)
+	}
+	w := &WSDiscovery{
+		Announcer:  announcer,
+		ifaces:     ifaces,
+		conn:       ipv4.NewPacketConn(conn),
+		closed:     make(chan struct{}),
+		instanceID: time.Now().Unix(),
+		endpoints:  map[LocalHostname]wsdEndpoint{},
+	}
+	w.conn.SetControlMessage(ipv4.FlagInterface, true)
+	joined := 0
+	for _, iface := range ifaces {
+		if err := w.conn.JoinGroup(&iface, &net.UDPAddr{IP: wsDiscoveryGroup.IP}); err != nil {
+			log.Warnf("Unable to join the WS-Discovery group on %v: %v", iface.Name, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to join the WS-Discovery group on any interface")
+	}
+	go w.recv()
+	log.Info("Answering WS-Discovery probes")
+	return w, nil
+}
+
+// Register registers the hostname with the wrapped announcer and sends a Hello for
+// its endpoint
+func (w *WSDiscovery) Register(local LocalHostname, service Service) error {
+	if err := w.Announcer.Register(local, service); err != nil {
+		return err
+	}
+	scheme := "http"
+	if local.TLS {
+		scheme = "https"
+	}
+	endpoint := wsdEndpoint{
+		address: endpointAddress(local, service),
+		xaddrs:  fmt.Sprintf("%v://%v.local:%v/", scheme, local.Hostname, service.Port),
+	}
+	w.lock.Lock()
+	w.endpoints[local] = endpoint
+	w.lock.Unlock()
+	w.multicast("Hello", fmt.Sprintf(
+		"<wsd:Hello>%v<wsd:MetadataVersion>1</wsd:MetadataVersion></wsd:Hello>", endpoint.xml()))
+	return nil
+}
+
+// Unregister sends a Bye for the endpoint of the hostname
+func (w *WSDiscovery) Unregister(local LocalHostname) {
+	w.Announcer.Unregister(local)
+	w.lock.Lock()
+	endpoint, exists := w.endpoints[local]
+	delete(w.endpoints, local)
+	for _, other := range w.endpoints {
+		// Still registered for the same hostname and port, e.g. with another TXT record
+		if other.address == endpoint.address {
+			exists = false
+		}
+	}
+	w.lock.Unlock()
+	if exists {
+		w.multicast("Bye", fmt.Sprintf("<wsd:Bye><wsa:EndpointReference><wsa:Address>%v</wsa:Address></wsa:EndpointReference></wsd:Bye>", escapeXML(endpoint.address)))
+	}
+}
+
+// Shutdown sends a Bye for all endpoints, closes the connection and shuts down the
+// wrapped announcer
+func (w *WSDiscovery) Shutdown() {
+	w.lock.Lock()
+	locals := []LocalHostname{}
+	for local := range w.endpoints {
+		locals = append(locals, local)
+	}
+	w.lock.Unlock()
+	for _, local := range locals {
+		w.Unregister(local)
+	}
+	close(w.closed)
+	w.conn.Close()
+	w.Announcer.Shutdown()
+}
+
+// recv answers the probes and resolves until the connection is closed
+func (w *WSDiscovery) recv() {
+	buf := make([]byte, 65536)
+	for {
+		n, cm, from, err := w.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-w.closed:
+				return
+			default:
+				continue
+			}
+		}
+		if cm != nil && !w.hasInterface(cm.IfIndex) {
+			continue
+		}
+		envelope := wsdEnvelope{}
+		if err := xml.Unmarshal(buf[:n], &envelope); err != nil {
+			continue
+		}
+		var action, body string
+		switch {
+		case envelope.Body.Probe != nil && matchesTypes(envelope.Body.Probe.Types):
+			action, body = "ProbeMatches", w.matches("Probe", func(wsdEndpoint) bool { return true })
+		case envelope.Body.Resolve != nil:
+			address := strings.TrimSpace(envelope.Body.Resolve.Address)
+			action, body = "ResolveMatches", w.matches("Resolve", func(endpoint wsdEndpoint) bool {
+				return endpoint.address == address
+			})
+		}
+		if body == "" {
+			continue
+		}
+		message := w.message(action, wsaAnonymous, fmt.Sprintf("<wsa:RelatesTo>%v</wsa:RelatesTo>", escapeXML(envelope.Header.MessageID)), body)
+		if _, err := w.conn.WriteTo(message, nil, from); err != nil {
+			log.Debugf("Unable to answer WS-Discovery message of %v: %v", from, err)
+		}
+	}
+}
+
+// matches returns the ProbeMatches or ResolveMatches body of the matching endpoints,
+// empty when none match
+func (w *WSDiscovery) matches(kind string, match func(wsdEndpoint) bool) string {
+	w.lock.Lock()
+	matched := []string{}
+	for _, endpoint := range w.endpoints {
+		if match(endpoint) {
+			matched = append(matched, fmt.Sprintf("<wsd:%vMatch>%v<wsd:MetadataVersion>1</wsd:MetadataVersion></wsd:%vMatch>", kind, endpoint.xml(), kind))
+		}
+	}
+	w.lock.Unlock()
+	if len(matched) == 0 {
+		return ""
+	}
+	sort.Strings(matched)
+	return fmt.Sprintf("<wsd:%vMatches>%v</wsd:%vMatches>", kind, strings.Join(matched, ""), kind)
+}
+
+// multicast sends the message on all interfaces
+func (w *WSDiscovery) multicast(action string, body string) {
+	message := w.message(action, wsdTo, "", body)
+	for _, iface := range w.ifaces {
+		if _, err := w.conn.WriteTo(message, &ipv4.ControlMessage{IfIndex: iface.Index}, wsDiscoveryGroup); err != nil {
+			log.Debugf("Unable to send WS-Discovery %v on %v: %v", action, iface.Name, err)
+		}
+	}
+}
+
+// message wraps the body in a SOAP envelope with the addressing headers
+func (w *WSDiscovery) message(action string, to string, headers string, body string) []byte {
+	w.lock.Lock()
+	w.messageNumber++
+	messageNumber := w.messageNumber
+	w.lock.Unlock()
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>`+
+		`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:wsd="%v" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof">`+
+		`<soap:Header><wsa:To>%v</wsa:To><wsa:Action>%v/%v</wsa:Action><wsa:MessageID>urn:uuid:%v</wsa:MessageID>%v`+
+		`<wsd:AppSequence InstanceId="%v" MessageNumber="%v"/></soap:Header>`+
+		`<soap:Body>%v</soap:Body></soap:Envelope>`,
+		wsdNamespace, to, wsdNamespace, action, randomUUID(), headers, w.instanceID, messageNumber, body))
+}
+
+func (w *WSDiscovery) hasInterface(ifIndex int) bool {
+	for _, iface := range w.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// xml returns the EndpointReference, Types and XAddrs of the endpoint
+func (e wsdEndpoint) xml() string {
+	return fmt.Sprintf("<wsa:EndpointReference><wsa:Address>%v</wsa:Address></wsa:EndpointReference><wsd:Types>%v</wsd:Types><wsd:XAddrs>%v</wsd:XAddrs>",
+		escapeXML(e.address), wsdType, escapeXML(e.xaddrs))
+}
+
+// matchesTypes returns whether a probe for the space separated types matches the
+// endpoints, probes without types match everything
+func matchesTypes(types string) bool {
+	for _, value := range strings.Fields(types) {
+		if value != wsdType && !strings.HasSuffix(value, ":Device") {
+			return false
+		}
+	}
+	return true
+}
+
+// endpointAddress derives a stable URN of the endpoint from its hostname and port
+func endpointAddress(local LocalHostname, service Service) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%v:%v:%v", local.Hostname, local.TLS, service.Port)))
+	return "urn:uuid:" + formatUUID(sum[:16])
+}
+
+func randomUUID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return formatUUID(id)
+}
+
+// formatUUID formats the bytes as a version 4 UUID
+func formatUUID(id []byte) string {
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+func escapeXML(value string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(value))
+	return buf.String()
+}
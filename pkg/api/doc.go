@@ -0,0 +1,4 @@
+// Package api holds the gRPC API of ingress-mdns, served with --grpc-addr
+package api
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative registrations.proto
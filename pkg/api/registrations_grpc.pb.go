@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// RegistrationsClient is the client API for Registrations service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RegistrationsClient interface {
+	// ListRegistrations returns the hostnames currently broadcast
+	ListRegistrations(ctx context.Context, in *ListRegistrationsRequest, opts ...grpc.CallOption) (*ListRegistrationsResponse, error)
+	// Register broadcasts an ad-hoc hostname until its TTL expires, requires --admin-api
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	// Unregister stops broadcasting an ad-hoc hostname, requires --admin-api
+	Unregister(ctx context.Context, in *UnregisterRequest, opts ...grpc.CallOption) (*UnregisterResponse, error)
+	// Reannounce broadcasts the records of all hostnames again
+	Reannounce(ctx context.Context, in *ReannounceRequest, opts ...grpc.CallOption) (*ReannounceResponse, error)
+}
+
+type registrationsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRegistrationsClient(cc grpc.ClientConnInterface) RegistrationsClient {
+	return &registrationsClient{cc}
+}
+
+func (c *registrationsClient) ListRegistrations(ctx context.Context, in *ListRegistrationsRequest, opts ...grpc.CallOption) (*ListRegistrationsResponse, error) {
+	out := new(ListRegistrationsResponse)
+	err := c.cc.Invoke(ctx, "/ingressmdns.v1.Registrations/ListRegistrations", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationsClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/ingressmdns.v1.Registrations/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationsClient) Unregister(ctx context.Context, in *UnregisterRequest, opts ...grpc.CallOption) (*UnregisterResponse, error) {
+	out := new(UnregisterResponse)
+	err := c.cc.Invoke(ctx, "/ingressmdns.v1.Registrations/Unregister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationsClient) Reannounce(ctx context.Context, in *ReannounceRequest, opts ...grpc.CallOption) (*ReannounceResponse, error) {
+	out := new(ReannounceResponse)
+	err := c.cc.Invoke(ctx, "/ingressmdns.v1.Registrations/Reannounce", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RegistrationsServer is the server API for Registrations service.
+// All implementations must embed UnimplementedRegistrationsServer
+// for forward compatibility
+type RegistrationsServer interface {
+	// ListRegistrations returns the hostnames currently broadcast
+	ListRegistrations(context.Context, *ListRegistrationsRequest) (*ListRegistrationsResponse, error)
+	// Register broadcasts an ad-hoc hostname until its TTL expires, requires --admin-api
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	// Unregister stops broadcasting an ad-hoc hostname, requires --admin-api
+	Unregister(context.Context, *UnregisterRequest) (*UnregisterResponse, error)
+	// Reannounce broadcasts the records of all hostnames again
+	Reannounce(context.Context, *ReannounceRequest) (*ReannounceResponse, error)
+	mustEmbedUnimplementedRegistrationsServer()
+}
+
+// UnimplementedRegistrationsServer must be embedded to have forward compatible implementations.
+type UnimplementedRegistrationsServer struct {
+}
+
+func (UnimplementedRegistrationsServer) ListRegistrations(context.Context, *ListRegistrationsRequest) (*ListRegistrationsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRegistrations not implemented")
+}
+func (UnimplementedRegistrationsServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedRegistrationsServer) Unregister(context.Context, *UnregisterRequest) (*UnregisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Unregister not implemented")
+}
+func (UnimplementedRegistrationsServer) Reannounce(context.Context, *ReannounceRequest) (*ReannounceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reannounce not implemented")
+}
+func (UnimplementedRegistrationsServer) mustEmbedUnimplementedRegistrationsServer() {}
+
+// UnsafeRegistrationsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RegistrationsServer will
+// result in compilation errors.
+type UnsafeRegistrationsServer interface {
+	mustEmbedUnimplementedRegistrationsServer()
+}
+
+func RegisterRegistrationsServer(s grpc.ServiceRegistrar, srv RegistrationsServer) {
+	s.RegisterService(&Registrations_ServiceDesc, srv)
+}
+
+func _Registrations_ListRegistrations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRegistrationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationsServer).ListRegistrations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ingressmdns.v1.Registrations/ListRegistrations",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationsServer).ListRegistrations(ctx, req.(*ListRegistrationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registrations_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationsServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ingressmdns.v1.Registrations/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationsServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registrations_Unregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationsServer).Unregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ingressmdns.v1.Registrations/Unregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationsServer).Unregister(ctx, req.(*UnregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registrations_Reannounce_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReannounceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationsServer).Reannounce(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ingressmdns.v1.Registrations/Reannounce",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationsServer).Reannounce(ctx, req.(*ReannounceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Registrations_ServiceDesc is the grpc.ServiceDesc for Registrations service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Registrations_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ingressmdns.v1.Registrations",
+	HandlerType: (*RegistrationsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListRegistrations",
+			Handler:    _Registrations_ListRegistrations_Handler,
+		},
+		{
+			MethodName: "Register",
+			Handler:    _Registrations_Register_Handler,
+		},
+		{
+			MethodName: "Unregister",
+			Handler:    _Registrations_Unregister_Handler,
+		},
+		{
+			MethodName: "Reannounce",
+			Handler:    _Registrations_Reannounce_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "registrations.proto",
+}
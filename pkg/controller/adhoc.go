@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// MaxAdHocTTL is the longest an ad-hoc registration stays broadcast
+const MaxAdHocTTL = time.Hour * 24
+
+// AdHocRequest is an ad-hoc registration as posted to /registrations
+type AdHocRequest struct {
+	// Hostname is the broadcast name, with or without .local
+	Hostname string   `json:"hostname"`
+	IP       string   `json:"ip"`
+	Port     int      `json:"port"`
+	TLS      bool     `json:"tls"`
+	TXT      []string `json:"txt"`
+	// TTL is how long the hostname is broadcast, e.g. 30m, 1h when empty
+	TTL string `json:"ttl"`
+}
+
+// AdHocRegistrations broadcasts hostnames that do not belong to any object, e.g. a
+// service running on a developer's workstation, until their TTL expires. Like the
+// hostnames of the other sources they are only broadcast while the manager runs the
+// controllers and when they belong to the shard of this replica.
+type AdHocRegistrations struct {
+	registrations *objectRegistrations
+
+	lock sync.Mutex
+	// Set while the manager runs the controllers, with --leader-elect while leading
+	leading bool
+	entries map[string]*adHocEntry
+}
+
+// adHocEntry is a registered ad-hoc hostname with the timer unregistering it
+type adHocEntry struct {
+	local announce.LocalHostname
+	timer *time.Timer
+}
+
+// NewAdHocRegistrations creates the ad-hoc registrations of the controller, they are
+// broadcast once added as one of its sources
+func NewAdHocRegistrations(controller *Controller) *AdHocRegistrations {
+	return &AdHocRegistrations{
+		registrations: newObjectRegistrations(controller),
+		entries:       map[string]*adHocEntry{},
+	}
+}
+
+// SetupWithManager only broadcasts the ad-hoc hostnames while the manager runs the
+// controllers, the hostnames added until then are registered once it does
+func (a *AdHocRegistrations) SetupWithManager(mgr manager.Manager) error {
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		a.lock.Lock()
+		a.leading = true
+		a.lock.Unlock()
+		a.Resync(false)
+		<-ctx.Done()
+		a.lock.Lock()
+		a.leading = false
+		a.lock.Unlock()
+		return nil
+	}))
+}
+
+// Resync registers the ad-hoc hostnames again, which are left out when they belong
+// to the shard of another replica
+func (a *AdHocRegistrations) Resync(force bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.leading {
+		return
+	}
+	for hostname, entry := range a.entries {
+		if err := a.registrations.Update(context.Background(), hostname, adHocRef(hostname), []announce.LocalHostname{entry.local}, force); err != nil {
+			log.WithField("hostname", hostname).Warnf("Unable to register ad-hoc hostname: %v", err)
+		}
+	}
+}
+
+// Add registers the hostname of the request, replacing an earlier ad-hoc
+// registration of the same hostname
+func (a *AdHocRegistrations) Add(request AdHocRequest) error {
+	hostname := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(request.Hostname, "."), ".local"))
+	if err := ValidateHostname(hostname); err != nil {
+		return err
+	}
+	if net.ParseIP(request.IP) == nil {
+		return fmt.Errorf("Invalid IP %q", request.IP)
+	}
+	if request.Port <= 0 || request.Port > 65535 {
+		return fmt.Errorf("Invalid port %v", request.Port)
+	}
+	ttl := time.Hour
+	if request.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid TTL %q", request.TTL)
+		}
+	}
+	if ttl > MaxAdHocTTL {
+		return fmt.Errorf("The TTL must not exceed %v", MaxAdHocTTL)
+	}
+	local := announce.LocalHostname{
+		TLS:      request.TLS,
+		Hostname: hostname,
+		Port:     request.Port,
+		TXT:      strings.Join(request.TXT, ","),
+		IPs:      request.IP,
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if entry, exists := a.entries[hostname]; exists {
+		entry.timer.Stop()
+		delete(a.entries, hostname)
+	}
+	if a.leading {
+		// The registration of a replaced hostname is updated to the new one
+		if err := a.registrations.Update(context.Background(), hostname, adHocRef(hostname), []announce.LocalHostname{local}, false); err != nil {
+			a.registrations.Remove(context.Background(), hostname, adHocRef(hostname))
+			return err
+		}
+	}
+	entry := &adHocEntry{local: local}
+	entry.timer = time.AfterFunc(ttl, func() { a.expire(hostname, entry) })
+	a.entries[hostname] = entry
+	log.WithField("hostname", hostname).Infof("Broadcasting ad-hoc hostname for %v", ttl)
+	return nil
+}
+
+// Remove unregisters the ad-hoc hostname, returns false when it is not registered
+func (a *AdHocRegistrations) Remove(hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(hostname, "."), ".local"))
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entry, exists := a.entries[hostname]
+	if !exists {
+		return false
+	}
+	entry.timer.Stop()
+	a.registrations.Remove(context.Background(), hostname, adHocRef(hostname))
+	delete(a.entries, hostname)
+	return true
+}
+
+// expire unregisters the entry once its TTL passed, unless it was replaced
+func (a *AdHocRegistrations) expire(hostname string, entry *adHocEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.entries[hostname] != entry {
+		return
+	}
+	log.WithField("hostname", hostname).Info("Ad-hoc hostname expired")
+	a.registrations.Remove(context.Background(), hostname, adHocRef(hostname))
+	delete(a.entries, hostname)
+}
+
+// adHocRef identifies an ad-hoc registration, it has no UID so no events are recorded
+func adHocRef(hostname string) ObjectRef {
+	return ObjectRef{Kind: "AdHoc", Name: hostname}
+}
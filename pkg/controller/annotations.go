@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The TXT record of objects without a TXT annotation
+const defaultTXT = "path=/"
+
+// The annotation holding comma separated key=value pairs published as the TXT record
+const txtAnnotation = "ingress-mdns.secoya.io/txt"
+
+// The annotation holding comma separated names that are broadcast in addition to the hosts of the object
+const aliasesAnnotation = "ingress-mdns.secoya.io/aliases"
+
+// The annotation holding comma separated hostnames a Service is broadcast under with --services
+const hostnameAnnotation = "ingress-mdns.secoya.io/hostname"
+
+// The annotation holding comma separated IPs the hostnames of the object resolve to instead of the advertised IPs
+const advertiseIPAnnotation = "ingress-mdns.secoya.io/advertise-ip"
+
+// The annotation holding the port advertised instead of the ports of the ingress controller,
+// either a single port or e.g. "http=8080,https=8443"
+const portAnnotation = "ingress-mdns.secoya.io/port"
+
+// The annotation holding comma separated DNS-SD service types the hostnames of the object
+// are advertised as in addition to the default type, e.g. "_grafana._tcp"
+const serviceTypeAnnotation = "ingress-mdns.secoya.io/service-type"
+
+// The annotation holding comma separated DNS-SD subtypes the hostnames of the object are
+// published under, either of all service types (_printer) or of one (_printer._sub._http._tcp)
+const subtypesAnnotation = "ingress-mdns.secoya.io/subtypes"
+
+// The annotation the broadcast state is written to with --write-status
+const statusAnnotation = "ingress-mdns.secoya.io/status"
+
+// getTXT returns the validated TXT entries of the object's annotation, joined by commas
+func getTXT(obj metav1.Object) string {
+	value, exists := obj.GetAnnotations()[txtAnnotation]
+	if !exists {
+		return ""
+	}
+	entries := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// Every entry is a single length-prefixed string in the TXT record
+		if strings.HasPrefix(entry, "=") || len(entry) > 255 {
+			log.Warnf("Ignoring invalid TXT entry %q of %v/%v", entry, obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ",")
+}
+
+// withMetadata appends entries identifying the object to the TXT entries,
+// so the owner of a hostname can be found with e.g. dns-sd -L
+func withMetadata(txt string, ref ObjectRef, class string) string {
+	if txt == "" {
+		txt = defaultTXT
+	}
+	entries := []string{txt, "kind=" + ref.Kind, "namespace=" + ref.Namespace, "name=" + ref.Name}
+	if class != "" {
+		entries = append(entries, "class="+class)
+	}
+	return strings.Join(entries, ",")
+}
+
+// withAliases adds the aliases of the object's annotation to its hostnames,
+// they are advertised on the same ports as the hostnames of the object
+func withAliases(obj metav1.Object, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	value, exists := obj.GetAnnotations()[aliasesAnnotation]
+	if !exists {
+		return hostnames
+	}
+	templates := hostnames
+	for _, alias := range strings.Split(value, ",") {
+		alias = strings.TrimSuffix(strings.TrimSpace(alias), ".local")
+		if alias == "" {
+			continue
+		}
+		if strings.ContainsAny(alias, "* ") {
+			log.Warnf("Ignoring invalid alias %q of %v/%v", alias, obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		for _, template := range templates {
+			local := template
+			local.Hostname = alias
+			if !containsHostname(hostnames, local) {
+				hostnames = append(hostnames, local)
+			}
+		}
+	}
+	return hostnames
+}
+
+// withAdvertiseIPs lets the hostnames resolve to the IPs of the object's annotation,
+// e.g. a MetalLB VIP, instead of the advertised IPs
+func withAdvertiseIPs(obj metav1.Object, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	value, exists := obj.GetAnnotations()[advertiseIPAnnotation]
+	if !exists {
+		return hostnames
+	}
+	ips := []string{}
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			log.Warnf("Ignoring invalid advertise IP %q of %v/%v", ip, obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return hostnames
+	}
+	for index := range hostnames {
+		hostnames[index].IPs = strings.Join(ips, ",")
+	}
+	return hostnames
+}
+
+// serviceTypePattern matches a DNS-SD service type, an underscore prefixed service name
+// of at most 15 characters and the protocol, see RFC 6335 section 5.1
+var serviceTypePattern = regexp.MustCompile(`^_[A-Za-z0-9]([A-Za-z0-9-]{0,13}[A-Za-z0-9])?\._(tcp|udp)$`)
+
+// withServiceTypes advertises the hostnames as the service types of the object's
+// annotation in addition to the default type
+func withServiceTypes(obj metav1.Object, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	value, exists := obj.GetAnnotations()[serviceTypeAnnotation]
+	if !exists {
+		return hostnames
+	}
+	types := []string{}
+	for _, serviceType := range strings.Split(value, ",") {
+		serviceType = strings.TrimSuffix(strings.TrimSpace(serviceType), ".local")
+		if serviceType == "" {
+			continue
+		}
+		if !serviceTypePattern.MatchString(serviceType) {
+			log.Warnf("Ignoring invalid service type %q of %v/%v", serviceType, obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		types = append(types, serviceType)
+	}
+	for index := range hostnames {
+		hostnames[index].ServiceTypes = strings.Join(types, ",")
+	}
+	return hostnames
+}
+
+// subtypePattern matches a DNS-SD subtype label, the leading underscore is conventional
+// but not required, see RFC 6763 section 7.1
+var subtypePattern = regexp.MustCompile(`^_?[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// withSubtypes publishes the hostnames under the subtypes of the object's annotation,
+// so clients browsing for a subtype only see the relevant services
+func withSubtypes(obj metav1.Object, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	value, exists := obj.GetAnnotations()[subtypesAnnotation]
+	if !exists {
+		return hostnames
+	}
+	subtypes := []string{}
+	for _, subtype := range strings.Split(value, ",") {
+		subtype = strings.TrimSuffix(strings.TrimSpace(subtype), ".local")
+		if subtype == "" {
+			continue
+		}
+		parts := strings.SplitN(subtype, "._sub.", 2)
+		if !subtypePattern.MatchString(parts[0]) || (len(parts) == 2 && !serviceTypePattern.MatchString(parts[1])) {
+			log.Warnf("Ignoring invalid subtype %q of %v/%v", subtype, obj.GetNamespace(), obj.GetName())
+			continue
+		}
+		subtypes = append(subtypes, subtype)
+	}
+	for index := range hostnames {
+		hostnames[index].Subtypes = strings.Join(subtypes, ",")
+	}
+	return hostnames
+}
+
+// withPorts advertises the hostnames of the object on the ports of its annotation,
+// e.g. when the object is served by another listener of the ingress controller
+func withPorts(obj metav1.Object, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	value, exists := obj.GetAnnotations()[portAnnotation]
+	if !exists {
+		return hostnames
+	}
+	cleartextPort, tlsPort, err := parsePorts(value)
+	if err != nil {
+		log.Warnf("Ignoring invalid annotation %v of %v/%v: %v", portAnnotation, obj.GetNamespace(), obj.GetName(), err)
+		return hostnames
+	}
+	for index := range hostnames {
+		if hostnames[index].TLS && tlsPort != 0 {
+			hostnames[index].Port = tlsPort
+		} else if !hostnames[index].TLS && cleartextPort != 0 {
+			hostnames[index].Port = cleartextPort
+		}
+	}
+	return hostnames
+}
+
+// parsePorts parses a single port for both services or http=port,https=port,
+// a port that is left out is 0
+func parsePorts(value string) (int, int, error) {
+	if port, err := parsePort(strings.TrimSpace(value)); err == nil {
+		return port, port, nil
+	}
+	cleartextPort, tlsPort := 0, 0
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("Expected a port or http=port,https=port, got %q", value)
+		}
+		port, err := parsePort(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, err
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "http":
+			cleartextPort = port
+		case "https":
+			tlsPort = port
+		default:
+			return 0, 0, fmt.Errorf("Unknown service %q, expected http or https", parts[0])
+		}
+	}
+	return cleartextPort, tlsPort, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("Invalid port %q", value)
+	}
+	return port, nil
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+var broadcastConfigResource = schema.GroupVersionResource{Group: "ingress-mdns.secoya.io", Version: "v1alpha1", Resource: "mdnsbroadcastconfigs"}
+
+// BroadcastConfig follows a cluster-scoped MDNSBroadcastConfig, see
+// deploy/mdnsbroadcastconfig-crd.yaml. Its spec holds the settings of the config
+// file and takes precedence over the config file and the flags.
+type BroadcastConfig struct {
+	name      string
+	informers dynamicinformer.DynamicSharedInformerFactory
+	synced    cache.InformerSynced
+
+	lock sync.Mutex
+	// The config of the flags and the config file
+	base *Config
+	// The spec of the MDNSBroadcastConfig, nil when it does not exist
+	spec     map[string]interface{}
+	current  *Config
+	onChange func(*Config)
+}
+
+// NewBroadcastConfig sets up an informer for the MDNSBroadcastConfig with the given
+// name that resyncs after resyncPeriod or never when 0
+func NewBroadcastConfig(dynamicClient dynamic.Interface, name string, base *Config, resyncPeriod time.Duration) *BroadcastConfig {
+	b := &BroadcastConfig{name: name, base: base, current: base}
+	b.informers = dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, resyncPeriod, metav1.NamespaceAll,
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		},
+	)
+	log.Debugf("Watching mdnsbroadcastconfig %v", name)
+	informer := b.informers.ForResource(broadcastConfigResource).Informer()
+	b.synced = informer.HasSynced
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			b.update(obj.(*unstructured.Unstructured))
+		},
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			b.update(newObj.(*unstructured.Unstructured))
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Infof("MDNSBroadcastConfig %v was deleted, using the flags and the config file", name)
+			b.setSpec(nil)
+		},
+	})
+	return b
+}
+
+// OnChange sets the function called with the new config whenever it changes
+func (b *BroadcastConfig) OnChange(onChange func(*Config)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.onChange = onChange
+}
+
+// Run watches the MDNSBroadcastConfig until stop is closed
+func (b *BroadcastConfig) Run(stop <-chan struct{}) {
+	b.informers.Start(stop)
+}
+
+// HasSynced returns true once the MDNSBroadcastConfig has been listed
+func (b *BroadcastConfig) HasSynced() bool {
+	return b.synced()
+}
+
+// Config returns the config of the flags and the config file with the spec applied
+func (b *BroadcastConfig) Config() *Config {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.current
+}
+
+// SetBase replaces the config the spec is applied to, e.g. after the config file
+// was reloaded
+func (b *BroadcastConfig) SetBase(base *Config) {
+	b.lock.Lock()
+	b.base = base
+	b.lock.Unlock()
+	b.apply()
+}
+
+func (b *BroadcastConfig) update(obj *unstructured.Unstructured) {
+	spec, _, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		log.Errorf("Not applying MDNSBroadcastConfig %v: %v", b.name, err)
+		return
+	}
+	b.setSpec(spec)
+}
+
+func (b *BroadcastConfig) setSpec(spec map[string]interface{}) {
+	b.lock.Lock()
+	b.spec = spec
+	b.lock.Unlock()
+	b.apply()
+}
+
+// apply applies the spec to the base and calls onChange when the result changed,
+// an invalid spec keeps the current config
+func (b *BroadcastConfig) apply() {
+	b.lock.Lock()
+	config, err := applySpec(b.base, b.spec)
+	if err != nil {
+		b.lock.Unlock()
+		log.Errorf("Not applying MDNSBroadcastConfig %v: %v", b.name, err)
+		return
+	}
+	if reflect.DeepEqual(config, b.current) {
+		b.lock.Unlock()
+		return
+	}
+	b.current = config
+	onChange := b.onChange
+	b.lock.Unlock()
+	log.Infof("MDNSBroadcastConfig %v changed, reloading", b.name)
+	if onChange != nil {
+		onChange(config)
+	}
+}
+
+// applySpec returns a copy of the base with the settings of the spec
+func applySpec(base *Config, spec map[string]interface{}) (*Config, error) {
+	config := *base
+	if spec == nil {
+		return &config, nil
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse the spec: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
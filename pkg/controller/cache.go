@@ -0,0 +1,392 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Cache is the cache of the manager of a cluster, sources watching the same resource
+// share a single watch connection. Typed resources are only cached in the watched
+// namespaces, custom resources in all namespaces, so routes can attach to gateways
+// in namespaces that are not watched. Failed watches are retried with the exponential
+// backoff of the informers, once they listed their resource again the registrations
+// are reconciled with the new state.
+type Cache struct {
+	namespaces []string
+	scheme     *runtime.Scheme
+	// The caches of the typed resources by namespace, "" for all namespaces
+	caches map[string]cache.Cache
+	// The cache of the custom resources in all namespaces
+	all cache.Cache
+	// Informers whose watch error handler is set
+	watched map[toolscache.SharedIndexInformer]bool
+	// Readiness checks of the watched informers by resource
+	synced map[string][]toolscache.InformerSynced
+
+	lock sync.Mutex
+	// Resource versions of the informers at the time their watch failed
+	failed    map[toolscache.SharedIndexInformer]string
+	reconcile func()
+}
+
+// NewCache returns the cache of a cluster watching the namespaces, "" for all namespaces
+func NewCache(namespaces []string) *Cache {
+	return &Cache{
+		namespaces: namespaces,
+		caches:     map[string]cache.Cache{},
+		watched:    map[toolscache.SharedIndexInformer]bool{},
+		synced:     map[string][]toolscache.InformerSynced{},
+		failed:     map[toolscache.SharedIndexInformer]string{},
+	}
+}
+
+// New creates the caches with the options of the manager, it is the NewCache
+// function of the manager options
+func (c *Cache) New(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+	all, err := cache.New(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.all = all
+	c.scheme = opts.Scheme
+	for _, namespace := range c.namespaces {
+		if namespace == "" {
+			c.caches[namespace] = all
+			continue
+		}
+		opts.Namespace = namespace
+		if c.caches[namespace], err = cache.New(config, opts); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// OnRelist sets the function called once failed watches listed their resources again,
+// e.g. Controller.Reconcile
+func (c *Cache) OnRelist(reconcile func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reconcile = reconcile
+}
+
+// Watch sets up the informers of the resource before the manager is started, so their
+// failed watches are tracked and their initial sync is part of the readiness checks
+func (c *Cache) Watch(ctx context.Context, obj client.Object, resource string) error {
+	for _, objCache := range c.cachesFor(obj) {
+		informer, err := objCache.GetInformer(ctx, obj)
+		if err != nil {
+			return fmt.Errorf("Unable to watch %v: %v", resource, err)
+		}
+		shared, ok := informer.(toolscache.SharedIndexInformer)
+		if !ok || c.watched[shared] {
+			continue
+		}
+		c.watched[shared] = true
+		c.synced[resource] = append(c.synced[resource], shared.HasSynced)
+		if err := shared.SetWatchErrorHandler(c.watchErrorHandler(resource, shared)); err != nil {
+			log.Errorf("Unable to watch the errors of the %v informer: %v", resource, err)
+		}
+	}
+	return nil
+}
+
+// Synced returns the readiness checks of the watched resources, whether all of their
+// informers have completed their initial sync
+func (c *Cache) Synced() map[string]func() bool {
+	checks := map[string]func() bool{}
+	for resource, synced := range c.synced {
+		synced := synced
+		checks[resource] = func() bool {
+			for _, hasSynced := range synced {
+				if !hasSynced() {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return checks
+}
+
+func (c *Cache) watchErrorHandler(resource string, informer toolscache.SharedIndexInformer) toolscache.WatchErrorHandler {
+	return func(r *toolscache.Reflector, err error) {
+		if err == io.EOF {
+			// The watch was closed by the API server and is simply restarted
+			return
+		}
+		metrics.CountWatchError(resource)
+		log.WithField("resource", resource).Errorf("Watch of %v failed, retrying with backoff: %v", resource, err)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if _, exists := c.failed[informer]; !exists {
+			c.failed[informer] = informer.LastSyncResourceVersion()
+		}
+	}
+}
+
+// reconcileRelisted reconciles the registrations once an informer whose watch failed
+// synced a newer resource version, objects deleted in the meantime are unregistered
+func (c *Cache) reconcileRelisted() {
+	c.lock.Lock()
+	relisted := false
+	for informer, resourceVersion := range c.failed {
+		if informer.LastSyncResourceVersion() != resourceVersion {
+			delete(c.failed, informer)
+			relisted = true
+		}
+	}
+	reconcile := c.reconcile
+	c.lock.Unlock()
+	if relisted && reconcile != nil {
+		log.Info("Watches recovered")
+		reconcile()
+	}
+}
+
+// cachesFor returns the caches holding the object, custom resources are only in the
+// cache of all namespaces
+func (c *Cache) cachesFor(obj runtime.Object) []cache.Cache {
+	if _, ok := obj.(runtime.Unstructured); ok {
+		return []cache.Cache{c.all}
+	}
+	caches := []cache.Cache{}
+	for _, namespace := range c.namespaces {
+		caches = append(caches, c.caches[namespace])
+	}
+	return caches
+}
+
+// namespaceCache returns the cache holding the object in the namespace
+func (c *Cache) namespaceCache(obj runtime.Object, namespace string) (cache.Cache, error) {
+	if _, ok := obj.(runtime.Unstructured); ok {
+		return c.all, nil
+	}
+	if objCache, exists := c.caches[""]; exists {
+		return objCache, nil
+	}
+	if objCache, exists := c.caches[namespace]; exists {
+		return objCache, nil
+	}
+	return nil, fmt.Errorf("Namespace %v is not watched", namespace)
+}
+
+// Get reads the object from the cache of its namespace
+func (c *Cache) Get(ctx context.Context, key types.NamespacedName, obj client.Object) error {
+	objCache, err := c.namespaceCache(obj, key.Namespace)
+	if err != nil {
+		return err
+	}
+	return objCache.Get(ctx, key, obj)
+}
+
+// List reads the objects of the namespace of the options, of all watched namespaces
+// when none is given
+func (c *Cache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if listOpts.Namespace != "" {
+		objCache, err := c.namespaceCache(list, listOpts.Namespace)
+		if err != nil {
+			return err
+		}
+		return objCache.List(ctx, list, opts...)
+	}
+	caches := c.cachesFor(list)
+	if len(caches) == 1 {
+		return caches[0].List(ctx, list, opts...)
+	}
+	items := []runtime.Object{}
+	for _, objCache := range caches {
+		namespaceList := list.DeepCopyObject().(client.ObjectList)
+		if err := objCache.List(ctx, namespaceList, opts...); err != nil {
+			return err
+		}
+		namespaceItems, err := apimeta.ExtractList(namespaceList)
+		if err != nil {
+			return err
+		}
+		items = append(items, namespaceItems...)
+	}
+	return apimeta.SetList(list, items)
+}
+
+// GetInformer returns the informer of the object, the informers of all watched
+// namespaces of a typed resource act as one
+func (c *Cache) GetInformer(ctx context.Context, obj client.Object) (cache.Informer, error) {
+	caches := c.cachesFor(obj)
+	informers := namespaceInformers{}
+	for _, objCache := range caches {
+		informer, err := objCache.GetInformer(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		informers = append(informers, informer)
+	}
+	if len(informers) == 1 {
+		return informers[0], nil
+	}
+	return informers, nil
+}
+
+// GetInformerForKind returns the informer of the kind, kinds unknown to the scheme
+// are custom resources
+func (c *Cache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if !c.scheme.Recognizes(gvk) {
+		return c.all.GetInformerForKind(ctx, gvk)
+	}
+	informers := namespaceInformers{}
+	for _, namespace := range c.namespaces {
+		informer, err := c.caches[namespace].GetInformerForKind(ctx, gvk)
+		if err != nil {
+			return nil, err
+		}
+		informers = append(informers, informer)
+	}
+	if len(informers) == 1 {
+		return informers[0], nil
+	}
+	return informers, nil
+}
+
+// Start runs the informers until the context is done
+func (c *Cache) Start(ctx context.Context) error {
+	for _, objCache := range c.distinctCaches() {
+		objCache := objCache
+		go func() {
+			if err := objCache.Start(ctx); err != nil {
+				log.Errorf("Unable to start the cache: %v", err)
+			}
+		}()
+	}
+	go wait.Until(c.reconcileRelisted, time.Second*5, ctx.Done())
+	<-ctx.Done()
+	return nil
+}
+
+// WaitForCacheSync waits for the initial sync of all informers
+func (c *Cache) WaitForCacheSync(ctx context.Context) bool {
+	synced := true
+	for _, objCache := range c.distinctCaches() {
+		if !objCache.WaitForCacheSync(ctx) {
+			synced = false
+		}
+	}
+	return synced
+}
+
+// IndexField adds the index to the informers of the object
+func (c *Cache) IndexField(ctx context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	for _, objCache := range c.cachesFor(obj) {
+		if err := objCache.IndexField(ctx, obj, field, extractValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// distinctCaches returns every cache once, the cache of all namespaces holds the
+// typed resources as well when all namespaces are watched
+func (c *Cache) distinctCaches() []cache.Cache {
+	caches := []cache.Cache{c.all}
+	for _, namespace := range c.namespaces {
+		if namespace != "" {
+			caches = append(caches, c.caches[namespace])
+		}
+	}
+	return caches
+}
+
+// namespaceInformers are the informers of a typed resource in each watched namespace
+type namespaceInformers []cache.Informer
+
+func (i namespaceInformers) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	for _, informer := range i {
+		informer.AddEventHandler(handler)
+	}
+}
+
+func (i namespaceInformers) AddEventHandlerWithResyncPeriod(handler toolscache.ResourceEventHandler, resyncPeriod time.Duration) {
+	for _, informer := range i {
+		informer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+	}
+}
+
+func (i namespaceInformers) AddIndexers(indexers toolscache.Indexers) error {
+	for _, informer := range i {
+		if err := informer.AddIndexers(indexers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i namespaceInformers) HasSynced() bool {
+	for _, informer := range i {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// newObject returns an empty custom resource of the kind
+func newObject(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	return obj
+}
+
+// getObject reads the custom resource of the key from the cache, nil when it does not exist
+func getObject(ctx context.Context, reader client.Reader, gvk schema.GroupVersionKind, key string) (*unstructured.Unstructured, error) {
+	namespace, name, err := toolscache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(gvk)
+	err = reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// listObjects reads all custom resources of the kind from the cache
+func listObjects(ctx context.Context, reader client.Reader, gvk schema.GroupVersionKind, opts ...client.ListOption) []unstructured.Unstructured {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := reader.List(ctx, list, opts...); err != nil {
+		return nil
+	}
+	return list.Items
+}
+
+// listKeys returns the keys of all custom resources of the kind in the cache
+func listKeys(ctx context.Context, reader client.Reader, gvk schema.GroupVersionKind) []string {
+	keys := []string{}
+	for _, obj := range listObjects(ctx, reader, gvk) {
+		keys = append(keys, obj.GetNamespace()+"/"+obj.GetName())
+	}
+	return keys
+}
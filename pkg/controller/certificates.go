@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	k8snet "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// The reasons of certificate warnings
+const (
+	certificateMissing  = "CertificateMissing"
+	certificateInvalid  = "CertificateInvalid"
+	certificateMismatch = "CertificateMismatch"
+)
+
+// certificateWarning is a problem with the certificate a TLS hostname is served with
+type certificateWarning struct {
+	reason  string
+	message string
+}
+
+// certificateChecks keeps the current warnings of each ingress, events are only
+// recorded when they change
+type certificateChecks struct {
+	lock     sync.Mutex
+	warnings map[string][]certificateWarning
+}
+
+// CheckCertificates warns about TLS hostnames whose spec.tls secretName does not exist
+// or whose certificate does not cover the .local hostname, browsers reject them anyway.
+// The warnings are logged, recorded as events on the ingress and counted by the
+// ingress_mdns_certificate_warnings metric. The Secrets of the watched namespaces
+// are watched as well.
+func (i *IngressSource) CheckCertificates() {
+	i.certificates = &certificateChecks{warnings: map[string][]certificateWarning{}}
+}
+
+// secretIngresses returns the ingresses whose tls section references a Secret
+func (i *IngressSource) secretIngresses(obj client.Object) []reconcile.Request {
+	return i.namespaceIngresses(obj.GetNamespace(), func(ingress *k8snet.Ingress) bool {
+		for _, ingressTLS := range ingress.Spec.TLS {
+			if ingressTLS.SecretName == obj.GetName() {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// checkCertificates validates the certificates of the TLS hostnames of the ingress and
+// reports the warnings when they changed, nil clears the warnings of a deleted ingress
+func (i *IngressSource) checkCertificates(ctx context.Context, key string, ref ObjectRef, ingress *k8snet.Ingress, hostnames []announce.LocalHostname) {
+	warnings := []certificateWarning{}
+	if ingress != nil {
+		warnings = i.getCertificateWarnings(ctx, ingress, hostnames)
+	}
+	checks := i.certificates
+	checks.lock.Lock()
+	previous := checks.warnings[key]
+	if len(warnings) == 0 {
+		delete(checks.warnings, key)
+	} else {
+		checks.warnings[key] = warnings
+	}
+	counts := map[string]int{certificateMissing: 0, certificateInvalid: 0, certificateMismatch: 0}
+	for _, ingressWarnings := range checks.warnings {
+		for _, warning := range ingressWarnings {
+			counts[warning.reason]++
+		}
+	}
+	checks.lock.Unlock()
+	for reason, count := range counts {
+		metrics.SetCertificateWarnings(reason, count)
+	}
+	i.controller.lock.RLock()
+	recorder := i.controller.recorder
+	i.controller.lock.RUnlock()
+	for _, warning := range warnings {
+		if containsWarning(previous, warning) {
+			continue
+		}
+		log.Warnf("Ingress %v: %v", key, warning.message)
+		recordEvent(recorder, ref, v1.EventTypeWarning, warning.reason, "%v", warning.message)
+	}
+}
+
+// getCertificateWarnings checks the Secret of each tls section covering a broadcast
+// TLS hostname
+func (i *IngressSource) getCertificateWarnings(ctx context.Context, ingress *k8snet.Ingress, hostnames []announce.LocalHostname) []certificateWarning {
+	filter := i.controller.Filter()
+	warnings := []certificateWarning{}
+	for _, ingressTLS := range ingress.Spec.TLS {
+		covered := []string{}
+		for _, rule := range ingress.Spec.Rules {
+			if len(ingressTLS.Hosts) > 0 && !contains(ingressTLS.Hosts, rule.Host) {
+				continue
+			}
+			for _, hostname := range filter.Hostnames(rule.Host, getRuleBackends(rule)) {
+				if containsTLSHostname(hostnames, hostname) && !contains(covered, hostname+".local") {
+					covered = append(covered, hostname+".local")
+				}
+			}
+		}
+		if len(covered) == 0 {
+			continue
+		}
+		if ingressTLS.SecretName == "" {
+			// Served with the default certificate of the ingress controller
+			continue
+		}
+		certificate, err := getCertificate(ctx, i.cache, ingress.Namespace, ingressTLS.SecretName)
+		if errors.IsNotFound(err) {
+			warnings = append(warnings, certificateWarning{certificateMissing, fmt.Sprintf("Secret %v of %v does not exist", ingressTLS.SecretName, covered[0])})
+			continue
+		}
+		if err != nil {
+			warnings = append(warnings, certificateWarning{certificateInvalid, fmt.Sprintf("Secret %v of %v has no valid certificate: %v", ingressTLS.SecretName, covered[0], err)})
+			continue
+		}
+		sort.Strings(covered)
+		for _, hostname := range covered {
+			if err := certificate.VerifyHostname(hostname); err != nil {
+				warnings = append(warnings, certificateWarning{certificateMismatch, fmt.Sprintf("Certificate of secret %v does not cover %v", ingressTLS.SecretName, hostname)})
+			}
+		}
+	}
+	return warnings
+}
+
+// getCertificate parses the first certificate in the tls.crt of the Secret
+func getCertificate(ctx context.Context, reader client.Reader, namespace string, name string) (*x509.Certificate, error) {
+	secret := &v1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(secret.Data[v1.TLSCertKey])
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No PEM encoded certificate in %v", v1.TLSCertKey)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// containsTLSHostname returns whether the hostname is broadcast on the TLS port
+func containsTLSHostname(hostnames []announce.LocalHostname, hostname string) bool {
+	for _, local := range hostnames {
+		if local.TLS && local.Hostname == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func containsWarning(warnings []certificateWarning, warning certificateWarning) bool {
+	for _, other := range warnings {
+		if other == warning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds the settings that can be given both as flags and in the config file.
+// Values in the config file take precedence over flags.
+type Config struct {
+	CleartextPort           int      `json:"cleartextPort"`
+	TLSPort                 int      `json:"tlsPort"`
+	CleartextServiceType    string   `json:"cleartextServiceType"`
+	TLSServiceType          string   `json:"tlsServiceType"`
+	Namespaces              []string `json:"namespaces"`
+	ExcludeNamespaces       []string `json:"excludeNamespaces"`
+	IncludeSystemNamespaces bool     `json:"includeSystemNamespaces"`
+	HostSuffixes            []string `json:"hostSuffixes"`
+	StripSuffix             []string `json:"stripSuffix"`
+	RequireAnnotation       bool     `json:"requireAnnotation"`
+	PublishMetadata         bool     `json:"publishMetadata"`
+	WildcardExpand          string   `json:"wildcardExpand"`
+	WildcardNames           []string `json:"wildcardNames"`
+	Debounce                string   `json:"debounce"`
+	HostnameTemplate        string   `json:"hostnameTemplate"`
+	ClassPorts              []string `json:"classPorts"`
+	SanitizeHostnames       bool     `json:"sanitizeHostnames"`
+	ConflictPolicy          string   `json:"conflictPolicy"`
+	// The settings below are only read at startup
+	Interfaces     []string `json:"interfaces"`
+	Subnet         string   `json:"subnet"`
+	AddressFamily  string   `json:"addressFamily"`
+	Backend        string   `json:"backend"`
+	TTL            int      `json:"ttl"`
+	PublishReverse bool     `json:"publishReverse"`
+}
+
+// LoadConfigFile reads the YAML config file, settings missing from the file keep
+// their value from base
+func LoadConfigFile(path string, base *Config) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file %v: %v", path, err)
+	}
+	config := *base
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %v: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config file %v: %v", path, err)
+	}
+	return &config, nil
+}
+
+// Validate checks the settings that are parsed when the config is applied
+func (c *Config) Validate() error {
+	if _, err := c.Filter(); err != nil {
+		return err
+	}
+	if _, err := c.DebounceWindow(); err != nil {
+		return err
+	}
+	if _, err := ParseConflictPolicy(c.ConflictPolicy); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WatchConfigFile calls onChange whenever the contents of the config file change.
+// The directory of the file is watched, so ConfigMap mounts that swap symlinks
+// are picked up as well.
+func WatchConfigFile(path string, base *Config, current *Config, onChange func(*Config), stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-watcher.Events:
+				config, err := LoadConfigFile(path, base)
+				if err != nil {
+					log.Errorf("Not reloading config: %v", err)
+					continue
+				}
+				if reflect.DeepEqual(config, current) {
+					continue
+				}
+				log.Infof("Config file %v changed, reloading", path)
+				current = config
+				onChange(config)
+			case err := <-watcher.Errors:
+				log.Errorf("Watching config file %v failed: %v", path, err)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Filter creates the Filter described by the config
+func (c *Config) Filter() (*Filter, error) {
+	filter := &Filter{
+		RequireAnnotation:       c.RequireAnnotation,
+		Namespaces:              c.Namespaces,
+		ExcludeNamespaces:       c.ExcludeNamespaces,
+		WildcardNames:           c.WildcardNames,
+		IncludeSystemNamespaces: c.IncludeSystemNamespaces,
+	}
+	wildcardExpand, err := ParseWildcardExpand(c.WildcardExpand)
+	if err != nil {
+		return nil, err
+	}
+	filter.WildcardExpand = wildcardExpand
+	for _, value := range c.HostSuffixes {
+		suffix, err := ParseHostSuffix(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.HostSuffixes = append(filter.HostSuffixes, suffix)
+	}
+	for _, value := range c.StripSuffix {
+		if len(filter.HostSuffixes) == 0 {
+			filter.HostSuffixes = []HostSuffix{{Suffix: ".local", Replacement: ".local"}}
+		}
+		if err := ApplyStripSuffix(filter.HostSuffixes, value); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range c.ClassPorts {
+		class, ports, err := ParseClassPorts(value)
+		if err != nil {
+			return nil, err
+		}
+		if filter.ClassPorts == nil {
+			filter.ClassPorts = map[string]ClassPorts{}
+		}
+		filter.ClassPorts[class] = ports
+	}
+	if c.HostnameTemplate != "" {
+		tmpl, err := template.New("hostname").Option("missingkey=error").Parse(c.HostnameTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hostname template %q: %v", c.HostnameTemplate, err)
+		}
+		filter.HostnameTemplate = tmpl
+	}
+	return filter, nil
+}
+
+// DebounceWindow parses the time during which changes of an object are coalesced, "" means 0
+func (c *Config) DebounceWindow() (time.Duration, error) {
+	if c.Debounce == "" {
+		return 0, nil
+	}
+	debounce, err := time.ParseDuration(c.Debounce)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid debounce %v: %v", c.Debounce, err)
+	}
+	return debounce, nil
+}
+
+// Service returns the service the hostname is advertised as
+func (c *Config) Service(local announce.LocalHostname) announce.Service {
+	service := announce.Service{Type: c.CleartextServiceType, Port: c.CleartextPort}
+	if local.TLS {
+		service = announce.Service{Type: c.TLSServiceType, Port: c.TLSPort}
+	}
+	if local.Port != 0 {
+		service.Port = local.Port
+	}
+	service.Text = []string{defaultTXT}
+	if local.TXT != "" {
+		service.Text = strings.Split(local.TXT, ",")
+	}
+	if local.ServiceTypes != "" {
+		for _, serviceType := range strings.Split(local.ServiceTypes, ",") {
+			if !strings.EqualFold(serviceType, service.Type) && !contains(service.Types, serviceType) {
+				service.Types = append(service.Types, serviceType)
+			}
+		}
+	}
+	if local.Subtypes != "" {
+		service.Subtypes = map[string][]string{}
+		for _, subtype := range strings.Split(local.Subtypes, ",") {
+			// Subtypes without ._sub.<type> belong to every type of the hostname
+			parts := strings.SplitN(subtype, "._sub.", 2)
+			for _, serviceType := range service.AllTypes() {
+				if (len(parts) == 1 || parts[1] == serviceType) && !contains(service.Subtypes[serviceType], parts[0]) {
+					service.Subtypes[serviceType] = append(service.Subtypes[serviceType], parts[0])
+				}
+			}
+		}
+	}
+	return service
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
+)
+
+// How long other responders have to answer a probe, RFC 6762 section 8.1 sends
+// three probes 250ms apart
+const probeTimeout = time.Millisecond * 750
+
+// ConflictPolicy selects what happens when another responder on the network
+// already answers for a hostname that is about to be registered
+type ConflictPolicy string
+
+// The supported conflict policies
+const (
+	// ConflictNone registers hostnames without probing the network
+	ConflictNone ConflictPolicy = "none"
+	// ConflictAnnounce records the conflict and registers the hostname anyway
+	ConflictAnnounce ConflictPolicy = "announce"
+	// ConflictSkip does not register the hostname, it is probed again with backoff
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictRename registers the hostname with -2, -3, ... appended to its first label
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// ParseConflictPolicy validates a conflict policy, "" means none
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(value); policy {
+	case "":
+		return ConflictNone, nil
+	case ConflictNone, ConflictAnnounce, ConflictSkip, ConflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown conflict policy %v", value)
+}
+
+// probe checks whether other responders answer for the hostname, which already has
+// the IPs of the cluster, and applies the conflict policy. It returns the hostname
+// to announce.
+func (c *Controller) probe(ref ObjectRef, local announce.LocalHostname) (announce.LocalHostname, error) {
+	c.lock.RLock()
+	policy, _ := ParseConflictPolicy(c.config.ConflictPolicy)
+	recorder := c.recorder
+	c.lock.RUnlock()
+	if policy == ConflictNone {
+		return local, nil
+	}
+	ours := c.Addresses()
+	if local.IPs != "" {
+		ours, _ = announce.ParseStaticAddresses(strings.Split(local.IPs, ","))
+	}
+	others := c.foreignIPs(local.Hostname, ours)
+	if len(others) == 0 {
+		return local, nil
+	}
+	metrics.CountConflict()
+	logger := c.logger(ref, local)
+	logger.Warnf("Another responder answers for the hostname with %v", strings.Join(others, ", "))
+	recordEvent(recorder, ref, v1.EventTypeWarning, "MDNSConflict", "%v.local is already answered for with %v", local.Hostname, strings.Join(others, ", "))
+	switch policy {
+	case ConflictSkip:
+		return local, fmt.Errorf("%v.local is already answered for with %v", local.Hostname, strings.Join(others, ", "))
+	case ConflictRename:
+		labels := strings.SplitN(local.Hostname, ".", 2)
+		first := labels[0]
+		for suffix := 2; suffix < 10; suffix++ {
+			renamed := local
+			labels[0] = fmt.Sprintf("%v-%v", first, suffix)
+			renamed.Hostname = strings.Join(labels, ".")
+			if len(c.foreignIPs(renamed.Hostname, ours)) == 0 {
+				logger.Warnf("Registering the hostname as %v instead", renamed.Hostname)
+				recordEvent(recorder, ref, v1.EventTypeWarning, "MDNSRenamed", "Registering %v.local as %v.local", local.Hostname, renamed.Hostname)
+				return renamed, nil
+			}
+		}
+		return local, fmt.Errorf("No free name found for %v.local", local.Hostname)
+	}
+	return local, nil
+}
+
+// foreignIPs returns the IPs other responders answer the hostname with
+func (c *Controller) foreignIPs(hostname string, ours []net.IP) []string {
+	name := hostname + ".local."
+	foreign := []string{}
+	for _, iface := range c.ifaces {
+		records := announce.Query(iface, []uint16{dns.TypeA, dns.TypeAAAA}, name, probeTimeout, false)
+		for _, ip := range announce.AddressesOf(records, name) {
+			if !containsIP(ours, net.ParseIP(ip)) && !contains(foreign, ip) {
+				foreign = append(foreign, ip)
+			}
+		}
+	}
+	return foreign
+}
+
+// How often a responder answering for a broadcast hostname is reported again
+const conflictReportInterval = time.Minute * 10
+
+// MonitorConflicts watches the mDNS responses on the interfaces until stop is closed
+// and records an MDNSConflict event when another responder answers for an announced
+// hostname with IPs that are not ours
+func (c *Controller) MonitorConflicts(stop <-chan struct{}) error {
+	return announce.MonitorAnswers(c.ifaces, c.checkAnswer, stop)
+}
+
+// checkAnswer reports an answer of another responder for an announced hostname
+func (c *Controller) checkAnswer(answer announce.Answer) {
+	if isLocalIP(answer.From) {
+		return
+	}
+	hostname := strings.TrimSuffix(strings.ToLower(answer.Name), ".local.")
+	c.lock.RLock()
+	var ref ObjectRef
+	var local announce.LocalHostname
+	found := false
+	for announced, registration := range c.announced {
+		if strings.ToLower(announced.Hostname) == hostname {
+			ref, local, found = registration.ref, announced, true
+			break
+		}
+	}
+	recorder := c.recorder
+	c.lock.RUnlock()
+	if !found {
+		return
+	}
+	ours := c.Addresses()
+	if local.IPs != "" {
+		ours, _ = announce.ParseStaticAddresses(strings.Split(local.IPs, ","))
+	}
+	if containsIP(ours, answer.IP) {
+		return
+	}
+	metrics.CountConflictingAnswer()
+	key := hostname + "/" + answer.From.String()
+	c.lock.Lock()
+	last, reported := c.reported[key]
+	recent := reported && time.Since(last) < conflictReportInterval
+	if !recent {
+		c.reported[key] = time.Now()
+	}
+	c.lock.Unlock()
+	if recent {
+		return
+	}
+	c.logger(ref, local).Warnf("%v answers for the hostname with %v", answer.From, answer.IP)
+	recordEvent(recorder, ref, v1.EventTypeWarning, "MDNSConflict", "%v answers for %v.local with %v", answer.From, local.Hostname, answer.IP)
+}
+
+// isLocalIP checks whether the IP belongs to this host, i.e. the answer was sent by
+// one of our own responders
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
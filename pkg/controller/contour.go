@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var httpProxyKind = schema.GroupVersionKind{Group: "projectcontour.io", Version: "v1", Kind: "HTTPProxy"}
+
+// The subset of the Contour HTTPProxy type needed to determine hostnames
+type httpProxy struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		VirtualHost *struct {
+			FQDN string                 `json:"fqdn"`
+			TLS  map[string]interface{} `json:"tls"`
+		} `json:"virtualhost"`
+	} `json:"spec"`
+}
+
+// ContourSource keeps track of the hostnames registered for each Contour HTTPProxy
+type ContourSource struct {
+	controller    *Controller
+	cache         *Cache
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewContourSource watches the HTTPProxies in the cache
+func NewContourSource(cache *Cache, controller *Controller) *ContourSource {
+	c := &ContourSource{
+		controller:    controller,
+		cache:         cache,
+		registrations: newObjectRegistrations(controller),
+	}
+	c.queue = newRegistrationQueue("httpproxies", controller, c.sync)
+	return c
+}
+
+// SetupWithManager adds the controller syncing changed HTTPProxies to the manager
+func (c *ContourSource) SetupWithManager(mgr manager.Manager) error {
+	log.Debugf("Watching httpproxies")
+	return c.queue.setupWithManager(mgr, c.cache, httpProxyKind, "httpproxies")
+}
+
+// Resync re-evaluates the hostnames of all HTTPProxies
+func (c *ContourSource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), c.cache, httpProxyKind) {
+		c.queue.AddKey(key, force)
+	}
+	c.queue.AddRegistered(c.registrations, force)
+}
+
+func (c *ContourSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "HTTPProxy", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, c.cache, httpProxyKind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		c.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	proxy := &httpProxy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, proxy); err != nil {
+		// Retrying will not make the httpproxy parseable, wait for it to change instead
+		log.Errorf("Unable to parse httpproxy %v: %v", key, err)
+		return nil
+	}
+	return c.registrations.Update(ctx, key, ref, c.getHostnames(proxy), force)
+}
+
+// getHostnames returns the fqdn of the root HTTPProxy, advertised on the TLS port
+// when the virtual host has TLS configured
+func (c *ContourSource) getHostnames(proxy *httpProxy) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := c.controller.Filter()
+	// Only root proxies have a virtual host, included proxies inherit it
+	if proxy.Spec.VirtualHost == nil || !filter.Allows(proxy) {
+		return hostnames
+	}
+	txt := getTXT(proxy)
+	if c.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "HTTPProxy", Namespace: proxy.Namespace, Name: proxy.Name}, "contour")
+	}
+	tls := proxy.Spec.VirtualHost.TLS != nil
+	for _, hostname := range filter.Hostnames(proxy.Spec.VirtualHost.FQDN, nil) {
+		hostnames = append(hostnames, announce.LocalHostname{TLS: tls, Hostname: hostname, TXT: txt})
+	}
+	return withSubtypes(proxy, withServiceTypes(proxy, withAliases(proxy, hostnames)))
+}
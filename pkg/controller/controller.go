@@ -0,0 +1,550 @@
+// Package controller registers the hostnames of Kubernetes objects with an announcer
+package controller
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Spans are only exported once a tracer provider is registered with otel.SetTracerProvider
+var tracer = otel.Tracer("github.com/secoya/ingress-mdns/pkg/controller")
+
+// Source watches objects and reports their hostnames to the Controller
+type Source interface {
+	// Resync re-evaluates the hostnames of all objects, re-registering all of them when forced.
+	// The hostnames of registered objects that no longer exist are unregistered.
+	Resync(force bool)
+	// SetupWithManager adds the controller processing changed objects to the manager
+	SetupWithManager(mgr manager.Manager) error
+}
+
+// ObjectRef identifies the object hostnames are registered for
+type ObjectRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// UID is only known while the object exists
+	UID types.UID
+}
+
+// Fields returns the log fields identifying the object
+func (o ObjectRef) Fields() log.Fields {
+	return log.Fields{"kind": o.Kind, "namespace": o.Namespace, "name": o.Name}
+}
+
+func (o ObjectRef) reference() *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: o.Kind, Namespace: o.Namespace, Name: o.Name, UID: o.UID}
+}
+
+// Controller registers the hostnames reported by the sources with the announcer
+type Controller struct {
+	announcer  announce.Announcer
+	ifaces     []net.Interface
+	interfaces string
+	addresses  announce.AddressSource
+	// Name of the cluster when broadcasting the hostnames of several clusters
+	cluster string
+	// Comma separated IPs of the cluster, overriding the address source when set
+	clusterIPs string
+	// Publish the hostnames as host.cluster.local, and no longer as host.local when only is set
+	clusterDomain     bool
+	clusterDomainOnly bool
+
+	lock     sync.RWMutex
+	config   *Config
+	filter   *Filter
+	debounce time.Duration
+	sources  []Source
+	// Records MDNSRegistered and MDNSFailed events on the objects when set
+	recorder record.EventRecorder
+	// Ports of the ingress controller Service, overriding the configured ports when set
+	cleartextServicePort int
+	tlsServicePort       int
+	// The hostnames announced under another name because of a conflict
+	renamed map[announce.LocalHostname]announce.LocalHostname
+	// The announced hostnames, watched for conflicts by MonitorConflicts
+	announced map[announce.LocalHostname]registration
+	// When conflicting answers were last reported by hostname and responder
+	reported map[string]time.Time
+	// Only the hostnames of the shard of this replica are registered when set
+	shards *Shards
+}
+
+// NewController creates a Controller with the given initial config
+func NewController(announcer announce.Announcer, ifaces []net.Interface, config *Config) (*Controller, error) {
+	filter, err := config.Filter()
+	if err != nil {
+		return nil, err
+	}
+	debounce, err := config.DebounceWindow()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseConflictPolicy(config.ConflictPolicy); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	return &Controller{
+		announcer:  announcer,
+		ifaces:     ifaces,
+		interfaces: strings.Join(names, ","),
+		addresses:  announce.InterfaceAddresses{},
+		config:     config,
+		filter:     filter,
+		debounce:   debounce,
+		renamed:    map[announce.LocalHostname]announce.LocalHostname{},
+		announced:  map[announce.LocalHostname]registration{},
+		reported:   map[string]time.Time{},
+	}, nil
+}
+
+// AddSource makes the source part of config reloads
+func (c *Controller) AddSource(source Source) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sources = append(c.sources, source)
+}
+
+// SetEventRecorder makes the controller record events on the objects whose hostnames
+// are registered, unregistered or fail to register
+func (c *Controller) SetEventRecorder(recorder record.EventRecorder) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.recorder = recorder
+}
+
+// SetCluster names the cluster the objects belong to when the hostnames of several
+// clusters are broadcast, its hostnames resolve to the IPs when given.
+// It must be called before any hostname is registered.
+func (c *Controller) SetCluster(name string, ips []net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cluster = name
+	values := []string{}
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+	c.clusterIPs = strings.Join(values, ",")
+}
+
+// SetClusterDomain publishes the hostnames in a subdomain named after the cluster,
+// e.g. grafana.kind.local, in addition to or instead of the plain hostnames.
+// Like SetCluster it must be called before any hostname is registered.
+func (c *Controller) SetClusterDomain(only bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clusterDomain = true
+	c.clusterDomainOnly = only
+}
+
+// SetShards only registers the hostnames of the shard of this replica, the others
+// are re-evaluated whenever a member joins or leaves. It must be called before any
+// hostname is registered.
+func (c *Controller) SetShards(shards *Shards) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shards = shards
+}
+
+// ownedHostnames leaves out the hostnames that belong to the shard of another replica
+func (c *Controller) ownedHostnames(hostnames []announce.LocalHostname) []announce.LocalHostname {
+	c.lock.RLock()
+	shards := c.shards
+	c.lock.RUnlock()
+	if shards == nil {
+		return hostnames
+	}
+	owned := []announce.LocalHostname{}
+	for _, local := range hostnames {
+		if shards.Owns(local.Hostname) {
+			owned = append(owned, local)
+		}
+	}
+	return owned
+}
+
+// SetAddressSource sets the source of the IPs reported by Addresses,
+// it should be the one given to the announcer
+func (c *Controller) SetAddressSource(addresses announce.AddressSource) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addresses = addresses
+}
+
+// Addresses returns the IPs the hostnames resolve to
+func (c *Controller) Addresses() []net.IP {
+	c.lock.RLock()
+	addresses := c.addresses
+	family, _ := announce.ParseAddressFamily(c.config.AddressFamily)
+	clusterIPs := c.clusterIPs
+	c.lock.RUnlock()
+	if clusterIPs != "" {
+		ips, _ := announce.ParseStaticAddresses(strings.Split(clusterIPs, ","))
+		return family.Filter(ips)
+	}
+	ips := []net.IP{}
+	for _, iface := range c.ifaces {
+		ifaceIPs, err := addresses.Addresses(iface)
+		if err != nil {
+			log.Debugf("Unable to get the addresses of %v: %v", iface.Name, err)
+			continue
+		}
+		for _, ip := range family.Filter(ifaceIPs) {
+			if !containsIP(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// SetupWithManager adds the controllers processing the changes of all sources to the manager,
+// the informers must be run separately
+func (c *Controller) SetupWithManager(mgr manager.Manager) error {
+	c.lock.RLock()
+	sources := append([]Source{}, c.sources...)
+	c.lock.RUnlock()
+	for _, source := range sources {
+		if err := source.SetupWithManager(mgr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Filter returns the filter of the current config
+func (c *Controller) Filter() *Filter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.filter
+}
+
+// Debounce returns the time during which the changes of an object are coalesced
+func (c *Controller) Debounce() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.debounce
+}
+
+// PublishMetadata returns whether the TXT records identify the object of the hostname
+func (c *Controller) PublishMetadata() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.config.PublishMetadata
+}
+
+// Reload applies a new config and re-registers the affected hostnames
+func (c *Controller) Reload(config *Config) {
+	filter, err := config.Filter()
+	if err != nil {
+		log.Errorf("Not reloading config: %v", err)
+		return
+	}
+	debounce, err := config.DebounceWindow()
+	if err != nil {
+		log.Errorf("Not reloading config: %v", err)
+		return
+	}
+	c.lock.Lock()
+	old := c.config
+	c.config = config
+	c.filter = filter
+	c.debounce = debounce
+	sources := c.sources
+	c.lock.Unlock()
+
+	if !reflect.DeepEqual(old.Interfaces, config.Interfaces) ||
+		old.AddressFamily != config.AddressFamily ||
+		old.Backend != config.Backend ||
+		old.TTL != config.TTL ||
+		old.PublishReverse != config.PublishReverse {
+		log.Warnf("Changes to interfaces, addressFamily, backend, ttl and publishReverse require a restart")
+	}
+	if len(old.Namespaces) > 0 && !watchesNamespaces(old.Namespaces, config.Namespaces) {
+		log.Warnf("Watching additional namespaces requires a restart")
+	}
+
+	// Hostnames stay the same when only the ports or service types change,
+	// in that case everything must be re-registered.
+	force := old.CleartextPort != config.CleartextPort ||
+		old.TLSPort != config.TLSPort ||
+		old.CleartextServiceType != config.CleartextServiceType ||
+		old.TLSServiceType != config.TLSServiceType
+	for _, source := range sources {
+		source.Resync(force)
+	}
+}
+
+// Reregister unregisters and registers all hostnames again, e.g. after the network
+// or the avahi-daemon of the node was restarted
+func (c *Controller) Reregister() {
+	c.lock.RLock()
+	sources := c.sources
+	c.lock.RUnlock()
+	log.Info("Re-registering all hostnames")
+	for _, source := range sources {
+		source.Resync(true)
+	}
+}
+
+// Reconcile re-evaluates the hostnames of all objects against the informer caches,
+// e.g. after a watch recovered, so no hostnames of deleted objects are left behind
+func (c *Controller) Reconcile() {
+	c.lock.RLock()
+	sources := c.sources
+	c.lock.RUnlock()
+	log.Info("Reconciling the registered hostnames")
+	for _, source := range sources {
+		source.Resync(false)
+	}
+}
+
+// SetServicePorts overrides the configured ports with the ones of the ingress
+// controller Service and re-registers all hostnames, ports that are 0 are not overridden
+func (c *Controller) SetServicePorts(cleartextPort int, tlsPort int) {
+	c.lock.Lock()
+	c.cleartextServicePort = cleartextPort
+	c.tlsServicePort = tlsPort
+	sources := c.sources
+	c.lock.Unlock()
+	for _, source := range sources {
+		source.Resync(true)
+	}
+}
+
+// Register starts broadcasting the hostnames of the object and returns the ones that
+// were registered. A failed hostname does not stop the others from being registered,
+// the first error is returned.
+func (c *Controller) Register(ctx context.Context, ref ObjectRef, hostnames []announce.LocalHostname) ([]announce.LocalHostname, error) {
+	c.lock.RLock()
+	recorder := c.recorder
+	c.lock.RUnlock()
+	registered := []announce.LocalHostname{}
+	var firstErr error
+	for _, local := range hostnames {
+		_, span := tracer.Start(ctx, "register", trace.WithAttributes(hostnameAttributes(ref, local)...))
+		service := c.Service(local)
+		span.SetAttributes(attribute.String("service.type", service.Type), attribute.Int("service.port", service.Port))
+		logger := c.logger(ref, local).WithField("port", service.Port)
+		logger.Info("Registering hostname")
+		announced, err := c.probe(ref, c.withClusterIPs(local))
+		if err == nil {
+			err = c.announcer.Register(announced, service)
+		}
+		if err == nil {
+			c.lock.Lock()
+			if announced.Hostname != local.Hostname {
+				c.renamed[local] = announced
+			}
+			c.announced[announced] = registration{ref: ref, registered: time.Now()}
+			c.lock.Unlock()
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		if err != nil {
+			logger.Errorf("Failed to register hostname: %v", err)
+			metrics.RegistrationFailures.Inc()
+			recordEvent(recorder, ref, v1.EventTypeWarning, "MDNSFailed", "Failed to register %v.local on port %v: %v", local.Hostname, service.Port, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		metrics.Registrations.Inc()
+		recordEvent(recorder, ref, v1.EventTypeNormal, "MDNSRegistered", "Registered %v.local as %v on port %v", local.Hostname, service.Type, service.Port)
+		registered = append(registered, local)
+	}
+	return registered, firstErr
+}
+
+// Service returns the DNS-SD service the hostname is registered with, the ports of
+// the ingress controller Service take precedence over the configured ones
+func (c *Controller) Service(local announce.LocalHostname) announce.Service {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	config := *c.config
+	if c.cleartextServicePort != 0 {
+		config.CleartextPort = c.cleartextServicePort
+	}
+	if c.tlsServicePort != 0 {
+		config.TLSPort = c.tlsServicePort
+	}
+	return config.Service(local)
+}
+
+// Unregister stops broadcasting the hostnames of the object
+func (c *Controller) Unregister(ctx context.Context, ref ObjectRef, hostnames []announce.LocalHostname) {
+	c.lock.RLock()
+	recorder := c.recorder
+	c.lock.RUnlock()
+	for _, local := range hostnames {
+		_, span := tracer.Start(ctx, "unregister", trace.WithAttributes(hostnameAttributes(ref, local)...))
+		c.logger(ref, local).Info("Unregistering hostname")
+		c.lock.Lock()
+		announced, renamed := c.renamed[local]
+		delete(c.renamed, local)
+		c.lock.Unlock()
+		if !renamed {
+			announced = c.withClusterIPs(local)
+		}
+		c.lock.Lock()
+		delete(c.announced, announced)
+		c.lock.Unlock()
+		c.announcer.Unregister(announced)
+		span.End()
+		metrics.Unregistrations.Inc()
+		tls := "cleartext"
+		if local.TLS {
+			tls = "TLS"
+		}
+		recordEvent(recorder, ref, v1.EventTypeNormal, "MDNSUnregistered", "Unregistered %v.local on the %v port", local.Hostname, tls)
+	}
+}
+
+// hostnameAttributes returns the span attributes identifying the hostname and its object
+func hostnameAttributes(ref ObjectRef, local announce.LocalHostname) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("kind", ref.Kind),
+		attribute.String("namespace", ref.Namespace),
+		attribute.String("name", ref.Name),
+		attribute.String("hostname", local.Hostname),
+		attribute.Bool("tls", local.TLS),
+	}
+}
+
+// recordEvent records an event on the object, unless it has been deleted
+func recordEvent(recorder record.EventRecorder, ref ObjectRef, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if recorder == nil || ref.UID == "" {
+		return
+	}
+	recorder.Eventf(ref.reference(), eventType, reason, messageFmt, args...)
+}
+
+// renameHostnames applies the hostname template and the cluster domain to the
+// hostnames of the object, hostnames renamed to the same name are only registered once
+func (c *Controller) renameHostnames(ref ObjectRef, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	c.lock.RLock()
+	filter := c.filter
+	data := HostnameData{Namespace: ref.Namespace, IngressName: ref.Name, ClusterName: c.cluster}
+	clusterDomain := c.clusterDomain && c.cluster != ""
+	clusterDomainOnly := c.clusterDomainOnly
+	c.lock.RUnlock()
+	if filter.HostnameTemplate == nil && !clusterDomain {
+		return hostnames
+	}
+	renamed := []announce.LocalHostname{}
+	add := func(local announce.LocalHostname) {
+		if !containsHostname(renamed, local) {
+			renamed = append(renamed, local)
+		}
+	}
+	for _, local := range hostnames {
+		local.Hostname = filter.Rename(local.Hostname, data)
+		if !clusterDomain || !clusterDomainOnly {
+			add(local)
+		}
+		if clusterDomain {
+			local.Hostname += "." + data.ClusterName
+			add(local)
+		}
+	}
+	return renamed
+}
+
+// validHostnames lowercases the hostnames of the object and leaves out the ones that
+// are not valid DNS names, which are sanitized instead with sanitizeHostnames
+func (c *Controller) validHostnames(ref ObjectRef, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	c.lock.RLock()
+	recorder := c.recorder
+	sanitize := c.config.SanitizeHostnames
+	c.lock.RUnlock()
+	valid := []announce.LocalHostname{}
+	for _, local := range hostnames {
+		local.Hostname = strings.ToLower(local.Hostname)
+		err := ValidateHostname(local.Hostname)
+		if err != nil && sanitize {
+			sanitized := SanitizeHostname(local.Hostname)
+			if err = ValidateHostname(sanitized); err == nil {
+				c.logger(ref, local).Debugf("Sanitized hostname to %v", sanitized)
+				local.Hostname = sanitized
+			}
+		}
+		if err != nil {
+			c.logger(ref, local).Warnf("Not broadcasting invalid hostname: %v", err)
+			recordEvent(recorder, ref, v1.EventTypeWarning, "MDNSInvalid", "Not broadcasting %v.local: %v", local.Hostname, err)
+			continue
+		}
+		if !containsHostname(valid, local) {
+			valid = append(valid, local)
+		}
+	}
+	return valid
+}
+
+// withClusterIPs makes the hostname resolve to the IPs of the cluster unless it has its own
+func (c *Controller) withClusterIPs(local announce.LocalHostname) announce.LocalHostname {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if local.IPs == "" {
+		local.IPs = c.clusterIPs
+	}
+	return local
+}
+
+func (c *Controller) logger(ref ObjectRef, local announce.LocalHostname) *log.Entry {
+	fields := log.Fields{
+		"hostname":  local.Hostname,
+		"tls":       local.TLS,
+		"interface": c.interfaces,
+	}
+	c.lock.RLock()
+	if c.cluster != "" {
+		fields["cluster"] = c.cluster
+	}
+	c.lock.RUnlock()
+	return log.WithFields(ref.Fields()).WithFields(fields)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchesNamespaces checks whether the watched namespaces cover the wanted namespaces
+func watchesNamespaces(watched []string, wanted []string) bool {
+	if len(wanted) == 0 {
+		return len(watched) == 0
+	}
+	for _, namespace := range wanted {
+		if !contains(watched, namespace) {
+			return false
+		}
+	}
+	return true
+}
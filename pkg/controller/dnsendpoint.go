@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var dnsEndpointKind = schema.GroupVersionKind{Group: "externaldns.k8s.io", Version: "v1alpha1", Kind: "DNSEndpoint"}
+
+// The subset of the external-dns DNSEndpoint type needed to determine hostnames
+type dnsEndpoint struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Endpoints []struct {
+			DNSName    string `json:"dnsName"`
+			RecordType string `json:"recordType"`
+		} `json:"endpoints"`
+	} `json:"spec"`
+}
+
+// DNSEndpointSource keeps track of the hostnames registered for each external-dns DNSEndpoint
+type DNSEndpointSource struct {
+	controller    *Controller
+	cache         *Cache
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewDNSEndpointSource watches the DNSEndpoints in the cache
+func NewDNSEndpointSource(cache *Cache, controller *Controller) *DNSEndpointSource {
+	d := &DNSEndpointSource{
+		controller:    controller,
+		cache:         cache,
+		registrations: newObjectRegistrations(controller),
+	}
+	d.queue = newRegistrationQueue("dnsendpoints", controller, d.sync)
+	return d
+}
+
+// SetupWithManager adds the controller syncing changed DNSEndpoints to the manager
+func (d *DNSEndpointSource) SetupWithManager(mgr manager.Manager) error {
+	log.Debugf("Watching dnsendpoints")
+	return d.queue.setupWithManager(mgr, d.cache, dnsEndpointKind, "dnsendpoints")
+}
+
+// Resync re-evaluates the hostnames of all DNSEndpoints
+func (d *DNSEndpointSource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), d.cache, dnsEndpointKind) {
+		d.queue.AddKey(key, force)
+	}
+	d.queue.AddRegistered(d.registrations, force)
+}
+
+func (d *DNSEndpointSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "DNSEndpoint", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, d.cache, dnsEndpointKind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		d.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	endpoint := &dnsEndpoint{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, endpoint); err != nil {
+		// Retrying will not make the endpoint parseable, wait for it to change instead
+		log.Errorf("Unable to parse dnsendpoint %v: %v", key, err)
+		return nil
+	}
+	return d.registrations.Update(ctx, key, ref, d.getHostnames(endpoint), force)
+}
+
+// getHostnames returns the eligible address records of the DNSEndpoint,
+// they are broadcast on the cleartext port
+func (d *DNSEndpointSource) getHostnames(endpoint *dnsEndpoint) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := d.controller.Filter()
+	if !filter.Allows(endpoint) {
+		return hostnames
+	}
+	txt := getTXT(endpoint)
+	if d.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "DNSEndpoint", Namespace: endpoint.Namespace, Name: endpoint.Name}, "")
+	}
+	for _, record := range endpoint.Spec.Endpoints {
+		switch record.RecordType {
+		case "A", "AAAA", "CNAME":
+		default:
+			continue
+		}
+		for _, hostname := range filter.Hostnames(strings.TrimSuffix(record.DNSName, "."), nil) {
+			local := announce.LocalHostname{TLS: false, Hostname: hostname, TXT: txt}
+			if !containsHostname(hostnames, local) {
+				hostnames = append(hostnames, local)
+			}
+		}
+	}
+	return withSubtypes(endpoint, withServiceTypes(endpoint, withAliases(endpoint, hostnames)))
+}
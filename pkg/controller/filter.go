@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The annotation that opts an object in or out of broadcasting
+const broadcastAnnotation = "ingress-mdns.secoya.io/broadcast"
+
+// SystemNamespaces are never broadcast from unless IncludeSystemNamespaces is set or
+// they are listed in Namespaces, so the Ingresses of cluster add-ons stay off the network
+var SystemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// Filter decides which objects should have their hostnames broadcast
+type Filter struct {
+	// RequireAnnotation only broadcasts objects that opt in with the broadcast annotation
+	RequireAnnotation bool
+	// Namespaces to broadcast hostnames from, all namespaces when empty
+	Namespaces []string
+	// ExcludeNamespaces are never broadcast from
+	ExcludeNamespaces []string
+	// IncludeSystemNamespaces broadcasts from the SystemNamespaces as well
+	IncludeSystemNamespaces bool
+	// HostSuffixes are the eligible host suffixes, only .local when empty
+	HostSuffixes []HostSuffix
+	// WildcardExpand selects how wildcard hosts are turned into concrete hostnames
+	WildcardExpand WildcardExpand
+	// WildcardNames replace the wildcard of wildcard hosts with WildcardExpandStatic
+	WildcardNames []string
+	// HostnameTemplate rewrites the broadcast names, it is executed with HostnameData
+	HostnameTemplate *template.Template
+	// ClassPorts are the ports of the ingress controllers by ingress class
+	ClassPorts map[string]ClassPorts
+}
+
+// ClassPorts are the external ports of the ingress controller of an ingress class
+type ClassPorts struct {
+	Cleartext int
+	TLS       int
+}
+
+// ParseClassPorts parses the ports of an ingress class like nginx=80:443
+func ParseClassPorts(value string) (string, ClassPorts, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", ClassPorts{}, fmt.Errorf("Expected class=cleartext:tls, got %q", value)
+	}
+	ports := strings.SplitN(parts[1], ":", 2)
+	if len(ports) != 2 {
+		return "", ClassPorts{}, fmt.Errorf("Expected class=cleartext:tls, got %q", value)
+	}
+	cleartext, err := parsePort(ports[0])
+	if err != nil {
+		return "", ClassPorts{}, fmt.Errorf("Invalid cleartext port of class %v: %v", parts[0], err)
+	}
+	tls, err := parsePort(ports[1])
+	if err != nil {
+		return "", ClassPorts{}, fmt.Errorf("Invalid TLS port of class %v: %v", parts[0], err)
+	}
+	return parts[0], ClassPorts{Cleartext: cleartext, TLS: tls}, nil
+}
+
+// HostnameData holds the fields of the hostname template, e.g. {{.Host}}-{{.Namespace}}
+type HostnameData struct {
+	// Host is the hostname without the .local domain
+	Host      string
+	Namespace string
+	// IngressName is the name of the object, whatever its kind
+	IngressName string
+	// ClusterName is the name of the cluster given with --cluster-name or --contexts
+	ClusterName string
+}
+
+// WildcardExpand selects how wildcard hosts like *.apps.local are broadcast
+type WildcardExpand string
+
+// The supported wildcard expansion modes
+const (
+	// WildcardExpandNone skips wildcard hosts
+	WildcardExpandNone WildcardExpand = "none"
+	// WildcardExpandBackends replaces the wildcard with the names of the backend Services
+	WildcardExpandBackends WildcardExpand = "backends"
+	// WildcardExpandStatic replaces the wildcard with the configured names
+	WildcardExpandStatic WildcardExpand = "static"
+)
+
+// ParseWildcardExpand validates a wildcard expansion mode, "" means none
+func ParseWildcardExpand(value string) (WildcardExpand, error) {
+	switch mode := WildcardExpand(value); mode {
+	case "":
+		return WildcardExpandNone, nil
+	case WildcardExpandNone, WildcardExpandBackends, WildcardExpandStatic:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown wildcard expansion mode %v", value)
+}
+
+// HostSuffix maps hosts ending in Suffix to mDNS names ending in Replacement
+type HostSuffix struct {
+	Suffix      string
+	Replacement string
+	// Keep preserves the suffix and appends the replacement unless the host already
+	// ends in it, e.g. grafana.kube is broadcast as grafana.kube.local
+	Keep bool
+}
+
+// ParseHostSuffix parses a suffix mapping like .kube=.local,
+// a suffix without a replacement is mapped to .local
+func ParseHostSuffix(value string) (HostSuffix, error) {
+	parts := strings.SplitN(value, "=", 2)
+	suffix := HostSuffix{Suffix: parts[0], Replacement: ".local"}
+	if len(parts) == 2 {
+		suffix.Replacement = parts[1]
+	}
+	if !strings.HasPrefix(suffix.Suffix, ".") {
+		return suffix, fmt.Errorf("The host suffix %q must start with a dot", suffix.Suffix)
+	}
+	if !strings.HasSuffix(suffix.Replacement, ".local") {
+		return suffix, fmt.Errorf("The host suffix replacement %q must end with .local", suffix.Replacement)
+	}
+	return suffix, nil
+}
+
+// ApplyStripSuffix sets whether the matched suffixes are stripped, value is either
+// true or false for all suffixes or e.g. .kube=false for a single suffix
+func ApplyStripSuffix(suffixes []HostSuffix, value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	strip, err := strconv.ParseBool(parts[len(parts)-1])
+	if err != nil {
+		return fmt.Errorf("Invalid strip suffix %q, expected true, false or suffix=true|false", value)
+	}
+	found := false
+	for i := range suffixes {
+		if len(parts) == 1 || suffixes[i].Suffix == parts[0] {
+			suffixes[i].Keep = !strip
+			found = true
+		}
+	}
+	if len(parts) == 2 && !found {
+		return fmt.Errorf("Unable to strip the unknown host suffix %q", parts[0])
+	}
+	return nil
+}
+
+// Hostname maps a host to the name that is broadcast, without the .local domain.
+// Returns false when the host does not have an eligible suffix.
+func (f *Filter) Hostname(host string) (string, bool) {
+	suffixes := f.HostSuffixes
+	if len(suffixes) == 0 {
+		suffixes = []HostSuffix{{Suffix: ".local", Replacement: ".local"}}
+	}
+	for _, suffix := range suffixes {
+		if !strings.HasSuffix(host, suffix.Suffix) || host == suffix.Suffix {
+			continue
+		}
+		hostname := strings.TrimSuffix(host, suffix.Suffix) + suffix.Replacement
+		if suffix.Keep {
+			hostname = host
+			if !strings.HasSuffix(host, suffix.Replacement) {
+				hostname += suffix.Replacement
+			}
+		}
+		return strings.TrimSuffix(hostname, ".local"), true
+	}
+	return "", false
+}
+
+// Hostnames maps a host to the names that are broadcast, expanding wildcard hosts.
+// backends are the names of the Services the host routes to.
+func (f *Filter) Hostnames(host string, backends []string) []string {
+	if !strings.HasPrefix(host, "*.") {
+		if hostname, eligible := f.Hostname(host); eligible {
+			return []string{hostname}
+		}
+		return nil
+	}
+	var labels []string
+	switch f.WildcardExpand {
+	case WildcardExpandBackends:
+		labels = backends
+	case WildcardExpandStatic:
+		labels = f.WildcardNames
+	default:
+		log.Debugf("Skipping wildcard host %v", host)
+		return nil
+	}
+	hostnames := []string{}
+	for _, label := range labels {
+		if label == "" || strings.Contains(label, ".") {
+			continue
+		}
+		hostname, eligible := f.Hostname(label + host[1:])
+		if eligible && !contains(hostnames, hostname) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames
+}
+
+// Rename applies the hostname template to the hostname, it is returned unchanged
+// without a template or when the template fails
+func (f *Filter) Rename(hostname string, data HostnameData) string {
+	if f.HostnameTemplate == nil {
+		return hostname
+	}
+	data.Host = hostname
+	var out strings.Builder
+	if err := f.HostnameTemplate.Execute(&out, data); err != nil {
+		log.Warnf("Unable to apply the hostname template to %v: %v", hostname, err)
+		return hostname
+	}
+	renamed := strings.TrimSuffix(strings.TrimSpace(out.String()), ".local")
+	if renamed == "" {
+		log.Warnf("The hostname template renamed %v to an empty name", hostname)
+		return hostname
+	}
+	return renamed
+}
+
+// ValidateHostname checks the hostname, without the .local domain, against the DNS
+// rules: labels of at most 63 lowercase letters, digits and dashes that do not start
+// or end with a dash, at most 253 characters including .local
+func ValidateHostname(hostname string) error {
+	if len(hostname)+len(".local") > 253 {
+		return fmt.Errorf("%v.local is longer than 253 characters", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" {
+			return fmt.Errorf("%v.local has an empty label", hostname)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("The label %v of %v.local is longer than 63 characters", label, hostname)
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("The label %v of %v.local starts or ends with a dash", label, hostname)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("The label %v of %v.local contains %q, only lowercase letters, digits and dashes are allowed", label, hostname, c)
+			}
+		}
+	}
+	return nil
+}
+
+// SanitizeHostname replaces the characters that are not allowed in a hostname with
+// dashes, drops empty labels and shortens labels to 63 characters
+func SanitizeHostname(hostname string) string {
+	labels := []string{}
+	for _, label := range strings.Split(strings.ToLower(hostname), ".") {
+		label = strings.Map(func(c rune) rune {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return '-'
+			}
+			return c
+		}, label)
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		label = strings.Trim(label, "-")
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// WatchNamespaces returns the namespaces that need to be watched
+func (f *Filter) WatchNamespaces() []string {
+	if len(f.Namespaces) == 0 {
+		return []string{v1.NamespaceAll}
+	}
+	return f.Namespaces
+}
+
+// Allows checks whether the hostnames of the object should be broadcast
+func (f *Filter) Allows(obj metav1.Object) bool {
+	if len(f.Namespaces) > 0 && !contains(f.Namespaces, obj.GetNamespace()) {
+		return false
+	}
+	if contains(f.ExcludeNamespaces, obj.GetNamespace()) {
+		return false
+	}
+	if !f.IncludeSystemNamespaces && len(f.Namespaces) == 0 && contains(SystemNamespaces, obj.GetNamespace()) {
+		return false
+	}
+	value, exists := obj.GetAnnotations()[broadcastAnnotation]
+	if !exists {
+		return !f.RequireAnnotation
+	}
+	broadcast, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warnf("Invalid value %q for annotation %v on %v/%v", value, broadcastAnnotation, obj.GetNamespace(), obj.GetName())
+		return !f.RequireAnnotation
+	}
+	return broadcast
+}
+
+// contains checks whether the slice contains the string
+func contains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var (
+	gatewayKind   = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "Gateway"}
+	httpRouteKind = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+)
+
+// The subset of the Gateway API types needed to determine hostnames and ports
+type gateway struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		GatewayClassName string            `json:"gatewayClassName"`
+		Listeners        []gatewayListener `json:"listeners"`
+	} `json:"spec"`
+}
+
+type gatewayListener struct {
+	Name     string  `json:"name"`
+	Hostname *string `json:"hostname"`
+	Port     int     `json:"port"`
+	Protocol string  `json:"protocol"`
+}
+
+type httpRoute struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []httpRouteParentRef `json:"parentRefs"`
+		Hostnames  []string             `json:"hostnames"`
+		Rules      []struct {
+			BackendRefs []struct {
+				Kind *string `json:"kind"`
+				Name string  `json:"name"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type httpRouteParentRef struct {
+	Kind        *string `json:"kind"`
+	Namespace   *string `json:"namespace"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName"`
+	Port        *int    `json:"port"`
+}
+
+// GatewaySource keeps track of the hostnames registered for each HTTPRoute.
+// Routes are re-evaluated whenever a Gateway they are attached to changes,
+// since the advertised port is taken from the Gateway listener.
+type GatewaySource struct {
+	controller    *Controller
+	cache         *Cache
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewGatewaySource watches Gateways and HTTPRoutes in the cache
+func NewGatewaySource(cache *Cache, controller *Controller) *GatewaySource {
+	g := &GatewaySource{
+		controller:    controller,
+		cache:         cache,
+		registrations: newObjectRegistrations(controller),
+	}
+	g.queue = newRegistrationQueue("httproutes", controller, g.syncRoute)
+	return g
+}
+
+// SetupWithManager adds the controller syncing changed routes to the manager,
+// the routes attached to a Gateway are synced when it changes
+func (g *GatewaySource) SetupWithManager(mgr manager.Manager) error {
+	ctx := context.Background()
+	log.Debugf("Watching gateways")
+	if err := g.cache.Watch(ctx, newObject(gatewayKind), "gateways"); err != nil {
+		return err
+	}
+	log.Debugf("Watching httproutes")
+	if err := g.cache.Watch(ctx, newObject(httpRouteKind), "httproutes"); err != nil {
+		return err
+	}
+	return g.queue.newControllerManagedBy(mgr, newObject(httpRouteKind), "httproutes").
+		Watches(
+			&source.Kind{Type: newObject(gatewayKind)},
+			handler.EnqueueRequestsFromMapFunc(g.gatewayRoutes),
+			builder.WithPredicates(countResyncs("gateways")),
+		).
+		Complete(g.queue)
+}
+
+// Resync re-evaluates the hostnames of all routes
+func (g *GatewaySource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), g.cache, httpRouteKind) {
+		g.queue.AddKey(key, force)
+	}
+	g.queue.AddRegistered(g.registrations, force)
+}
+
+func (g *GatewaySource) syncRoute(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "HTTPRoute", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, g.cache, httpRouteKind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		g.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	route := &httpRoute{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, route); err != nil {
+		// Retrying will not make the route parseable, wait for it to change instead
+		log.Errorf("Unable to parse httproute %v: %v", key, err)
+		return nil
+	}
+	return g.registrations.Update(ctx, key, ref, g.getRouteHostnames(ctx, route), force)
+}
+
+// gatewayRoutes returns all routes that are attached to the gateway
+func (g *GatewaySource) gatewayRoutes(gw client.Object) []reconcile.Request {
+	keys := []string{}
+	for _, routeObj := range listObjects(context.Background(), g.cache, httpRouteKind) {
+		route := &httpRoute{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(routeObj.Object, route); err != nil {
+			continue
+		}
+		for _, ref := range route.Spec.ParentRefs {
+			if ref.Name == gw.GetName() && parentRefNamespace(route, ref) == gw.GetNamespace() {
+				keys = append(keys, routeObj.GetNamespace()+"/"+routeObj.GetName())
+				break
+			}
+		}
+	}
+	return g.queue.requests(keys...)
+}
+
+func (g *GatewaySource) getRouteHostnames(ctx context.Context, route *httpRoute) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := g.controller.Filter()
+	if !filter.Allows(route) {
+		return hostnames
+	}
+	txt := getTXT(route)
+	for _, ref := range route.Spec.ParentRefs {
+		if ref.Kind != nil && *ref.Kind != "Gateway" {
+			continue
+		}
+		item, err := getObject(ctx, g.cache, gatewayKind, parentRefNamespace(route, ref)+"/"+ref.Name)
+		if err != nil || item == nil {
+			log.Debugf("Gateway %v of httproute %v not found", ref.Name, route.Name)
+			continue
+		}
+		gw := &gateway{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, gw); err != nil {
+			log.Errorf("Unable to parse gateway %v/%v: %v", parentRefNamespace(route, ref), ref.Name, err)
+			continue
+		}
+		gatewayTXT := txt
+		if g.controller.PublishMetadata() {
+			routeRef := ObjectRef{Kind: "HTTPRoute", Namespace: route.Namespace, Name: route.Name}
+			gatewayTXT = withMetadata(txt, routeRef, gw.Spec.GatewayClassName)
+		}
+		for _, attached := range attachedHosts(gw, ref, route.Spec.Hostnames) {
+			for _, hostname := range filter.Hostnames(attached.host, getRouteBackends(route)) {
+				hostnames = append(hostnames, announce.LocalHostname{
+					TLS:      attached.listener.Protocol == "HTTPS",
+					Hostname: hostname,
+					Port:     attached.listener.Port,
+					TXT:      gatewayTXT,
+				})
+			}
+		}
+	}
+	return withSubtypes(route, withServiceTypes(route, withAliases(route, hostnames)))
+}
+
+// getRouteBackends returns the names of the Services the route forwards to
+func getRouteBackends(route *httpRoute) []string {
+	backends := []string{}
+	for _, rule := range route.Spec.Rules {
+		for _, backendRef := range rule.BackendRefs {
+			if backendRef.Kind == nil || *backendRef.Kind == "Service" {
+				backends = append(backends, backendRef.Name)
+			}
+		}
+	}
+	return backends
+}
+
+// routeHost is a hostname of a route and the listener it is served on
+type routeHost struct {
+	host     string
+	listener *gatewayListener
+}
+
+// attachedHosts pairs the hostnames of the route with the listener of the gateway
+// serving them. A route without hostnames inherits the hostname of every listener it
+// attaches to, listeners without a hostname or with a wildcard have none to broadcast.
+func attachedHosts(gw *gateway, ref httpRouteParentRef, hosts []string) []routeHost {
+	attached := []routeHost{}
+	if len(hosts) > 0 {
+		for _, host := range hosts {
+			if listener := findListener(gw, ref, host); listener != nil {
+				attached = append(attached, routeHost{host: host, listener: listener})
+			}
+		}
+		return attached
+	}
+	for i, listener := range gw.Spec.Listeners {
+		if !listenerAttaches(listener, ref) || listener.Hostname == nil || strings.HasPrefix(*listener.Hostname, "*") {
+			continue
+		}
+		attached = append(attached, routeHost{host: *listener.Hostname, listener: &gw.Spec.Listeners[i]})
+	}
+	return attached
+}
+
+// findListener returns the first HTTP(S) listener on the gateway the route
+// attaches to and that accepts the hostname
+func findListener(gw *gateway, ref httpRouteParentRef, hostname string) *gatewayListener {
+	for i, listener := range gw.Spec.Listeners {
+		if !listenerAttaches(listener, ref) {
+			continue
+		}
+		if listener.Hostname != nil && !hostnameMatches(*listener.Hostname, hostname) {
+			continue
+		}
+		return &gw.Spec.Listeners[i]
+	}
+	return nil
+}
+
+// listenerAttaches checks whether the parent reference selects the HTTP(S) listener
+func listenerAttaches(listener gatewayListener, ref httpRouteParentRef) bool {
+	if listener.Protocol != "HTTP" && listener.Protocol != "HTTPS" {
+		return false
+	}
+	if ref.SectionName != nil && *ref.SectionName != listener.Name {
+		return false
+	}
+	return ref.Port == nil || *ref.Port == listener.Port
+}
+
+func hostnameMatches(pattern string, hostname string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(hostname, pattern[1:])
+	}
+	return pattern == hostname
+}
+
+func parentRefNamespace(route *httpRoute, ref httpRouteParentRef) string {
+	if ref.Namespace != nil {
+		return *ref.Namespace
+	}
+	return route.Namespace
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"testing"
+)
+
+func TestAttachedHostsInheritListenerHostname(t *testing.T) {
+	grafana := "grafana.local"
+	wildcard := "*.example.local"
+	gw := &gateway{}
+	gw.Spec.Listeners = []gatewayListener{
+		{Name: "http", Port: 80, Protocol: "HTTP"},
+		{Name: "https", Hostname: &grafana, Port: 443, Protocol: "HTTPS"},
+		{Name: "wildcard", Hostname: &wildcard, Port: 8080, Protocol: "HTTP"},
+		{Name: "tcp", Hostname: &grafana, Port: 9000, Protocol: "TCP"},
+	}
+
+	attached := attachedHosts(gw, httpRouteParentRef{Name: "gateway"}, nil)
+	if len(attached) != 1 {
+		t.Fatalf("Expected the hostname of the https listener, got %v", attached)
+	}
+	if attached[0].host != grafana || attached[0].listener.Name != "https" {
+		t.Errorf("Expected %v on the https listener, got %v on %v", grafana, attached[0].host, attached[0].listener.Name)
+	}
+
+	section := "http"
+	if attached := attachedHosts(gw, httpRouteParentRef{Name: "gateway", SectionName: &section}, nil); len(attached) != 0 {
+		t.Errorf("Expected no hostname for a listener without one, got %v", attached)
+	}
+}
+
+func TestAttachedHostsOfRouteHostnames(t *testing.T) {
+	grafana := "grafana.local"
+	gw := &gateway{}
+	gw.Spec.Listeners = []gatewayListener{
+		{Name: "https", Hostname: &grafana, Port: 443, Protocol: "HTTPS"},
+		{Name: "http", Port: 80, Protocol: "HTTP"},
+	}
+
+	attached := attachedHosts(gw, httpRouteParentRef{Name: "gateway"}, []string{"grafana.local", "prometheus.local"})
+	if len(attached) != 2 {
+		t.Fatalf("Expected both hostnames of the route, got %v", attached)
+	}
+	if attached[0].host != "grafana.local" || attached[0].listener.Name != "https" {
+		t.Errorf("Expected grafana.local on the https listener, got %v on %v", attached[0].host, attached[0].listener.Name)
+	}
+	if attached[1].host != "prometheus.local" || attached[1].listener.Name != "http" {
+		t.Errorf("Expected prometheus.local on the http listener, got %v on %v", attached[1].host, attached[1].listener.Name)
+	}
+}
@@ -0,0 +1,399 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	k8snet "k8s.io/api/networking/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// IngressSource keeps track of the hostnames registered for each Ingress
+type IngressSource struct {
+	controller  *Controller
+	cache       *Cache
+	clientset   kubernetes.Interface
+	writeStatus bool
+	// The group version of the watched Ingresses, converted to networking.k8s.io/v1
+	ingressAPI schema.GroupVersion
+	// Resolve the hostnames to the load balancer IPs in the status of their ingress
+	statusAddresses bool
+	// Only broadcast the hosts whose backends have ready endpoints
+	readyEndpoints bool
+	// Only set when the certificates of the TLS hostnames are checked
+	certificates  *certificateChecks
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewIngressSource watches the Ingresses of the watched namespaces in the cache,
+// the clientset writes the status annotations
+func NewIngressSource(cache *Cache, clientset kubernetes.Interface, controller *Controller) *IngressSource {
+	i := &IngressSource{
+		controller:    controller,
+		cache:         cache,
+		clientset:     clientset,
+		ingressAPI:    k8snet.SchemeGroupVersion,
+		registrations: newObjectRegistrations(controller),
+	}
+	i.queue = newRegistrationQueue("ingresses", controller, i.sync)
+	return i
+}
+
+// SetIngressAPI watches the Ingresses through one of the IngressAPIs instead of
+// networking.k8s.io/v1, for clusters that do not serve it yet
+func (i *IngressSource) SetIngressAPI(groupVersion schema.GroupVersion) {
+	i.ingressAPI = groupVersion
+}
+
+// SetWriteStatus enables patching the broadcast state onto the ingresses as an annotation
+func (i *IngressSource) SetWriteStatus(enabled bool) {
+	i.writeStatus = enabled
+}
+
+// SetStatusAddresses makes the hostnames resolve to the load balancer IPs in the status
+// of their ingress instead of the address source, ingresses without any are not broadcast
+func (i *IngressSource) SetStatusAddresses(enabled bool) {
+	i.statusAddresses = enabled
+}
+
+// SetupWithManager adds the controller syncing changed ingresses to the manager, it
+// also watches the EndpointSlices and Secrets the ingresses are checked against
+func (i *IngressSource) SetupWithManager(mgr manager.Manager) error {
+	ctx := context.Background()
+	log.Debugf("Watching %v ingresses in namespaces %q", i.ingressAPI, i.controller.Filter().WatchNamespaces())
+	ingress, _ := newIngressObjects(i.ingressAPI)
+	if err := i.cache.Watch(ctx, ingress, "ingresses"); err != nil {
+		return err
+	}
+	blder := i.queue.newControllerManagedBy(mgr, ingress, "ingresses")
+	if i.readyEndpoints {
+		if err := i.cache.Watch(ctx, &discoveryv1.EndpointSlice{}, "endpointslices"); err != nil {
+			return err
+		}
+		blder = blder.Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(i.sliceIngresses))
+	}
+	if i.certificates != nil {
+		if err := i.cache.Watch(ctx, &v1.Secret{}, "secrets"); err != nil {
+			return err
+		}
+		blder = blder.Watches(&source.Kind{Type: &v1.Secret{}}, handler.EnqueueRequestsFromMapFunc(i.secretIngresses))
+	}
+	return blder.Complete(i.queue)
+}
+
+// Resync re-evaluates the hostnames of all ingresses
+func (i *IngressSource) Resync(force bool) {
+	ingresses, err := i.listIngresses(context.Background())
+	if err != nil {
+		log.Errorf("Unable to list ingresses: %v", err)
+	}
+	for _, ingress := range ingresses {
+		i.queue.AddKey(ingress.Namespace+"/"+ingress.Name, force)
+	}
+	i.queue.AddRegistered(i.registrations, force)
+}
+
+func (i *IngressSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "Ingress", Namespace: namespace, Name: name}
+	ingress, err := i.getIngress(ctx, namespace, name)
+	if errors.IsNotFound(err) {
+		if i.certificates != nil {
+			i.checkCertificates(ctx, key, ref, nil, nil)
+		}
+		i.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ref.UID = ingress.UID
+	hostnames := IngressHostnames(ingress, i.controller.Filter(), i.controller.PublishMetadata())
+	if i.statusAddresses {
+		hostnames = i.withStatusAddresses(ingress, hostnames)
+	}
+	if i.readyEndpoints {
+		hostnames = i.withReadyEndpoints(ctx, ingress, hostnames)
+	}
+	if i.certificates != nil {
+		i.checkCertificates(ctx, key, ref, ingress, hostnames)
+	}
+	err = i.registrations.Update(ctx, key, ref, hostnames, force)
+	if i.writeStatus {
+		if statusErr := i.updateStatus(ctx, ingress, hostnames, i.registrations.Registered(key)); statusErr != nil && err == nil {
+			err = statusErr
+		}
+	}
+	return err
+}
+
+// namespaceIngresses returns the keys of the ingresses in the namespace the filter accepts
+func (i *IngressSource) namespaceIngresses(namespace string, accepts func(ingress *k8snet.Ingress) bool) []reconcile.Request {
+	ingresses, err := i.listIngresses(context.Background(), client.InNamespace(namespace))
+	if err != nil {
+		return nil
+	}
+	keys := []string{}
+	for _, ingress := range ingresses {
+		if accepts(ingress) {
+			keys = append(keys, ingress.Namespace+"/"+ingress.Name)
+		}
+	}
+	return i.queue.requests(keys...)
+}
+
+// getIngress reads the ingress from the cache, converted to networking.k8s.io/v1
+func (i *IngressSource) getIngress(ctx context.Context, namespace string, name string) (*k8snet.Ingress, error) {
+	obj, _ := newIngressObjects(i.ingressAPI)
+	if err := i.cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil {
+		return nil, err
+	}
+	return toIngress(obj)
+}
+
+// listIngresses lists the ingresses in the cache, converted to networking.k8s.io/v1
+func (i *IngressSource) listIngresses(ctx context.Context, opts ...client.ListOption) ([]*k8snet.Ingress, error) {
+	_, list := newIngressObjects(i.ingressAPI)
+	if err := i.cache.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	items, err := apimeta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	ingresses := []*k8snet.Ingress{}
+	for _, item := range items {
+		ingress, err := toIngress(item)
+		if err != nil {
+			return nil, err
+		}
+		ingresses = append(ingresses, ingress)
+	}
+	return ingresses, nil
+}
+
+// withStatusAddresses lets the hostnames resolve to the load balancer IPs of the ingress,
+// none are returned until the ingress controller has reported any. The IPs of the
+// advertise-ip annotation take precedence.
+func (i *IngressSource) withStatusAddresses(ingress *k8snet.Ingress, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	if len(hostnames) > 0 && hostnames[0].IPs != "" {
+		return hostnames
+	}
+	ips, err := getLoadBalancerIPs(ingress.Status.LoadBalancer)
+	if err != nil {
+		log.Errorf("Not broadcasting ingress %v/%v: %v", ingress.Namespace, ingress.Name, err)
+		return []announce.LocalHostname{}
+	}
+	if len(ips) == 0 {
+		if len(hostnames) > 0 {
+			log.Debugf("Not broadcasting ingress %v/%v until it has a load balancer IP", ingress.Namespace, ingress.Name)
+		}
+		return []announce.LocalHostname{}
+	}
+	values := []string{}
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+	for index := range hostnames {
+		hostnames[index].IPs = strings.Join(values, ",")
+	}
+	return hostnames
+}
+
+// updateStatus patches the status annotation of the ingress when it changed,
+// ingresses without any eligible hostnames are left alone
+func (i *IngressSource) updateStatus(ctx context.Context, ingress *k8snet.Ingress, hostnames []announce.LocalHostname, registered []announce.LocalHostname) error {
+	current, exists := ingress.Annotations[statusAnnotation]
+	if !exists && len(hostnames) == 0 {
+		return nil
+	}
+	status := i.getStatus(registered)
+	if current == status {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{statusAnnotation: status},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	switch i.ingressAPI {
+	case netv1beta1.SchemeGroupVersion:
+		_, err = i.clientset.NetworkingV1beta1().Ingresses(ingress.Namespace).Patch(ctx, ingress.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case extv1beta1.SchemeGroupVersion:
+		_, err = i.clientset.ExtensionsV1beta1().Ingresses(ingress.Namespace).Patch(ctx, ingress.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		_, err = i.clientset.NetworkingV1().Ingresses(ingress.Namespace).Patch(ctx, ingress.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write the status of ingress %v/%v: %v", ingress.Namespace, ingress.Name, err)
+	}
+	return nil
+}
+
+// getStatus describes the registered hostnames, e.g. broadcast=true,ip=192.168.1.20,port=443.
+// The ip and port entries are repeated when there are several.
+func (i *IngressSource) getStatus(registered []announce.LocalHostname) string {
+	if len(registered) == 0 {
+		return "broadcast=false"
+	}
+	entries := []string{"broadcast=true"}
+	if registered[0].IPs != "" {
+		for _, ip := range strings.Split(registered[0].IPs, ",") {
+			entries = append(entries, "ip="+ip)
+		}
+	} else {
+		for _, ip := range i.controller.Addresses() {
+			entries = append(entries, "ip="+ip.String())
+		}
+	}
+	ports := []int{}
+	for _, local := range registered {
+		port := i.controller.Service(local).Port
+		if !containsPort(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		entries = append(entries, fmt.Sprintf("port=%v", port))
+	}
+	return strings.Join(entries, ",")
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, other := range ports {
+		if other == port {
+			return true
+		}
+	}
+	return false
+}
+
+// IngressHostnames returns the hostnames the filter allows broadcasting for the ingress
+func IngressHostnames(ingress *k8snet.Ingress, filter *Filter, publishMetadata bool) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	if !filter.Allows(ingress) {
+		return hostnames
+	}
+	// Hosts listed in the tls section are served on both ports, a tls
+	// section without any hosts applies to all hosts of the ingress.
+	txt := getTXT(ingress)
+	if publishMetadata {
+		ref := ObjectRef{Kind: "Ingress", Namespace: ingress.Namespace, Name: ingress.Name}
+		txt = withMetadata(txt, ref, getIngressClass(ingress))
+	}
+	tlsHosts := map[string]bool{}
+	allTLS := false
+	for _, ingressTLS := range ingress.Spec.TLS {
+		if len(ingressTLS.Hosts) == 0 {
+			allTLS = true
+		}
+		for _, host := range ingressTLS.Hosts {
+			tlsHosts[host] = true
+		}
+	}
+	for _, rule := range ingress.Spec.Rules {
+		for _, hostname := range filter.Hostnames(rule.Host, getRuleBackends(rule)) {
+			if allTLS || tlsHosts[rule.Host] {
+				hostnames = append(hostnames,
+					announce.LocalHostname{TLS: false, Hostname: hostname, TXT: txt},
+					announce.LocalHostname{TLS: true, Hostname: hostname, TXT: txt},
+				)
+				continue
+			}
+			hostnames = append(hostnames, announce.LocalHostname{TLS: false, Hostname: hostname, TXT: txt})
+		}
+	}
+	if ports, exists := filter.ClassPorts[getIngressClass(ingress)]; exists {
+		for index := range hostnames {
+			hostnames[index].Port = ports.Cleartext
+			if hostnames[index].TLS {
+				hostnames[index].Port = ports.TLS
+			}
+		}
+	}
+	hostnames = withBackendProtocol(ingress, withServiceTypes(ingress, withAliases(ingress, hostnames)))
+	return withPorts(ingress, withAdvertiseIPs(ingress, withSubtypes(ingress, hostnames)))
+}
+
+// The ingress-nginx annotation selecting the protocol spoken to the backends
+const backendProtocolAnnotation = "nginx.ingress.kubernetes.io/backend-protocol"
+
+// withBackendProtocol additionally advertises the hostnames of gRPC backends as
+// _grpc._tcp with a proto=h2 TXT entry, so discovery clients know to speak HTTP/2.
+// HTTPS only concerns the connection of the ingress controller to the backend, the
+// hostnames are advertised as usual.
+func withBackendProtocol(ingress *k8snet.Ingress, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	switch strings.ToUpper(strings.TrimSpace(ingress.Annotations[backendProtocolAnnotation])) {
+	case "GRPC", "GRPCS":
+	default:
+		return hostnames
+	}
+	for index := range hostnames {
+		local := &hostnames[index]
+		types := []string{}
+		if local.ServiceTypes != "" {
+			types = strings.Split(local.ServiceTypes, ",")
+		}
+		if !contains(types, "_grpc._tcp") {
+			local.ServiceTypes = strings.Join(append(types, "_grpc._tcp"), ",")
+		}
+		txt := local.TXT
+		if txt == "" {
+			txt = defaultTXT
+		}
+		if !contains(strings.Split(txt, ","), "proto=h2") {
+			local.TXT = txt + ",proto=h2"
+		}
+	}
+	return hostnames
+}
+
+// getIngressClass returns the class of the ingress, falling back to the deprecated annotation
+func getIngressClass(ingress *k8snet.Ingress) string {
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName
+	}
+	return ingress.Annotations["kubernetes.io/ingress.class"]
+}
+
+// getRuleBackends returns the names of the Services the rule routes to
+func getRuleBackends(rule k8snet.IngressRule) []string {
+	backends := []string{}
+	if rule.HTTP == nil {
+		return backends
+	}
+	for _, path := range rule.HTTP.Paths {
+		if path.Backend.Service != nil {
+			backends = append(backends, path.Backend.Service.Name)
+		}
+	}
+	return backends
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	k8snet "k8s.io/api/networking/v1"
+	netv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// IngressAPIs are the group versions Ingresses can be watched through, in order of
+// preference. Clusters older than Kubernetes 1.19 only serve the v1beta1 versions.
+var IngressAPIs = []schema.GroupVersion{
+	k8snet.SchemeGroupVersion,
+	netv1beta1.SchemeGroupVersion,
+	extv1beta1.SchemeGroupVersion,
+}
+
+// newIngressObjects returns an empty Ingress and IngressList of the group version,
+// networking.k8s.io/v1 for any other
+func newIngressObjects(groupVersion schema.GroupVersion) (client.Object, client.ObjectList) {
+	switch groupVersion {
+	case netv1beta1.SchemeGroupVersion:
+		return &netv1beta1.Ingress{}, &netv1beta1.IngressList{}
+	case extv1beta1.SchemeGroupVersion:
+		return &extv1beta1.Ingress{}, &extv1beta1.IngressList{}
+	}
+	return &k8snet.Ingress{}, &k8snet.IngressList{}
+}
+
+// The subset of the v1beta1 Ingress types that differs from networking.k8s.io/v1,
+// the service of a backend became a field of its own and the backend of the spec
+// was renamed to defaultBackend
+type v1beta1Ingress struct {
+	Spec struct {
+		Backend *v1beta1IngressBackend `json:"backend"`
+		Rules   []struct {
+			HTTP *struct {
+				Paths []struct {
+					Backend v1beta1IngressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type v1beta1IngressBackend struct {
+	ServiceName string                        `json:"serviceName"`
+	ServicePort intstr.IntOrString            `json:"servicePort"`
+	Resource    *v1.TypedLocalObjectReference `json:"resource"`
+}
+
+func (b v1beta1IngressBackend) toV1() k8snet.IngressBackend {
+	backend := k8snet.IngressBackend{Resource: b.Resource}
+	if b.ServiceName == "" {
+		return backend
+	}
+	backend.Service = &k8snet.IngressServiceBackend{Name: b.ServiceName}
+	if b.ServicePort.Type == intstr.String {
+		backend.Service.Port.Name = b.ServicePort.StrVal
+	} else {
+		backend.Service.Port.Number = b.ServicePort.IntVal
+	}
+	return backend
+}
+
+// toIngress converts an Ingress of any of the IngressAPIs to networking.k8s.io/v1, the
+// fields the versions share are carried over through their JSON representation
+func toIngress(obj runtime.Object) (*k8snet.Ingress, error) {
+	if ingress, ok := obj.(*k8snet.Ingress); ok {
+		return ingress, nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	ingress := &k8snet.Ingress{}
+	if err := json.Unmarshal(data, ingress); err != nil {
+		return nil, err
+	}
+	ingress.TypeMeta = metav1.TypeMeta{}
+	beta := &v1beta1Ingress{}
+	if err := json.Unmarshal(data, beta); err != nil {
+		return nil, err
+	}
+	if beta.Spec.Backend != nil {
+		backend := beta.Spec.Backend.toV1()
+		ingress.Spec.DefaultBackend = &backend
+	}
+	for ruleIndex, rule := range beta.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for pathIndex, path := range rule.HTTP.Paths {
+			ingress.Spec.Rules[ruleIndex].HTTP.Paths[pathIndex].Backend = path.Backend.toV1()
+		}
+	}
+	return ingress, nil
+}
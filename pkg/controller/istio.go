@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var (
+	istioGatewayKind   = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "Gateway"}
+	virtualServiceKind = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "VirtualService"}
+)
+
+// The subset of the Istio networking types needed to determine hostnames
+type istioGateway struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Servers []istioServer `json:"servers"`
+	} `json:"spec"`
+}
+
+type istioServer struct {
+	Hosts []string `json:"hosts"`
+	Port  struct {
+		Protocol string `json:"protocol"`
+	} `json:"port"`
+}
+
+type virtualService struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Hosts    []string `json:"hosts"`
+		Gateways []string `json:"gateways"`
+	} `json:"spec"`
+}
+
+// IstioSource keeps track of the hostnames registered for each VirtualService.
+// The hosts are advertised on the ports of the ingress controller, i.e. the
+// istio-ingressgateway Service, the Gateway servers decide between cleartext and TLS.
+type IstioSource struct {
+	controller    *Controller
+	cache         *Cache
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewIstioSource watches Istio Gateways and VirtualServices in the cache
+func NewIstioSource(cache *Cache, controller *Controller) *IstioSource {
+	s := &IstioSource{
+		controller:    controller,
+		cache:         cache,
+		registrations: newObjectRegistrations(controller),
+	}
+	s.queue = newRegistrationQueue("virtualservices", controller, s.sync)
+	return s
+}
+
+// SetupWithManager adds the controller syncing changed VirtualServices to the manager,
+// the VirtualServices bound to a Gateway are synced when it changes
+func (s *IstioSource) SetupWithManager(mgr manager.Manager) error {
+	ctx := context.Background()
+	log.Debugf("Watching istio gateways")
+	if err := s.cache.Watch(ctx, newObject(istioGatewayKind), "istio-gateways"); err != nil {
+		return err
+	}
+	log.Debugf("Watching virtualservices")
+	if err := s.cache.Watch(ctx, newObject(virtualServiceKind), "virtualservices"); err != nil {
+		return err
+	}
+	return s.queue.newControllerManagedBy(mgr, newObject(virtualServiceKind), "virtualservices").
+		Watches(
+			&source.Kind{Type: newObject(istioGatewayKind)},
+			handler.EnqueueRequestsFromMapFunc(s.gatewayVirtualServices),
+			builder.WithPredicates(countResyncs("istio-gateways")),
+		).
+		Complete(s.queue)
+}
+
+// Resync re-evaluates the hostnames of all VirtualServices
+func (s *IstioSource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), s.cache, virtualServiceKind) {
+		s.queue.AddKey(key, force)
+	}
+	s.queue.AddRegistered(s.registrations, force)
+}
+
+func (s *IstioSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "VirtualService", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, s.cache, virtualServiceKind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	vs := &virtualService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, vs); err != nil {
+		// Retrying will not make the virtualservice parseable, wait for it to change instead
+		log.Errorf("Unable to parse virtualservice %v: %v", key, err)
+		return nil
+	}
+	return s.registrations.Update(ctx, key, ref, s.getHostnames(ctx, vs), force)
+}
+
+// gatewayVirtualServices returns all VirtualServices bound to the gateway
+func (s *IstioSource) gatewayVirtualServices(gw client.Object) []reconcile.Request {
+	gatewayKey := gw.GetNamespace() + "/" + gw.GetName()
+	keys := []string{}
+	for _, vsObj := range listObjects(context.Background(), s.cache, virtualServiceKind) {
+		vs := &virtualService{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(vsObj.Object, vs); err != nil {
+			continue
+		}
+		for _, gateway := range vs.Spec.Gateways {
+			if virtualServiceGatewayKey(vs, gateway) == gatewayKey {
+				keys = append(keys, vsObj.GetNamespace()+"/"+vsObj.GetName())
+				break
+			}
+		}
+	}
+	return s.queue.requests(keys...)
+}
+
+func (s *IstioSource) getHostnames(ctx context.Context, vs *virtualService) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := s.controller.Filter()
+	if !filter.Allows(vs) {
+		return hostnames
+	}
+	txt := getTXT(vs)
+	if s.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "VirtualService", Namespace: vs.Namespace, Name: vs.Name}, "istio")
+	}
+	for _, gatewayName := range vs.Spec.Gateways {
+		if gatewayName == "mesh" {
+			continue
+		}
+		item, err := getObject(ctx, s.cache, istioGatewayKind, virtualServiceGatewayKey(vs, gatewayName))
+		if err != nil || item == nil {
+			log.Debugf("Gateway %v of virtualservice %v not found", gatewayName, vs.Name)
+			continue
+		}
+		gw := &istioGateway{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, gw); err != nil {
+			log.Errorf("Unable to parse istio gateway %v: %v", gatewayName, err)
+			continue
+		}
+		for _, host := range vs.Spec.Hosts {
+			for _, server := range gw.Spec.Servers {
+				tls := server.Port.Protocol == "HTTPS"
+				if server.Port.Protocol != "HTTP" && !tls {
+					continue
+				}
+				if !istioServerAccepts(server, gw.Namespace, vs.Namespace, host) {
+					continue
+				}
+				for _, hostname := range filter.Hostnames(host, nil) {
+					local := announce.LocalHostname{TLS: tls, Hostname: hostname, TXT: txt}
+					if !containsHostname(hostnames, local) {
+						hostnames = append(hostnames, local)
+					}
+				}
+			}
+		}
+	}
+	return withSubtypes(vs, withServiceTypes(vs, withAliases(vs, hostnames)))
+}
+
+// virtualServiceGatewayKey returns the store key of a gateway referenced as name or namespace/name
+func virtualServiceGatewayKey(vs *virtualService, gateway string) string {
+	if strings.Contains(gateway, "/") {
+		return gateway
+	}
+	return vs.Namespace + "/" + gateway
+}
+
+// istioServerAccepts checks whether the server exposes the host of a VirtualService
+// in the namespace, server hosts may be prefixed with the namespace they apply to
+func istioServerAccepts(server istioServer, gatewayNamespace string, namespace string, host string) bool {
+	for _, serverHost := range server.Hosts {
+		if parts := strings.SplitN(serverHost, "/", 2); len(parts) == 2 {
+			switch parts[0] {
+			case "*", namespace:
+			case ".":
+				if gatewayNamespace != namespace {
+					continue
+				}
+			default:
+				continue
+			}
+			serverHost = parts[1]
+		}
+		if serverHost == "*" || hostnameMatches(serverHost, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var mdnsEntryKind = schema.GroupVersionKind{Group: "ingress-mdns.secoya.io", Version: "v1alpha1", Kind: "MDNSEntry"}
+
+// mdnsEntry is a static registration of a hostname, see deploy/mdnsentry-crd.yaml
+type mdnsEntry struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Hostname string `json:"hostname"`
+		// IP the hostname resolves to, the advertised IPs when empty
+		IP string `json:"ip"`
+		// Port of the service, the cleartext or TLS port of the ingress controller when 0
+		Port int      `json:"port"`
+		TLS  bool     `json:"tls"`
+		TXT  []string `json:"txt"`
+	} `json:"spec"`
+}
+
+// MDNSEntrySource keeps track of the hostnames registered for each MDNSEntry
+type MDNSEntrySource struct {
+	controller    *Controller
+	cache         *Cache
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewMDNSEntrySource watches the MDNSEntries in the cache
+func NewMDNSEntrySource(cache *Cache, controller *Controller) *MDNSEntrySource {
+	m := &MDNSEntrySource{
+		controller:    controller,
+		cache:         cache,
+		registrations: newObjectRegistrations(controller),
+	}
+	m.queue = newRegistrationQueue("mdnsentries", controller, m.sync)
+	return m
+}
+
+// SetupWithManager adds the controller syncing changed MDNSEntries to the manager
+func (m *MDNSEntrySource) SetupWithManager(mgr manager.Manager) error {
+	log.Debugf("Watching mdnsentries")
+	return m.queue.setupWithManager(mgr, m.cache, mdnsEntryKind, "mdnsentries")
+}
+
+// Resync re-evaluates the hostnames of all MDNSEntries
+func (m *MDNSEntrySource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), m.cache, mdnsEntryKind) {
+		m.queue.AddKey(key, force)
+	}
+	m.queue.AddRegistered(m.registrations, force)
+}
+
+func (m *MDNSEntrySource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "MDNSEntry", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, m.cache, mdnsEntryKind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		m.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	entry := &mdnsEntry{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, entry); err != nil {
+		// Retrying will not make the entry parseable, wait for it to change instead
+		log.Errorf("Unable to parse mdnsentry %v: %v", key, err)
+		return nil
+	}
+	return m.registrations.Update(ctx, key, ref, m.getHostnames(entry), force)
+}
+
+// getHostnames returns the hostname of the entry with its IP, port and TXT record
+func (m *MDNSEntrySource) getHostnames(entry *mdnsEntry) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := m.controller.Filter()
+	if !filter.Allows(entry) {
+		return hostnames
+	}
+	if entry.Spec.IP != "" && net.ParseIP(entry.Spec.IP) == nil {
+		log.Errorf("Invalid IP %v of mdnsentry %v/%v", entry.Spec.IP, entry.Namespace, entry.Name)
+		return hostnames
+	}
+	txt := getTXT(entry)
+	if len(entry.Spec.TXT) > 0 {
+		txt = strings.Join(entry.Spec.TXT, ",")
+	}
+	if m.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "MDNSEntry", Namespace: entry.Namespace, Name: entry.Name}, "")
+	}
+	for _, hostname := range filter.Hostnames(entry.Spec.Hostname, nil) {
+		local := announce.LocalHostname{
+			TLS:      entry.Spec.TLS,
+			Hostname: hostname,
+			Port:     entry.Spec.Port,
+			TXT:      txt,
+			IPs:      entry.Spec.IP,
+		}
+		if !containsHostname(hostnames, local) {
+			hostnames = append(hostnames, local)
+		}
+	}
+	return withSubtypes(entry, withServiceTypes(entry, withAliases(entry, hostnames)))
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NodeAddresses follows the Node the pod runs on, its InternalIPs select the
+// interfaces the hostnames are broadcast on
+type NodeAddresses struct {
+	name      string
+	informers informers.SharedInformerFactory
+	synced    cache.InformerSynced
+
+	lock     sync.RWMutex
+	ips      []net.IP
+	onChange func(ips []net.IP)
+}
+
+// NewNodeAddresses sets up an informer for the Node with the given name that resyncs
+// after resyncPeriod or never when 0
+func NewNodeAddresses(clientset kubernetes.Interface, name string, resyncPeriod time.Duration) *NodeAddresses {
+	n := &NodeAddresses{name: name}
+	n.informers = informers.NewSharedInformerFactoryWithOptions(clientset, resyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	log.Debugf("Watching node %v", name)
+	informer := n.informers.Core().V1().Nodes().Informer()
+	n.synced = informer.HasSynced
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			n.update(obj.(*v1.Node))
+		},
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			n.update(newObj.(*v1.Node))
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warnf("Node %v was deleted, keeping the last known IPs", name)
+		},
+	})
+	return n
+}
+
+// OnChange sets the function called with the new IPs whenever the InternalIPs change
+func (n *NodeAddresses) OnChange(onChange func(ips []net.IP)) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.onChange = onChange
+}
+
+// Run watches the Node until stop is closed
+func (n *NodeAddresses) Run(stop <-chan struct{}) {
+	n.informers.Start(stop)
+}
+
+// HasSynced returns true once the Node has been listed
+func (n *NodeAddresses) HasSynced() bool {
+	return n.synced()
+}
+
+// IPs returns the InternalIPs of the Node
+func (n *NodeAddresses) IPs() []net.IP {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.ips
+}
+
+func (n *NodeAddresses) update(node *v1.Node) {
+	ips := GetNodeIPs(node)
+	if len(ips) == 0 {
+		log.Errorf("Keeping the last known IPs of node %v: it has no InternalIP", n.name)
+		return
+	}
+	n.lock.Lock()
+	changed := n.ips != nil && !reflect.DeepEqual(ips, n.ips)
+	n.ips = ips
+	onChange := n.onChange
+	n.lock.Unlock()
+
+	if changed {
+		log.WithField("ips", ips).Infof("Node %v changed", n.name)
+		if onChange != nil {
+			onChange(ips)
+		}
+	}
+}
+
+// GetNodeIPs returns the InternalIPs of the Node
+func GetNodeIPs(node *v1.Node) []net.IP {
+	ips := []net.IP{}
+	for _, address := range node.Status.Addresses {
+		if address.Type != v1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(address.Address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
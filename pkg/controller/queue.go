@@ -0,0 +1,351 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// registrationQueue syncs the objects of a source one key at a time as the reconciler
+// of a controller-runtime controller. Keys that fail to sync are retried with
+// exponential backoff.
+type registrationQueue struct {
+	name       string
+	controller *Controller
+	sync       func(ctx context.Context, key string, force bool) error
+
+	lock sync.Mutex
+	// The workqueue of the controller once it started
+	queue workqueue.RateLimitingInterface
+	// Keys enqueued by a resync are synced without waiting for the debounce window,
+	// true when they are forced to re-register all hostnames
+	resyncs map[string]bool
+	// When the first change of a key that has not been synced yet was seen,
+	// the sync span starts at that time
+	changed map[string]time.Time
+}
+
+func newRegistrationQueue(name string, controller *Controller, sync func(ctx context.Context, key string, force bool) error) *registrationQueue {
+	return &registrationQueue{
+		name:       name,
+		controller: controller,
+		sync:       sync,
+		resyncs:    map[string]bool{},
+		changed:    map[string]time.Time{},
+	}
+}
+
+// newControllerManagedBy returns the builder of the controller reconciling the objects
+// of the source, which only runs while this replica is the leader. The changes of the
+// objects are counted as resource.
+func (q *registrationQueue) newControllerManagedBy(mgr manager.Manager, obj client.Object, resource string) *builder.Builder {
+	name := q.name
+	// The controllers of several clusters share the metrics
+	q.controller.lock.RLock()
+	if q.controller.cluster != "" {
+		name = q.controller.cluster + "-" + name
+	}
+	q.controller.lock.RUnlock()
+	return builder.ControllerManagedBy(mgr).
+		Named(name).
+		For(obj, builder.WithPredicates(q.predicate(resource))).
+		Watches(resyncSource{q}, &handler.Funcs{}).
+		WithOptions(ctrlcontroller.Options{
+			RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute*5),
+		})
+}
+
+// setupWithManager watches the custom resources of the kind in the cache and adds the
+// controller syncing the changed ones to the manager
+func (q *registrationQueue) setupWithManager(mgr manager.Manager, cache *Cache, gvk schema.GroupVersionKind, resource string) error {
+	if err := cache.Watch(context.Background(), newObject(gvk), resource); err != nil {
+		return err
+	}
+	return q.newControllerManagedBy(mgr, newObject(gvk), resource).Complete(q)
+}
+
+// predicate lets all events of the object through, noting when it changed
+func (q *registrationQueue) predicate(resource string) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			q.markChanged(objectKey(e.Object))
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			metrics.CountResync(resource, e.ObjectOld, e.ObjectNew)
+			q.markChanged(objectKey(e.ObjectNew))
+			return true
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			q.markChanged(objectKey(e.Object))
+			return true
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			q.markChanged(objectKey(e.Object))
+			return true
+		},
+	}
+}
+
+// countResyncs counts the periodic resyncs of a resource that is watched for the
+// objects it affects
+func countResyncs(resource string) predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			metrics.CountResync(resource, e.ObjectOld, e.ObjectNew)
+			return true
+		},
+	}
+}
+
+// requests returns the requests of the keys of objects affected by a change of
+// another resource, for handler.EnqueueRequestsFromMapFunc
+func (q *registrationQueue) requests(keys ...string) []reconcile.Request {
+	requests := []reconcile.Request{}
+	for _, key := range keys {
+		q.markChanged(key)
+		requests = append(requests, requestForKey(key))
+	}
+	return requests
+}
+
+// AddRegistered enqueues the keys of all objects hostnames are registered for, so the
+// hostnames of objects that were deleted while the watch was down are unregistered
+func (q *registrationQueue) AddRegistered(registrations *objectRegistrations, force bool) {
+	for _, key := range registrations.Keys() {
+		q.AddKey(key, force)
+	}
+}
+
+// AddKey enqueues the key, a forced sync re-registers all hostnames of the object.
+// Before the controller started the objects are enqueued by its initial list anyway.
+func (q *registrationQueue) AddKey(key string, force bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.resyncs[key] = q.resyncs[key] || force
+	if _, exists := q.changed[key]; !exists {
+		q.changed[key] = time.Now()
+	}
+	if q.queue != nil {
+		q.queue.Add(requestForKey(key))
+	}
+}
+
+func (q *registrationQueue) markChanged(key string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, exists := q.changed[key]; !exists {
+		q.changed[key] = time.Now()
+	}
+}
+
+// Reconcile syncs the key of the request, failed syncs are requeued by the controller.
+// With a debounce window all changes of the object within the window are synced at once.
+func (q *registrationQueue) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	// Passes panics of the syncs to the error reporting before crashing
+	defer utilruntime.HandleCrash()
+	key := request.Name
+	if request.Namespace != "" {
+		key = request.Namespace + "/" + request.Name
+	}
+
+	debounce := q.controller.Debounce()
+	q.lock.Lock()
+	force, resync := q.resyncs[key]
+	changed, exists := q.changed[key]
+	if !exists {
+		changed = time.Now()
+	}
+	if !resync && debounce > 0 {
+		if wait := time.Until(changed.Add(debounce)); wait > 0 {
+			q.changed[key] = changed
+			q.lock.Unlock()
+			return reconcile.Result{RequeueAfter: wait}, nil
+		}
+	}
+	delete(q.resyncs, key)
+	delete(q.changed, key)
+	retries := q.queue.NumRequeues(request)
+	q.lock.Unlock()
+
+	// The span covers the time from the change to the registration of the hostnames
+	ctx, span := tracer.Start(ctx, "sync "+q.name,
+		trace.WithTimestamp(changed),
+		trace.WithAttributes(
+			attribute.String("key", key),
+			attribute.Bool("force", force),
+			attribute.Int("retries", retries),
+		),
+	)
+	defer span.End()
+	span.AddEvent("dequeued")
+	if err := q.sync(ctx, key, force); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.WithFields(log.Fields{"key": key, "retries": retries}).Warnf("Sync failed, retrying: %v", err)
+		q.lock.Lock()
+		q.changed[key] = changed
+		q.lock.Unlock()
+		// Requeued with backoff without the controller logging the error again
+		return reconcile.Result{Requeue: true}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// resyncSource hands the workqueue of the controller to the resyncs of the source,
+// they enqueue objects that did not change, e.g. to re-register their hostnames
+type resyncSource struct {
+	queue *registrationQueue
+}
+
+func (s resyncSource) Start(ctx context.Context, _ handler.EventHandler, queue workqueue.RateLimitingInterface, _ ...predicate.Predicate) error {
+	s.queue.lock.Lock()
+	defer s.queue.lock.Unlock()
+	s.queue.queue = queue
+	return nil
+}
+
+// objectKey returns the namespace/name key of the object, just the name for cluster
+// scoped objects
+func objectKey(obj client.Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// requestForKey returns the request of a namespace/name key, keys of cluster scoped
+// objects are just the name
+func requestForKey(key string) reconcile.Request {
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}
+}
+
+// objectRegistrations keeps track of the hostnames registered for each object of a source
+type objectRegistrations struct {
+	controller *Controller
+
+	lock      sync.Mutex
+	hostnames map[string][]announce.LocalHostname
+}
+
+func newObjectRegistrations(controller *Controller) *objectRegistrations {
+	return &objectRegistrations{
+		controller: controller,
+		hostnames:  map[string][]announce.LocalHostname{},
+	}
+}
+
+// Update registers the hostnames of the object and unregisters the ones it no longer has.
+// Only hostnames that were registered successfully are remembered, so a retry
+// picks up the ones that failed.
+func (r *objectRegistrations) Update(ctx context.Context, key string, ref ObjectRef, hostnames []announce.LocalHostname, force bool) error {
+	hostnames = r.controller.ownedHostnames(r.controller.validHostnames(ref, r.controller.renameHostnames(ref, hostnames)))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	oldHostnames, exists := r.hostnames[key]
+	if exists && !force && reflect.DeepEqual(oldHostnames, hostnames) {
+		return nil
+	}
+	keep := []announce.LocalHostname{}
+	removed := []announce.LocalHostname{}
+	for _, local := range oldHostnames {
+		if !force && containsHostname(hostnames, local) {
+			keep = append(keep, local)
+		} else {
+			removed = append(removed, local)
+		}
+	}
+	added := []announce.LocalHostname{}
+	for _, local := range hostnames {
+		if !containsHostname(keep, local) {
+			added = append(added, local)
+		}
+	}
+	if exists && (len(removed) > 0 || len(added) > 0) {
+		log.WithFields(ref.Fields()).Infof("%v changed, re-registering hostnames", ref.Kind)
+	}
+	r.controller.Unregister(ctx, ref, removed)
+	registered, err := r.controller.Register(ctx, ref, added)
+	r.hostnames[key] = append(keep, registered...)
+	return err
+}
+
+// Registered returns the hostnames that are currently registered for the object
+func (r *objectRegistrations) Registered(key string) []announce.LocalHostname {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]announce.LocalHostname{}, r.hostnames[key]...)
+}
+
+// Keys returns the keys of the objects hostnames are registered for
+func (r *objectRegistrations) Keys() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	keys := []string{}
+	for key := range r.hostnames {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// claimedBy maps the hostnames that are registered for other objects to the key of that object
+func (r *objectRegistrations) claimedBy(key string, hostnames []announce.LocalHostname) map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	claimed := map[string]string{}
+	for otherKey, registered := range r.hostnames {
+		if otherKey == key {
+			continue
+		}
+		for _, other := range registered {
+			for _, local := range hostnames {
+				if strings.EqualFold(local.Hostname, other.Hostname) {
+					claimed[local.Hostname] = otherKey
+				}
+			}
+		}
+	}
+	return claimed
+}
+
+// Remove unregisters all hostnames of the object
+func (r *objectRegistrations) Remove(ctx context.Context, key string, ref ObjectRef) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if hostnames, exists := r.hostnames[key]; exists {
+		r.controller.Unregister(ctx, ref, hostnames)
+		delete(r.hostnames, key)
+	}
+}
+
+func containsHostname(hostnames []announce.LocalHostname, local announce.LocalHostname) bool {
+	for _, hostname := range hostnames {
+		if hostname == local {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	k8snet "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// RequireReadyEndpoints only broadcasts the hosts of an ingress whose backend Services
+// have ready endpoints, they are unregistered once all endpoints become unready.
+// The EndpointSlices of the watched namespaces are watched as well.
+func (i *IngressSource) RequireReadyEndpoints() {
+	i.readyEndpoints = true
+}
+
+// sliceIngresses returns the ingresses routing to the Service of an EndpointSlice
+func (i *IngressSource) sliceIngresses(obj client.Object) []reconcile.Request {
+	service, exists := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if !exists {
+		return nil
+	}
+	return i.namespaceIngresses(obj.GetNamespace(), func(ingress *k8snet.Ingress) bool {
+		return contains(getIngressBackends(ingress), service)
+	})
+}
+
+// withReadyEndpoints drops the hostnames of the rules whose backends have no ready
+// endpoints, unless another rule of the same host has them, and all hostnames when
+// no rule has any
+func (i *IngressSource) withReadyEndpoints(ctx context.Context, ingress *k8snet.Ingress, hostnames []announce.LocalHostname) []announce.LocalHostname {
+	filter := i.controller.Filter()
+	unready := []string{}
+	readyHosts := []string{}
+	anyReady := false
+	for _, rule := range ingress.Spec.Rules {
+		backends := getRuleBackends(rule)
+		if len(backends) == 0 && ingress.Spec.DefaultBackend != nil && ingress.Spec.DefaultBackend.Service != nil {
+			backends = []string{ingress.Spec.DefaultBackend.Service.Name}
+		}
+		ready := false
+		for _, backend := range backends {
+			if hasReadyEndpoints(ctx, i.cache, ingress.Namespace, backend) {
+				ready = true
+				break
+			}
+		}
+		if ready {
+			anyReady = true
+			readyHosts = append(readyHosts, filter.Hostnames(rule.Host, backends)...)
+			continue
+		}
+		unready = append(unready, filter.Hostnames(rule.Host, backends)...)
+	}
+	if !anyReady {
+		if len(hostnames) > 0 {
+			log.Debugf("Not broadcasting ingress %v/%v until its backends have ready endpoints", ingress.Namespace, ingress.Name)
+		}
+		return []announce.LocalHostname{}
+	}
+	ready := []announce.LocalHostname{}
+	for _, local := range hostnames {
+		if !contains(unready, local.Hostname) || contains(readyHosts, local.Hostname) {
+			ready = append(ready, local)
+		}
+	}
+	return ready
+}
+
+// hasReadyEndpoints checks whether the EndpointSlices of the Service have a ready
+// endpoint, endpoints with an unknown readiness are considered ready
+func hasReadyEndpoints(ctx context.Context, reader client.Reader, namespace string, service string) bool {
+	slices := &discoveryv1.EndpointSliceList{}
+	err := reader.List(ctx, slices, client.InNamespace(namespace), client.MatchingLabels{discoveryv1.LabelServiceName: service})
+	if err != nil {
+		return false
+	}
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getIngressBackends returns the names of the Services the ingress routes to
+func getIngressBackends(ingress *k8snet.Ingress) []string {
+	backends := []string{}
+	if ingress.Spec.DefaultBackend != nil && ingress.Spec.DefaultBackend.Service != nil {
+		backends = append(backends, ingress.Spec.DefaultBackend.Service.Name)
+	}
+	for _, rule := range ingress.Spec.Rules {
+		backends = append(backends, getRuleBackends(rule)...)
+	}
+	return backends
+}
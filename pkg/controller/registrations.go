@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+)
+
+// registration is a hostname announced for an object
+type registration struct {
+	ref        ObjectRef
+	registered time.Time
+}
+
+// Registration describes a hostname being broadcast, as served on /registrations
+type Registration struct {
+	// Hostname is the broadcast name without .local
+	Hostname    string    `json:"hostname"`
+	IPs         []string  `json:"ips"`
+	Port        int       `json:"port"`
+	TLS         bool      `json:"tls"`
+	ServiceType string    `json:"serviceType"`
+	Cluster     string    `json:"cluster,omitempty"`
+	Kind        string    `json:"kind"`
+	Namespace   string    `json:"namespace"`
+	Name        string    `json:"name"`
+	Registered  time.Time `json:"registered"`
+}
+
+// Registrations returns the announced hostnames sorted by hostname, the IPs are
+// the ones currently advertised
+func (c *Controller) Registrations() []Registration {
+	c.lock.RLock()
+	announced := map[announce.LocalHostname]registration{}
+	for local, registration := range c.announced {
+		announced[local] = registration
+	}
+	cluster := c.cluster
+	c.lock.RUnlock()
+	addresses := []string{}
+	for _, ip := range c.Addresses() {
+		addresses = append(addresses, ip.String())
+	}
+	registrations := []Registration{}
+	for local, registration := range announced {
+		service := c.Service(local)
+		ips := addresses
+		if local.IPs != "" {
+			ips = strings.Split(local.IPs, ",")
+		}
+		registrations = append(registrations, Registration{
+			Hostname:    local.Hostname,
+			IPs:         ips,
+			Port:        service.Port,
+			TLS:         local.TLS,
+			ServiceType: service.Type,
+			Cluster:     cluster,
+			Kind:        registration.ref.Kind,
+			Namespace:   registration.ref.Namespace,
+			Name:        registration.ref.Name,
+			Registered:  registration.registered,
+		})
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		if registrations[i].Hostname != registrations[j].Hostname {
+			return registrations[i].Hostname < registrations[j].Hostname
+		}
+		return !registrations[i].TLS && registrations[j].TLS
+	})
+	return registrations
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ControllerService follows the Service of the ingress controller, hostnames resolve
+// to its load balancer IPs and are advertised with the ports named http and https
+type ControllerService struct {
+	name      string
+	informers informers.SharedInformerFactory
+	synced    cache.InformerSynced
+	nodePorts bool
+
+	lock          sync.RWMutex
+	ips           announce.StaticAddresses
+	cleartextPort int
+	tlsPort       int
+	onChange      func(cleartextPort int, tlsPort int)
+}
+
+// NewControllerService sets up an informer for the Service, given as namespace/name,
+// that resyncs after resyncPeriod or never when 0
+func NewControllerService(clientset kubernetes.Interface, service string, resyncPeriod time.Duration) (*ControllerService, error) {
+	namespace, name, err := parseServiceName(service)
+	if err != nil {
+		return nil, err
+	}
+	s := &ControllerService{name: service}
+	// Only the Service itself is watched rather than sharing the informer of all Services
+	s.informers = informers.NewSharedInformerFactoryWithOptions(clientset, resyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	log.Debugf("Watching service %v", service)
+	informer := s.informers.Core().V1().Services().Informer()
+	s.synced = informer.HasSynced
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.update(obj.(*v1.Service))
+		},
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			s.update(newObj.(*v1.Service))
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warnf("Service %v was deleted, keeping the last known IPs and ports", service)
+		},
+	})
+	return s, nil
+}
+
+// UseNodePorts advertises the NodePorts of the ports named http and https instead,
+// it must be called before the Service is watched
+func (s *ControllerService) UseNodePorts(enabled bool) {
+	s.nodePorts = enabled
+}
+
+// OnChange sets the function called with the new ports whenever the IPs or ports change
+func (s *ControllerService) OnChange(onChange func(cleartextPort int, tlsPort int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onChange = onChange
+}
+
+// Run watches the Service until stop is closed
+func (s *ControllerService) Run(stop <-chan struct{}) {
+	s.informers.Start(stop)
+}
+
+// HasSynced returns true once the Service has been listed
+func (s *ControllerService) HasSynced() bool {
+	return s.synced()
+}
+
+// Addresses returns the load balancer IPs of the Service
+func (s *ControllerService) Addresses(iface net.Interface) ([]net.IP, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.ips) == 0 {
+		return nil, fmt.Errorf("No load balancer IP of service %v is known yet", s.name)
+	}
+	return s.ips, nil
+}
+
+func (s *ControllerService) update(service *v1.Service) {
+	ips, err := getLoadBalancerIPs(service.Status.LoadBalancer)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("Service %v/%v has no load balancer IP", service.Namespace, service.Name)
+	}
+	if err != nil {
+		log.Errorf("Keeping the last known IPs of service %v: %v", s.name, err)
+		s.lock.RLock()
+		ips = s.ips
+		s.lock.RUnlock()
+	}
+	cleartextPort, tlsPort := getServicePorts(service, s.nodePorts)
+
+	s.lock.Lock()
+	changed := !reflect.DeepEqual(ips, s.ips) || cleartextPort != s.cleartextPort || tlsPort != s.tlsPort
+	s.ips = ips
+	s.cleartextPort = cleartextPort
+	s.tlsPort = tlsPort
+	onChange := s.onChange
+	s.lock.Unlock()
+
+	if changed {
+		log.WithFields(log.Fields{"ips": ips, "cleartextPort": cleartextPort, "tlsPort": tlsPort}).Infof("Service %v changed", s.name)
+		if onChange != nil {
+			onChange(cleartextPort, tlsPort)
+		}
+	}
+}
+
+// getServicePorts returns the ports or NodePorts named http and https,
+// 0 when the service has no such port
+func getServicePorts(service *v1.Service, nodePorts bool) (int, int) {
+	cleartextPort, tlsPort := 0, 0
+	for _, port := range service.Spec.Ports {
+		number := int(port.Port)
+		if nodePorts {
+			number = int(port.NodePort)
+		}
+		switch port.Name {
+		case "http":
+			cleartextPort = number
+		case "https":
+			tlsPort = number
+		}
+	}
+	return cleartextPort, tlsPort
+}
+
+func parseServiceName(service string) (string, string, error) {
+	parts := strings.SplitN(service, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid service %v, expected namespace/name", service)
+	}
+	return parts[0], parts[1], nil
+}
+
+// getLoadBalancerIPs returns the IPs of a Service or Ingress load balancer status,
+// load balancers that only report a hostname are resolved
+func getLoadBalancerIPs(status v1.LoadBalancerStatus) (announce.StaticAddresses, error) {
+	ips := announce.StaticAddresses{}
+	for _, ingress := range status.Ingress {
+		if ingress.IP != "" {
+			if ip := net.ParseIP(ingress.IP); ip != nil {
+				ips = append(ips, ip)
+			}
+			continue
+		}
+		if ingress.Hostname != "" {
+			resolved, err := net.LookupIP(ingress.Hostname)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to resolve load balancer hostname %v: %v", ingress.Hostname, err)
+			}
+			log.Debugf("Resolved load balancer hostname %v to %v", ingress.Hostname, resolved)
+			ips = append(ips, resolved...)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ServiceAddress selects the IPs and port annotated Services are broadcast with
+type ServiceAddress string
+
+// The supported service addresses
+const (
+	ServiceLoadBalancer ServiceAddress = "load-balancer"
+	ServiceNodePort     ServiceAddress = "node-port"
+	ServiceClusterIP    ServiceAddress = "cluster-ip"
+)
+
+// ParseServiceAddress validates a service address
+func ParseServiceAddress(value string) (ServiceAddress, error) {
+	switch address := ServiceAddress(value); address {
+	case ServiceLoadBalancer, ServiceNodePort, ServiceClusterIP:
+		return address, nil
+	}
+	return "", fmt.Errorf("Unknown service address %v", value)
+}
+
+// ServiceSource keeps track of the hostnames registered for each Service annotated
+// with ingress-mdns.secoya.io/hostname, e.g. databases that never have an Ingress.
+// Headless Services are broadcast with a hostname per ready pod, e.g.
+// postgres-0.postgres.local, taken from their EndpointSlices.
+type ServiceSource struct {
+	controller    *Controller
+	cache         *Cache
+	address       ServiceAddress
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewServiceSource watches the Services and EndpointSlices of the watched namespaces
+// in the cache, the Services are broadcast with the IPs and port selected by address
+func NewServiceSource(cache *Cache, controller *Controller, address ServiceAddress) *ServiceSource {
+	s := &ServiceSource{
+		controller:    controller,
+		cache:         cache,
+		address:       address,
+		registrations: newObjectRegistrations(controller),
+	}
+	s.queue = newRegistrationQueue("services", controller, s.sync)
+	return s
+}
+
+// SetupWithManager adds the controller syncing changed Services to the manager,
+// the Service of an EndpointSlice is synced when the slice changes
+func (s *ServiceSource) SetupWithManager(mgr manager.Manager) error {
+	ctx := context.Background()
+	log.Debugf("Watching services in namespaces %q", s.controller.Filter().WatchNamespaces())
+	if err := s.cache.Watch(ctx, &v1.Service{}, "services"); err != nil {
+		return err
+	}
+	if err := s.cache.Watch(ctx, &discoveryv1.EndpointSlice{}, "endpointslices"); err != nil {
+		return err
+	}
+	return s.queue.newControllerManagedBy(mgr, &v1.Service{}, "services").
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(s.sliceService)).
+		Complete(s.queue)
+}
+
+// Resync re-evaluates the hostnames of all Services
+func (s *ServiceSource) Resync(force bool) {
+	services := &v1.ServiceList{}
+	if err := s.cache.List(context.Background(), services); err != nil {
+		log.Errorf("Unable to list services: %v", err)
+	}
+	for _, service := range services.Items {
+		s.queue.AddKey(service.Namespace+"/"+service.Name, force)
+	}
+	s.queue.AddRegistered(s.registrations, force)
+}
+
+func (s *ServiceSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "Service", Namespace: namespace, Name: name}
+	service := &v1.Service{}
+	err = s.cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, service)
+	if errors.IsNotFound(err) {
+		s.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ref.UID = service.UID
+	hostnames, err := s.getHostnames(ctx, service)
+	if err != nil {
+		return err
+	}
+	return s.registrations.Update(ctx, key, ref, hostnames, force)
+}
+
+// sliceService returns the Service an EndpointSlice belongs to
+func (s *ServiceSource) sliceService(obj client.Object) []reconcile.Request {
+	service, exists := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if !exists {
+		return nil
+	}
+	return s.queue.requests(obj.GetNamespace() + "/" + service)
+}
+
+// getHostnames returns the hostnames of the Service's annotation, advertised with
+// the first port of the Service on the cleartext service type
+func (s *ServiceSource) getHostnames(ctx context.Context, service *v1.Service) ([]announce.LocalHostname, error) {
+	hostnames := []announce.LocalHostname{}
+	value, exists := service.Annotations[hostnameAnnotation]
+	if !exists {
+		return hostnames, nil
+	}
+	filter := s.controller.Filter()
+	if !filter.Allows(service) {
+		return hostnames, nil
+	}
+	if len(service.Spec.Ports) == 0 {
+		log.Warnf("Not broadcasting service %v/%v without any ports", service.Namespace, service.Name)
+		return hostnames, nil
+	}
+	txt := getTXT(service)
+	if s.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "Service", Namespace: service.Namespace, Name: service.Name}, "")
+	}
+	if service.Spec.ClusterIP == v1.ClusterIPNone {
+		pods, err := getReadyPods(ctx, s.cache, service)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range strings.Split(value, ",") {
+			for _, hostname := range filter.Hostnames(strings.TrimSpace(host), nil) {
+				for _, pod := range pods {
+					local := announce.LocalHostname{Hostname: pod.name + "." + hostname, Port: pod.port, TXT: txt, IPs: pod.ips}
+					if !containsHostname(hostnames, local) {
+						hostnames = append(hostnames, local)
+					}
+				}
+			}
+		}
+		return withSubtypes(service, withServiceTypes(service, hostnames)), nil
+	}
+	port, ips, err := s.getAddress(service)
+	if err != nil {
+		log.Debugf("Not broadcasting service %v/%v yet: %v", service.Namespace, service.Name, err)
+		return hostnames, nil
+	}
+	for _, host := range strings.Split(value, ",") {
+		for _, hostname := range filter.Hostnames(strings.TrimSpace(host), nil) {
+			local := announce.LocalHostname{Hostname: hostname, Port: port, TXT: txt, IPs: ips}
+			if !containsHostname(hostnames, local) {
+				hostnames = append(hostnames, local)
+			}
+		}
+	}
+	return withAdvertiseIPs(service, withSubtypes(service, withServiceTypes(service, withAliases(service, hostnames)))), nil
+}
+
+// readyPod is a ready endpoint of a headless Service
+type readyPod struct {
+	name string
+	port int
+	// Comma separated IPs of the pod
+	ips string
+}
+
+// getReadyPods returns the ready pods in the EndpointSlices of the headless Service,
+// advertised on the first port of their slice
+func getReadyPods(ctx context.Context, reader client.Reader, service *v1.Service) ([]readyPod, error) {
+	slices := &discoveryv1.EndpointSliceList{}
+	err := reader.List(ctx, slices, client.InNamespace(service.Namespace), client.MatchingLabels{discoveryv1.LabelServiceName: service.Name})
+	if err != nil {
+		return nil, err
+	}
+	port := int(service.Spec.Ports[0].Port)
+	pods := []readyPod{}
+	for _, slice := range slices.Items {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		slicePort := port
+		if len(slice.Ports) > 0 && slice.Ports[0].Port != nil {
+			slicePort = int(*slice.Ports[0].Port)
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Endpoints with an unknown readiness are considered ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" || len(endpoint.Addresses) == 0 {
+				continue
+			}
+			pods = append(pods, readyPod{
+				name: endpoint.TargetRef.Name,
+				port: slicePort,
+				ips:  strings.Join(endpoint.Addresses, ","),
+			})
+		}
+	}
+	return pods, nil
+}
+
+// getAddress returns the port and the comma separated IPs of the Service, no IPs
+// let the hostnames resolve to the advertised IPs like with NodePorts
+func (s *ServiceSource) getAddress(service *v1.Service) (int, string, error) {
+	port := service.Spec.Ports[0]
+	switch s.address {
+	case ServiceLoadBalancer:
+		ips, err := getLoadBalancerIPs(service.Status.LoadBalancer)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(ips) == 0 {
+			return 0, "", fmt.Errorf("No load balancer IP")
+		}
+		values := []string{}
+		for _, ip := range ips {
+			values = append(values, ip.String())
+		}
+		return int(port.Port), strings.Join(values, ","), nil
+	case ServiceNodePort:
+		if port.NodePort == 0 {
+			return 0, "", fmt.Errorf("No NodePort")
+		}
+		return int(port.NodePort), "", nil
+	case ServiceClusterIP:
+		if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == v1.ClusterIPNone {
+			return 0, "", fmt.Errorf("No cluster IP")
+		}
+		ips := service.Spec.ClusterIPs
+		if len(ips) == 0 {
+			ips = []string{service.Spec.ClusterIP}
+		}
+		return int(port.Port), strings.Join(ips, ","), nil
+	}
+	return 0, "", fmt.Errorf("Unknown service address %v", s.address)
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The label grouping the member leases of the replicas sharing the hostnames
+const shardGroupLabel = "ingress-mdns.secoya.io/shard-group"
+
+// Shards splits the hostnames between the replicas of a group. Every replica renews
+// a member Lease labelled with the group, the replicas whose lease has not expired
+// are the members. A hostname belongs to the member with the highest hash of the
+// member and the hostname (rendezvous hashing), so a member joining or leaving
+// only moves the hostnames of its own shard.
+type Shards struct {
+	clientset     kubernetes.Interface
+	namespace     string
+	group         string
+	identity      string
+	leaseDuration time.Duration
+
+	lock     sync.RWMutex
+	members  []string
+	onChange func()
+}
+
+// NewShards creates the membership of the replica identity in the group, the member
+// leases are kept in the namespace
+func NewShards(clientset kubernetes.Interface, namespace string, group string, identity string, leaseDuration time.Duration) *Shards {
+	return &Shards{
+		clientset:     clientset,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+	}
+}
+
+// OnChange sets the function called whenever a member joined or left
+func (s *Shards) OnChange(onChange func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onChange = onChange
+}
+
+// Run joins the group and renews the member lease until stop is closed, then
+// leaves the group. Unless listing the members failed they are known once Run returns.
+func (s *Shards) Run(stop <-chan struct{}) {
+	s.update()
+	go func() {
+		wait.Until(s.update, s.leaseDuration/3, stop)
+		s.leave()
+	}()
+}
+
+// Members returns the sorted identities of the replicas in the group
+func (s *Shards) Members() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string{}, s.members...)
+}
+
+// Owns returns whether the hostname belongs to the shard of this replica. No
+// hostname does until this replica is listed as a member, so replicas that cannot
+// list the group do not broadcast the shards of the others.
+func (s *Shards) Owns(hostname string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !contains(s.members, s.identity) {
+		return false
+	}
+	return shardOwner(s.members, hostname) == s.identity
+}
+
+// shardOwner returns the member with the highest hash of the member and the hostname
+func shardOwner(members []string, hostname string) string {
+	hostname = strings.ToLower(hostname)
+	var owner string
+	var highest uint64
+	for _, member := range members {
+		hash := fnv.New64a()
+		hash.Write([]byte(member))
+		hash.Write([]byte{0})
+		hash.Write([]byte(hostname))
+		if sum := hash.Sum64(); owner == "" || sum > highest {
+			owner, highest = member, sum
+		}
+	}
+	return owner
+}
+
+func (s *Shards) leaseName() string {
+	return s.group + "-" + s.identity
+}
+
+// update renews the member lease and lists the members of the group
+func (s *Shards) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.leaseDuration/3)
+	defer cancel()
+	if err := s.renew(ctx); err != nil {
+		log.Errorf("Unable to renew member lease %v/%v: %v", s.namespace, s.leaseName(), err)
+	}
+	leases, err := s.clientset.CoordinationV1().Leases(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{shardGroupLabel: s.group}).String(),
+	})
+	if err != nil {
+		log.Errorf("Unable to list the members of shard group %v, keeping the previous members: %v", s.group, err)
+		return
+	}
+	members := []string{}
+	for _, lease := range leases.Items {
+		if lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if time.Now().Before(expires) {
+			members = append(members, *lease.Spec.HolderIdentity)
+		}
+	}
+	sort.Strings(members)
+
+	s.lock.Lock()
+	changed := !reflect.DeepEqual(members, s.members)
+	s.members = members
+	onChange := s.onChange
+	s.lock.Unlock()
+	if changed {
+		log.WithField("members", members).Infof("Shard group %v changed", s.group)
+		metrics.ShardMembers.Set(float64(len(members)))
+		if onChange != nil {
+			onChange()
+		}
+	}
+}
+
+// renew creates or renews the member lease of this replica
+func (s *Shards) renew(ctx context.Context) error {
+	leases := s.clientset.CoordinationV1().Leases(s.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(s.leaseDuration / time.Second)
+	lease, err := leases.Get(ctx, s.leaseName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   s.leaseName(),
+				Labels: map[string]string{shardGroupLabel: s.group, "app.kubernetes.io/name": "ingress-mdns"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &s.identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// leave deletes the member lease, so the other members take over the shard
+// without waiting for the lease to expire
+func (s *Shards) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.leaseDuration/3)
+	defer cancel()
+	if err := s.clientset.CoordinationV1().Leases(s.namespace).Delete(ctx, s.leaseName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		log.Errorf("Unable to delete member lease %v/%v: %v", s.namespace, s.leaseName(), err)
+	}
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/secoya/ingress-mdns/pkg/announce"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Matches the Host() matchers of a Traefik rule, e.g. Host(`a.local`, `b.local`)
+var traefikHostMatcher = regexp.MustCompile("Host\\(([^)]*)\\)")
+
+// The subset of the Traefik IngressRoute type needed to determine hostnames
+type ingressRoute struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		EntryPoints []string `json:"entryPoints"`
+		Routes      []struct {
+			Match string `json:"match"`
+		} `json:"routes"`
+	} `json:"spec"`
+}
+
+// TraefikEntryPoints names the entry points that are served on the cleartext and TLS port
+type TraefikEntryPoints struct {
+	Cleartext string
+	TLS       string
+}
+
+// TraefikSource keeps track of the hostnames registered for each Traefik IngressRoute
+type TraefikSource struct {
+	controller    *Controller
+	entryPoints   TraefikEntryPoints
+	cache         *Cache
+	kind          schema.GroupVersionKind
+	queue         *registrationQueue
+	registrations *objectRegistrations
+}
+
+// NewTraefikSource watches the IngressRoutes of the API group in the cache,
+// traefik.io or the older traefik.containo.us
+func NewTraefikSource(
+	cache *Cache,
+	controller *Controller,
+	group string,
+	entryPoints TraefikEntryPoints,
+) *TraefikSource {
+	t := &TraefikSource{
+		controller:    controller,
+		cache:         cache,
+		kind:          schema.GroupVersionKind{Group: group, Version: "v1alpha1", Kind: "IngressRoute"},
+		entryPoints:   entryPoints,
+		registrations: newObjectRegistrations(controller),
+	}
+	t.queue = newRegistrationQueue("ingressroutes", controller, t.sync)
+	return t
+}
+
+// SetupWithManager adds the controller syncing changed IngressRoutes to the manager
+func (t *TraefikSource) SetupWithManager(mgr manager.Manager) error {
+	log.Debugf("Watching ingressroutes.%v", t.kind.Group)
+	return t.queue.setupWithManager(mgr, t.cache, t.kind, "ingressroutes")
+}
+
+// Resync re-evaluates the hostnames of all IngressRoutes
+func (t *TraefikSource) Resync(force bool) {
+	for _, key := range listKeys(context.Background(), t.cache, t.kind) {
+		t.queue.AddKey(key, force)
+	}
+	t.queue.AddRegistered(t.registrations, force)
+}
+
+func (t *TraefikSource) sync(ctx context.Context, key string, force bool) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	ref := ObjectRef{Kind: "IngressRoute", Namespace: namespace, Name: name}
+	obj, err := getObject(ctx, t.cache, t.kind, key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		t.registrations.Remove(ctx, key, ref)
+		return nil
+	}
+	ref.UID = obj.GetUID()
+	route := &ingressRoute{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, route); err != nil {
+		// Retrying will not make the ingressroute parseable, wait for it to change instead
+		log.Errorf("Unable to parse ingressroute %v: %v", key, err)
+		return nil
+	}
+	return t.registrations.Update(ctx, key, ref, t.getHostnames(route), force)
+}
+
+// getHostnames returns the hosts of the route's Host() matchers, advertised on the
+// cleartext and/or TLS port depending on the entry points of the route
+func (t *TraefikSource) getHostnames(route *ingressRoute) []announce.LocalHostname {
+	hostnames := []announce.LocalHostname{}
+	filter := t.controller.Filter()
+	if !filter.Allows(route) {
+		return hostnames
+	}
+	txt := getTXT(route)
+	if t.controller.PublishMetadata() {
+		txt = withMetadata(txt, ObjectRef{Kind: "IngressRoute", Namespace: route.Namespace, Name: route.Name}, "traefik")
+	}
+	// Routes without entry points are served on all of them
+	entryPoints := route.Spec.EntryPoints
+	if len(entryPoints) == 0 {
+		entryPoints = []string{t.entryPoints.Cleartext, t.entryPoints.TLS}
+	}
+	tlsModes := []bool{}
+	if contains(entryPoints, t.entryPoints.Cleartext) {
+		tlsModes = append(tlsModes, false)
+	}
+	if contains(entryPoints, t.entryPoints.TLS) {
+		tlsModes = append(tlsModes, true)
+	}
+	for _, r := range route.Spec.Routes {
+		for _, host := range parseTraefikHosts(r.Match) {
+			for _, hostname := range filter.Hostnames(host, nil) {
+				for _, tls := range tlsModes {
+					local := announce.LocalHostname{TLS: tls, Hostname: hostname, TXT: txt}
+					if !containsHostname(hostnames, local) {
+						hostnames = append(hostnames, local)
+					}
+				}
+			}
+		}
+	}
+	return withSubtypes(route, withServiceTypes(route, withAliases(route, hostnames)))
+}
+
+// parseTraefikHosts returns the hosts of all Host() matchers in the rule
+func parseTraefikHosts(match string) []string {
+	hosts := []string{}
+	for _, matcher := range traefikHostMatcher.FindAllStringSubmatch(match, -1) {
+		for _, host := range strings.Split(matcher[1], ",") {
+			host = strings.Trim(strings.TrimSpace(host), "`\"")
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
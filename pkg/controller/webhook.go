@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	k8snet "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// IngressWebhook is a validating admission webhook that warns about or rejects
+// Ingresses whose hostnames are already registered for another Ingress
+type IngressWebhook struct {
+	source *IngressSource
+	deny   bool
+}
+
+// NewIngressWebhook validates Ingresses against the registrations of the source,
+// collisions are rejected when deny is set and only warned about otherwise
+func NewIngressWebhook(source *IngressSource, deny bool) *IngressWebhook {
+	return &IngressWebhook{source: source, deny: deny}
+}
+
+// ServeHTTP answers an AdmissionReview
+func (w *IngressWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(rw, fmt.Sprintf("Invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = w.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	resp, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(resp)
+}
+
+func (w *IngressWebhook) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	// The request holds the ingress in the version it was written in
+	obj, _ := newIngressObjects(schema.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version})
+	var ingress *k8snet.Ingress
+	err := json.Unmarshal(req.Object.Raw, obj)
+	if err == nil {
+		ingress, err = toIngress(obj)
+	}
+	if err != nil {
+		// Not ours to reject, the API server validates the object itself
+		log.Warnf("Unable to parse the ingress of admission request %v: %v", req.UID, err)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	if ingress.Namespace == "" {
+		ingress.Namespace = req.Namespace
+	}
+	key := ingress.Namespace + "/" + ingress.Name
+	ref := ObjectRef{Kind: "Ingress", Namespace: ingress.Namespace, Name: ingress.Name}
+	hostnames := w.source.controller.renameHostnames(ref, IngressHostnames(ingress, w.source.controller.Filter(), false))
+	collisions := w.source.registrations.claimedBy(key, hostnames)
+	if len(collisions) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	messages := []string{}
+	for hostname, owner := range collisions {
+		messages = append(messages, fmt.Sprintf("%v.local is already broadcast for ingress %v", hostname, owner))
+	}
+	sort.Strings(messages)
+	log.WithFields(log.Fields{"namespace": ingress.Namespace, "name": ingress.Name}).Warnf("Hostname collision: %v", strings.Join(messages, ", "))
+	if w.deny {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonConflict,
+				Code:    http.StatusConflict,
+				Message: strings.Join(messages, ", "),
+			},
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true, Warnings: messages}
+}
@@ -0,0 +1,158 @@
+// Package metrics holds the Prometheus metrics of ingress-mdns
+package metrics
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The metrics are served by the controller manager together with its workqueue,
+// reconcile and client metrics
+var factory = promauto.With(ctrlmetrics.Registry)
+
+var (
+	RegisteredHostnames = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ingress_mdns_registered_hostnames",
+		Help: "Number of hostnames currently being broadcast",
+	})
+	Registrations = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_mdns_registrations_total",
+		Help: "Number of hostname registrations",
+	})
+	RegistrationFailures = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_mdns_registration_failures_total",
+		Help: "Number of hostname registrations that failed",
+	})
+	Unregistrations = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_mdns_unregistrations_total",
+		Help: "Number of hostname unregistrations",
+	})
+	WatchdogUnresolvable = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ingress_mdns_watchdog_unresolvable_hostnames",
+		Help: "Number of sampled hostnames that could not be resolved by the last watchdog probe",
+	})
+	UnhealthyHostnames = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ingress_mdns_unhealthy_hostnames",
+		Help: "Number of hostnames withdrawn because their target stopped responding to health probes",
+	})
+	ShardMembers = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ingress_mdns_shard_members",
+		Help: "Number of replicas the hostnames are split between with --shard",
+	})
+	watchdogProbes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_watchdog_probes_total",
+		Help: "Number of hostnames resolved by the watchdog, by result",
+	}, []string{"result"})
+	conflicts = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_mdns_conflicts_total",
+		Help: "Number of hostnames other responders answered for when probing",
+	})
+	conflictingAnswers = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_mdns_conflicting_answers_total",
+		Help: "Number of mDNS answers of other responders for the broadcast hostnames",
+	})
+	informerResyncs = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_informer_resyncs_total",
+		Help: "Number of periodic informer resyncs per watched resource",
+	}, []string{"resource"})
+	watchErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_watch_errors_total",
+		Help: "Number of failed informer watches per watched resource",
+	}, []string{"resource"})
+	buildInfo = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ingress_mdns_build_info",
+		Help: "Always 1, labeled with the build metadata of the running binary",
+	}, []string{"version", "commit", "build_date", "go_version"})
+	certificateWarnings = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ingress_mdns_certificate_warnings",
+		Help: "Number of missing, invalid or mismatching certificates of the broadcast TLS hostnames, by reason",
+	}, []string{"reason"})
+	reflectedPackets = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_reflected_packets_total",
+		Help: "Number of mDNS packets relayed by the reflector, by the interface they were sent to",
+	}, []string{"interface"})
+	queries = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_queries_total",
+		Help: "Number of mDNS queries received for the addresses or service instances of the registered hostnames, by hostname",
+	}, []string{"hostname"})
+	announcementErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_mdns_announcement_errors_total",
+		Help: "Number of mDNS packets that could not be sent, by the interface they were sent on",
+	}, []string{"interface"})
+)
+
+// CountResync counts informer updates where the object did not change
+func CountResync(resource string, oldObj interface{}, newObj interface{}) {
+	oldMeta, oldErr := meta.Accessor(oldObj)
+	newMeta, newErr := meta.Accessor(newObj)
+	if oldErr == nil && newErr == nil && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+		informerResyncs.WithLabelValues(resource).Inc()
+	}
+}
+
+// CountWatchError counts a failed list or watch of the resource
+func CountWatchError(resource string) {
+	watchErrors.WithLabelValues(resource).Inc()
+}
+
+// CountWatchdogProbe counts a hostname the watchdog tried to resolve
+func CountWatchdogProbe(resolved bool) {
+	result := "resolved"
+	if !resolved {
+		result = "unresolvable"
+	}
+	watchdogProbes.WithLabelValues(result).Inc()
+}
+
+// CountConflict counts a hostname another responder answered a probe for
+func CountConflict() {
+	conflicts.Inc()
+}
+
+// CountConflictingAnswer counts an answer another responder sent for a broadcast hostname
+func CountConflictingAnswer() {
+	conflictingAnswers.Inc()
+}
+
+// SetCertificateWarnings publishes the number of certificate warnings of the reason
+func SetCertificateWarnings(reason string, count int) {
+	certificateWarnings.WithLabelValues(reason).Set(float64(count))
+}
+
+// CountReflectedPacket counts a packet the reflector sent to the interface
+func CountReflectedPacket(iface string) {
+	reflectedPackets.WithLabelValues(iface).Inc()
+}
+
+// CountQuery counts a query received for the hostname
+func CountQuery(hostname string) {
+	queries.WithLabelValues(hostname).Inc()
+}
+
+// ForgetQueries removes the query count of a hostname that is no longer registered
+func ForgetQueries(hostname string) {
+	queries.DeleteLabelValues(hostname)
+}
+
+// SetBuildInfo publishes the build metadata
+func SetBuildInfo(version string, commit string, buildDate string, goVersion string) {
+	buildInfo.WithLabelValues(version, commit, buildDate, goVersion).Set(1)
+}
+
+// CountAnnouncementError counts packets that could not be sent on the interface with
+// the index, packets sent to the relay peers are counted under their interface as well
+func CountAnnouncementError(ifIndex int, err error) {
+	if err == nil {
+		return
+	}
+	name := strconv.Itoa(ifIndex)
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+		name = iface.Name
+	}
+	announcementErrors.WithLabelValues(name).Inc()
+}
@@ -0,0 +1,536 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/secoya/ingress-mdns/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How long announcements are collected before they are sent in combined packets
+	batchDelay = time.Millisecond * 100
+	// Size of the IPv6 and UDP headers subtracted from the MTU of the interface
+	packetOverhead = 48
+	// Packet size when the MTU of the interface is unknown
+	defaultPacketSize = 1452
+)
+
+// Responder owns the multicast connections shared by any number of servers, the
+// queries it receives are handled by every server registered on the interface
+type Responder struct {
+	ipv4conn *ipv4.PacketConn
+	ipv6conn *ipv6.PacketConn
+
+	lock    sync.RWMutex
+	servers map[*Server]bool
+	limiter *rate.Limiter
+	// Limits the queries logged by the query log, no queries are logged when nil
+	queryLog *rate.Limiter
+	// Queries that were not logged since the last logged query
+	droppedQueries int
+	// Peers sent a unicast copy of the packets of the first interface
+	peers      []*net.UDPAddr
+	relayIndex int
+	// Announced records waiting for the batch to be sent by interface index,
+	// with the positions of the records by recordKey
+	pending        map[int][]dns.RR
+	pendingIndex   map[int]map[string]int
+	flushTimer     *time.Timer
+	shouldShutdown chan struct{}
+	shutdownEnd    sync.WaitGroup
+	isShutdown     bool
+}
+
+// NewResponder joins the multicast groups of the enabled IP versions on the
+// interfaces and starts receiving queries
+func NewResponder(ifaces []net.Interface, v4 bool, v6 bool) (*Responder, error) {
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces()
+	}
+	r := &Responder{
+		servers:        map[*Server]bool{},
+		pending:        map[int][]dns.RR{},
+		pendingIndex:   map[int]map[string]int{},
+		shouldShutdown: make(chan struct{}),
+	}
+	if len(ifaces) > 0 {
+		r.relayIndex = ifaces[0].Index
+	}
+	err4 := errors.New("IPv4 disabled")
+	err6 := errors.New("IPv6 disabled")
+	if v4 {
+		r.ipv4conn, err4 = joinUdp4Multicast(ifaces)
+		if err4 != nil {
+			log.Errorf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+		}
+	}
+	if v6 {
+		r.ipv6conn, err6 = joinUdp6Multicast(ifaces)
+		if err6 != nil {
+			log.Errorf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+		}
+	}
+	if err4 != nil && err6 != nil {
+		return nil, fmt.Errorf("No supported interface")
+	}
+	if r.ipv4conn != nil {
+		r.shutdownEnd.Add(1)
+		go r.recv(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := r.ipv4conn.ReadFrom(buf)
+			if cm != nil {
+				return n, cm.IfIndex, from, err
+			}
+			return n, 0, from, err
+		})
+	}
+	if r.ipv6conn != nil {
+		r.shutdownEnd.Add(1)
+		go r.recv(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := r.ipv6conn.ReadFrom(buf)
+			if cm != nil {
+				return n, cm.IfIndex, from, err
+			}
+			return n, 0, from, err
+		})
+	}
+	return r, nil
+}
+
+// NewSharedServer is like NewProxyServer, but the server answers queries and sends
+// its announcements through the connections of the responder
+func NewSharedServer(responder *Responder, instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface) (*Server, error) {
+	entry, err := newProxyEntry(instance, service, domain, port, host, ips, text)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		service:        entry,
+		ipv4conn:       responder.ipv4conn,
+		ipv6conn:       responder.ipv6conn,
+		ifaces:         ifaces,
+		ttl:            3200,
+		shouldShutdown: make(chan struct{}),
+		responder:      responder,
+	}, nil
+}
+
+// Servers returns the number of servers registered with the responder
+func (r *Responder) Servers() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.servers)
+}
+
+// RateLimit makes the responder wait for the limiter before sending each batch
+// packet, the limiter may be shared with the servers
+func (r *Responder) RateLimit(limiter *rate.Limiter) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.limiter = limiter
+}
+
+// LogQueries logs the queries for the host and service instance names of the
+// servers with the client's address, as many as the limiter allows
+func (r *Responder) LogQueries(limiter *rate.Limiter) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queryLog = limiter
+}
+
+// RelayTo additionally sends the announcements and answers of the first interface
+// as unicast packets to the peers, e.g. clients behind a VPN without multicast.
+// Only the first interface is relayed as the records of the other interfaces
+// would flush its addresses from the caches of the peers.
+func (r *Responder) RelayTo(peers []*net.UDPAddr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.peers = peers
+}
+
+// relay sends the packet to the peers when it was sent on the relayed interface
+func (r *Responder) relay(buf []byte, ifIndex int) {
+	r.lock.RLock()
+	peers := r.peers
+	relayed := ifIndex == 0 || ifIndex == r.relayIndex
+	r.lock.RUnlock()
+	if !relayed {
+		return
+	}
+	for _, peer := range peers {
+		var err error
+		if peer.IP.To4() != nil && r.ipv4conn != nil {
+			_, err = r.ipv4conn.WriteTo(buf, nil, peer)
+		} else if r.ipv6conn != nil {
+			_, err = r.ipv6conn.WriteTo(buf, nil, peer)
+		}
+		if err != nil {
+			log.Debugf("[ERR] zeroconf: failed to relay to %v: %v", peer, err)
+		}
+		metrics.CountAnnouncementError(ifIndex, err)
+	}
+}
+
+// Shutdown sends the pending announcements and closes the connections, the servers
+// should be shut down before so their goodbye packets are sent. It fails when
+// some of the pending packets could not be sent.
+func (r *Responder) Shutdown() error {
+	r.lock.Lock()
+	if r.isShutdown {
+		r.lock.Unlock()
+		return nil
+	}
+	r.isShutdown = true
+	r.servers = map[*Server]bool{}
+	r.lock.Unlock()
+	sent, failed := r.flush()
+	close(r.shouldShutdown)
+	if r.ipv4conn != nil {
+		r.ipv4conn.Close()
+	}
+	if r.ipv6conn != nil {
+		r.ipv6conn.Close()
+	}
+	r.shutdownEnd.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packets could not be sent", failed, sent+failed)
+	}
+	log.Debugf("[zeroconf] sent %d packets before shutting down", sent)
+	return nil
+}
+
+// Rejoin joins the multicast groups on the interface again, e.g. after it went down
+// or its addresses changed, memberships the kernel still has are left first
+func (r *Responder) Rejoin(iface net.Interface) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		return nil
+	}
+	joined := 0
+	var lastErr error
+	if r.ipv4conn != nil {
+		group := &net.UDPAddr{IP: mdnsGroupIPv4}
+		r.ipv4conn.LeaveGroup(&iface, group)
+		if lastErr = r.ipv4conn.JoinGroup(&iface, group); lastErr == nil {
+			joined++
+		}
+	}
+	if r.ipv6conn != nil {
+		group := &net.UDPAddr{IP: mdnsGroupIPv6}
+		r.ipv6conn.LeaveGroup(&iface, group)
+		if err := r.ipv6conn.JoinGroup(&iface, group); err == nil {
+			joined++
+		} else {
+			lastErr = err
+		}
+	}
+	if joined == 0 && lastErr != nil {
+		return fmt.Errorf("Unable to join the mDNS group on %v: %v", iface.Name, lastErr)
+	}
+	return nil
+}
+
+func (r *Responder) add(s *Server) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.servers[s] = true
+}
+
+func (r *Responder) remove(s *Server) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.servers, s)
+}
+
+// servedRecords returns the recordKeys of the records the servers other than
+// except answer with on the interface
+func (r *Responder) servedRecords(except *Server, ifIndex int) map[string]bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	served := map[string]bool{}
+	for s := range r.servers {
+		if s == except || !s.hasInterface(ifIndex) {
+			continue
+		}
+		resp := new(dns.Msg)
+		s.composeLookupAnswers(resp, 0, ifIndex, true)
+		for _, record := range resp.Answer {
+			served[recordKey(record)] = true
+		}
+	}
+	return served
+}
+
+// recv is a long running routine receiving the packets of one connection
+func (r *Responder) recv(read func(buf []byte) (int, int, net.Addr, error)) {
+	defer r.shutdownEnd.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, from, err := read(buf)
+		if err != nil {
+			select {
+			case <-r.shouldShutdown:
+				return
+			default:
+				continue
+			}
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil {
+			log.Debugf("[ERR] zeroconf: Failed to unpack packet: %v", err)
+			continue
+		}
+		r.lock.RLock()
+		servers := make([]*Server, 0, len(r.servers))
+		for s := range r.servers {
+			if ifIndex == 0 || s.hasInterface(ifIndex) {
+				servers = append(servers, s)
+			}
+		}
+		r.lock.RUnlock()
+		r.countQueries(&msg, servers, ifIndex, from)
+		if err := r.enumerateServiceTypes(&msg, servers, ifIndex, from); err != nil {
+			log.Debugf("[ERR] zeroconf: failed to answer service type enumeration: %v", err)
+		}
+		for _, s := range servers {
+			if err := s.handleQuery(&msg, ifIndex, from); err != nil {
+				log.Debugf("[ERR] zeroconf: failed to handle query: %v", err)
+			}
+		}
+	}
+}
+
+// countQueries counts the questions for the host and service instance names of the
+// servers once per hostname and logs them with the query log, browses for a
+// service type are not counted
+func (r *Responder) countQueries(query *dns.Msg, servers []*Server, ifIndex int, from net.Addr) {
+	if query.Response {
+		return
+	}
+	counted := map[string]bool{}
+	for _, q := range query.Question {
+		for _, s := range servers {
+			if !strings.EqualFold(q.Name, s.service.HostName) && !strings.EqualFold(q.Name, s.service.ServiceInstanceName()) {
+				continue
+			}
+			hostname := strings.TrimSuffix(s.service.HostName, "."+trimDot(s.service.Domain)+".")
+			if !counted[hostname] {
+				counted[hostname] = true
+				metrics.CountQuery(hostname)
+				r.logQuery(q, hostname, ifIndex, from)
+			}
+		}
+	}
+}
+
+// logQuery logs the question unless the query log is disabled or its limit is
+// exceeded, the number of queries left out is logged with the next one
+func (r *Responder) logQuery(q dns.Question, hostname string, ifIndex int, from net.Addr) {
+	r.lock.Lock()
+	if r.queryLog == nil {
+		r.lock.Unlock()
+		return
+	}
+	if !r.queryLog.Allow() {
+		r.droppedQueries++
+		r.lock.Unlock()
+		return
+	}
+	dropped := r.droppedQueries
+	r.droppedQueries = 0
+	r.lock.Unlock()
+
+	fields := log.Fields{"client": from.String(), "name": q.Name, "type": dns.TypeToString[q.Qtype], "hostname": hostname}
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+		fields["interface"] = iface.Name
+	}
+	if dropped > 0 {
+		fields["dropped"] = dropped
+	}
+	log.WithFields(fields).Info("Query received")
+}
+
+// enumerateServiceTypes answers the _services._dns-sd._udp meta-query with a single
+// response listing the distinct service types of the servers on the interface,
+// instead of every server answering with its own type
+func (r *Responder) enumerateServiceTypes(query *dns.Msg, servers []*Server, ifIndex int, from net.Addr) error {
+	if len(servers) == 0 || len(query.Ns) > 0 {
+		return nil
+	}
+	for _, q := range query.Question {
+		if q.Name != servers[0].service.ServiceTypeName() || (q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY) {
+			continue
+		}
+		resp := dns.Msg{}
+		resp.SetReply(query)
+		resp.Compress = true
+		resp.RecursionDesired = false
+		resp.Authoritative = true
+		resp.Question = nil
+		types := map[string]bool{}
+		for _, s := range servers {
+			if types[s.service.ServiceName()] {
+				continue
+			}
+			types[s.service.ServiceName()] = true
+			ptr := &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   s.service.ServiceTypeName(),
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    s.ttl,
+				},
+				Ptr: s.service.ServiceName(),
+			}
+			if !isKnownRecord(ptr, query) {
+				resp.Answer = append(resp.Answer, ptr)
+			}
+		}
+		if len(resp.Answer) == 0 {
+			continue
+		}
+		if isUnicastQuestion(q) {
+			return servers[0].unicastResponse(&resp, ifIndex, from)
+		}
+		return servers[0].multicastResponse(&resp, ifIndex)
+	}
+	return nil
+}
+
+// queue adds announced records to the batch of the interface, a record that is
+// already pending is replaced so e.g. a goodbye followed by an announcement of
+// the same record only sends the announcement
+func (r *Responder) queue(ifIndex int, records []dns.RR) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		return
+	}
+	pending := r.pending[ifIndex]
+	index, exists := r.pendingIndex[ifIndex]
+	if !exists {
+		index = map[string]int{}
+		r.pendingIndex[ifIndex] = index
+	}
+	for _, record := range records {
+		key := recordKey(record)
+		if i, exists := index[key]; exists {
+			pending[i] = record
+			continue
+		}
+		index[key] = len(pending)
+		pending = append(pending, record)
+	}
+	r.pending[ifIndex] = pending
+	if r.flushTimer == nil {
+		r.flushTimer = time.AfterFunc(batchDelay, func() { r.flush() })
+	}
+}
+
+// flush sends the pending records of every interface in as few packets as fit
+// the MTU of the interface, it returns the number of packets sent and failed
+func (r *Responder) flush() (int, int) {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = map[int][]dns.RR{}
+	r.pendingIndex = map[int]map[string]int{}
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+	limiter := r.limiter
+	r.lock.Unlock()
+	sent, failed := 0, 0
+	for ifIndex, records := range pending {
+		for _, msg := range packRecords(records, packetSize(ifIndex)) {
+			buf, err := msg.Pack()
+			if err != nil {
+				log.Debugf("[ERR] zeroconf: failed to pack announcement: %v", err)
+				failed++
+				continue
+			}
+			packetsSent, packetsFailed := r.multicast(buf, ifIndex, limiter)
+			sent += packetsSent
+			failed += packetsFailed
+		}
+	}
+	return sent, failed
+}
+
+// multicast sends the packet on the interface over both connections and returns
+// the number of packets sent and failed
+func (r *Responder) multicast(buf []byte, ifIndex int, limiter *rate.Limiter) (int, int) {
+	sent, failed := 0, 0
+	count := func(_ int, err error) {
+		metrics.CountAnnouncementError(ifIndex, err)
+		if err != nil {
+			log.Debugf("[ERR] zeroconf: failed to send announcement: %v", err)
+			failed++
+		} else {
+			sent++
+		}
+	}
+	if r.ipv4conn != nil {
+		if limiter != nil {
+			limiter.Wait(context.Background())
+		}
+		count(r.ipv4conn.WriteTo(buf, &ipv4.ControlMessage{IfIndex: ifIndex}, ipv4Addr))
+	}
+	if r.ipv6conn != nil {
+		if limiter != nil {
+			limiter.Wait(context.Background())
+		}
+		count(r.ipv6conn.WriteTo(buf, &ipv6.ControlMessage{IfIndex: ifIndex}, ipv6Addr))
+	}
+	r.relay(buf, ifIndex)
+	return sent, failed
+}
+
+// packRecords splits the records into unsolicited responses of at most size bytes,
+// a single record exceeding the size is sent on its own
+func packRecords(records []dns.RR, size int) []*dns.Msg {
+	msgs := []*dns.Msg{}
+	var msg *dns.Msg
+	for _, record := range records {
+		if msg != nil {
+			msg.Answer = append(msg.Answer, record)
+			if msg.Len() <= size {
+				continue
+			}
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+		}
+		msg = new(dns.Msg)
+		msg.MsgHdr.Response = true
+		msg.Compress = true
+		msg.Answer = []dns.RR{record}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// packetSize returns the largest packet that fits the MTU of the interface
+func packetSize(ifIndex int) int {
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil || iface.MTU <= packetOverhead {
+		return defaultPacketSize
+	}
+	return iface.MTU - packetOverhead
+}
+
+// recordKey identifies a record regardless of its TTL
+func recordKey(record dns.RR) string {
+	copied := dns.Copy(record)
+	copied.Header().Ttl = 0
+	return copied.String()
+}
@@ -1,4 +1,4 @@
-package main
+package zeroconf
 
 // source: https://github.com/grandcat/zeroconf
 
@@ -30,6 +30,7 @@ package main
 // SOFTWARE.
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -39,11 +40,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/secoya/ingress-mdns/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/miekg/dns"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -97,7 +100,7 @@ func Register(instance, service, domain string, port int, text []string, ifaces
 		return nil, fmt.Errorf("Could not determine host IP addresses")
 	}
 
-	s, err := newServer(ifaces)
+	s, err := newServer(ifaces, true, true)
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +115,38 @@ func Register(instance, service, domain string, port int, text []string, ifaces
 // RegisterProxy registers a service proxy. This call will skip the hostname/IP lookup and
 // will use the provided values.
 func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface) (*Server, error) {
+	s, err := NewProxyServer(instance, service, domain, port, host, ips, text, ifaces)
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	return s, nil
+}
+
+// NewProxyServer is like RegisterProxy, but does not start the server.
+// This allows configuring the server with e.g. TTL before calling Start.
+func NewProxyServer(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface) (*Server, error) {
+	entry, err := newProxyEntry(instance, service, domain, port, host, ips, text)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ifaces) == 0 {
+		ifaces = listMulticastInterfaces()
+	}
+
+	// Only join the multicast groups of the IP versions that are published
+	s, err := newServer(ifaces, entry.AddrIPv4 != nil, entry.AddrIPv6 != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.service = entry
+	return s, nil
+}
+
+// newProxyEntry validates the arguments of a service proxy and constructs its entry
+func newProxyEntry(instance, service, domain string, port int, host string, ips []string, text []string) (*ServiceEntry, error) {
 	entry := NewServiceEntry(instance, service, domain)
 	entry.Port = port
 	entry.Text = text
@@ -150,20 +185,21 @@ func RegisterProxy(instance, service, domain string, port int, host string, ips
 		}
 	}
 
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+	if entry.AddrIPv4 == nil && entry.AddrIPv6 == nil {
+		return nil, fmt.Errorf("Missing host IP addresses")
 	}
+	return entry, nil
+}
 
-	s, err := newServer(ifaces)
-	if err != nil {
-		return nil, err
+// Start listens for queries and announces the service, servers of a responder
+// receive the queries of the responder instead
+func (s *Server) Start() {
+	if s.responder != nil {
+		s.responder.add(s)
+	} else {
+		go s.mainloop()
 	}
-
-	s.service = entry
-	go s.mainloop()
 	go s.probe()
-
-	return s, nil
 }
 
 const (
@@ -182,17 +218,29 @@ type Server struct {
 	shutdownEnd    sync.WaitGroup
 	isShutdown     bool
 	ttl            uint32
+	reverse        bool
+	limiter        *rate.Limiter
+	// The responder owning the connections, nil when the server has its own
+	responder *Responder
 }
 
 // Constructs server structure
-func newServer(ifaces []net.Interface) (*Server, error) {
-	ipv4conn, err4 := joinUdp4Multicast(ifaces)
-	if err4 != nil {
-		log.Errorf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+func newServer(ifaces []net.Interface, v4 bool, v6 bool) (*Server, error) {
+	var ipv4conn *ipv4.PacketConn
+	var ipv6conn *ipv6.PacketConn
+	err4 := errors.New("IPv4 disabled")
+	err6 := errors.New("IPv6 disabled")
+	if v4 {
+		ipv4conn, err4 = joinUdp4Multicast(ifaces)
+		if err4 != nil {
+			log.Errorf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+		}
 	}
-	ipv6conn, err6 := joinUdp6Multicast(ifaces)
-	if err6 != nil {
-		log.Errorf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+	if v6 {
+		ipv6conn, err6 = joinUdp6Multicast(ifaces)
+		if err6 != nil {
+			log.Errorf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+		}
 	}
 	if err4 != nil && err6 != nil {
 		// No supported interface left.
@@ -236,6 +284,17 @@ func (s *Server) TTL(ttl uint32) {
 	s.ttl = ttl
 }
 
+// PublishReverse makes the server answer reverse lookups of its IPs with its hostname
+func (s *Server) PublishReverse(enabled bool) {
+	s.reverse = enabled
+}
+
+// RateLimit makes the server wait for the limiter before sending each multicast
+// packet, the limiter may be shared by several servers
+func (s *Server) RateLimit(limiter *rate.Limiter) {
+	s.limiter = limiter
+}
+
 // Shutdown server will close currently open connections & channel
 func (s *Server) shutdown() error {
 	s.shutdownLock.Lock()
@@ -248,6 +307,11 @@ func (s *Server) shutdown() error {
 
 	close(s.shouldShutdown)
 
+	if s.responder != nil {
+		s.responder.remove(s)
+		s.isShutdown = true
+		return err
+	}
 	if s.ipv4conn != nil {
 		s.ipv4conn.Close()
 	}
@@ -320,6 +384,10 @@ func (s *Server) recv6(c *ipv6.PacketConn) {
 
 // parsePacket is used to parse an incoming packet
 func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
+	// The socket may receive packets from interfaces the server is not registered on
+	if ifIndex != 0 && !s.hasInterface(ifIndex) {
+		return nil
+	}
 	var msg dns.Msg
 	if err := msg.Unpack(packet); err != nil {
 		log.Debug("[ERR] zeroconf: Failed to unpack packet: %v", err)
@@ -328,6 +396,15 @@ func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
 	return s.handleQuery(&msg, ifIndex, from)
 }
 
+func (s *Server) hasInterface(ifIndex int) bool {
+	for _, iface := range s.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
 // handleQuery is used to handle an incoming query
 func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
 	// Ignore questions with authoritative section for now
@@ -380,8 +457,12 @@ func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
 	if resp.Answer[0].Header().Rrtype != dns.TypePTR {
 		return false
 	}
-	answer := resp.Answer[0].(*dns.PTR)
+	return isKnownRecord(resp.Answer[0].(*dns.PTR), query)
+}
 
+// isKnownRecord returns whether the query lists the PTR record as a known answer
+// with at least half of its TTL remaining
+func isKnownRecord(answer *dns.PTR, query *dns.Msg) bool {
 	for _, known := range query.Answer {
 		hdr := known.Header()
 		if hdr.Rrtype != answer.Hdr.Rrtype {
@@ -405,13 +486,17 @@ func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, i
 
 	switch q.Name {
 	case s.service.ServiceTypeName():
+		if s.responder != nil {
+			// Answered once for all servers by the responder
+			break
+		}
 		s.serviceTypeName(resp, s.ttl)
 		if isKnownAnswer(resp, query) {
 			resp.Answer = nil
 		}
 
 	case s.service.ServiceName():
-		s.composeBrowsingAnswers(resp, ifIndex)
+		s.composeBrowsingAnswers(resp, s.service.ServiceName(), ifIndex)
 		if isKnownAnswer(resp, query) {
 			resp.Answer = nil
 		}
@@ -421,11 +506,14 @@ func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, i
 	case s.service.HostName:
 		s.composeLookupAnswers(resp, s.ttl, ifIndex, false)
 	default:
-		// handle matching subtype query
+		if s.reverse && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) && s.composeReverseAnswers(resp, q.Name) {
+			break
+		}
+		// handle matching subtype query, the subtypes are complete names
+		// (e.g. _printer._sub._http._tcp.local.)
 		for _, subtype := range s.service.Subtypes {
-			subtype = fmt.Sprintf("%s._sub.%s", subtype, s.service.ServiceName())
 			if q.Name == subtype {
-				s.composeBrowsingAnswers(resp, ifIndex)
+				s.composeBrowsingAnswers(resp, subtype, ifIndex)
 				if isKnownAnswer(resp, query) {
 					resp.Answer = nil
 				}
@@ -437,10 +525,12 @@ func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, i
 	return nil
 }
 
-func (s *Server) composeBrowsingAnswers(resp *dns.Msg, ifIndex int) {
+// composeBrowsingAnswers answers a browse for the service or one of its subtypes,
+// the PTR record has the name that was browsed for
+func (s *Server) composeBrowsingAnswers(resp *dns.Msg, name string, ifIndex int) {
 	ptr := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
+			Name:   name,
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
@@ -595,7 +685,9 @@ func (s *Server) probe() {
 		if err := s.multicastResponse(q, 0); err != nil {
 			log.Println("[ERR] zeroconf: failed to send probe:", err.Error())
 		}
-		time.Sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond)
+		if !s.sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond) {
+			return
+		}
 	}
 
 	// From RFC6762
@@ -606,20 +698,53 @@ func (s *Server) probe() {
 	//    at least a factor of two with every response sent.
 	timeout := 1 * time.Second
 	for i := 0; i < multicastRepetitions; i++ {
-		for _, intf := range s.ifaces {
+		s.Announce()
+		if !s.sleep(timeout) {
+			return
+		}
+		timeout *= 2
+	}
+}
+
+// sleep waits for the duration, it returns false once the server was shut down, so
+// a server probing on the shared connections sends nothing after its goodbye packets
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.shouldShutdown:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Announce sends an unsolicited response with all records on every interface,
+// servers of a responder add the records to the responder's next batch. A server
+// that was shut down announces nothing.
+func (s *Server) Announce() {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return
+	}
+	for _, intf := range s.ifaces {
+		if s.responder != nil {
 			resp := new(dns.Msg)
-			resp.MsgHdr.Response = true
-			// TODO: make response authoritative if we are the publisher
-			resp.Compress = true
-			resp.Answer = []dns.RR{}
-			resp.Extra = []dns.RR{}
 			s.composeLookupAnswers(resp, s.ttl, intf.Index, true)
-			if err := s.multicastResponse(resp, intf.Index); err != nil {
-				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
-			}
+			s.responder.queue(intf.Index, resp.Answer)
+			continue
+		}
+		resp := new(dns.Msg)
+		resp.MsgHdr.Response = true
+		// TODO: make response authoritative if we are the publisher
+		resp.Compress = true
+		resp.Answer = []dns.RR{}
+		resp.Extra = []dns.RR{}
+		s.composeLookupAnswers(resp, s.ttl, intf.Index, true)
+		if err := s.multicastResponse(resp, intf.Index); err != nil {
+			log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
 		}
-		time.Sleep(timeout)
-		timeout *= 2
 	}
 }
 
@@ -642,7 +767,27 @@ func (s *Server) announceText() {
 	s.multicastResponse(resp, 0)
 }
 
+// unregister sends the goodbye packets of the records, servers of a responder leave
+// out the records other servers still answer with, e.g. the address records of
+// the TLS service of a hostname whose cleartext service is unregistered
 func (s *Server) unregister() error {
+	if s.responder != nil {
+		for _, intf := range s.ifaces {
+			resp := new(dns.Msg)
+			s.composeLookupAnswers(resp, 0, intf.Index, true)
+			served := s.responder.servedRecords(s, intf.Index)
+			goodbyes := []dns.RR{}
+			for _, record := range resp.Answer {
+				if !served[recordKey(record)] {
+					goodbyes = append(goodbyes, record)
+				}
+			}
+			if len(goodbyes) > 0 {
+				s.responder.queue(intf.Index, goodbyes)
+			}
+		}
+		return nil
+	}
 	resp := new(dns.Msg)
 	resp.MsgHdr.Response = true
 	resp.Answer = []dns.RR{}
@@ -651,6 +796,33 @@ func (s *Server) unregister() error {
 	return s.multicastResponse(resp, 0)
 }
 
+// composeReverseAnswers answers a reverse lookup of one of the IPs of the service,
+// the records are shared since other hostnames may resolve to the same IP
+func (s *Server) composeReverseAnswers(resp *dns.Msg, name string) bool {
+	ttl := s.ttl
+	if ttl > 120 {
+		ttl = 120
+	}
+	ips := append(append([]net.IP{}, s.service.AddrIPv4...), s.service.AddrIPv6...)
+	for _, ip := range ips {
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil || !strings.EqualFold(reverse, name) {
+			continue
+		}
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: s.service.HostName,
+		})
+		return true
+	}
+	return false
+}
+
 func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache bool) []dns.RR {
 	v4 := s.service.AddrIPv4
 	v6 := s.service.AddrIPv6
@@ -662,7 +834,7 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 			v6 = append(v6, a6...)
 		}
 	}
-	if ttl > 0 {
+	if ttl > 120 {
 		// RFC6762 Section 10 says A/AAAA records SHOULD
 		// use TTL of 120s, to account for network interface
 		// and IP address changes.
@@ -750,6 +922,13 @@ func (s *Server) unicastResponse(resp *dns.Msg, ifIndex int, from net.Addr) erro
 	}
 }
 
+// waitForLimiter blocks until the rate limiter allows sending another packet
+func (s *Server) waitForLimiter() {
+	if s.limiter != nil {
+		s.limiter.Wait(context.Background())
+	}
+}
+
 // multicastResponse us used to send a multicast response packet
 func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
 	buf, err := msg.Pack()
@@ -760,11 +939,15 @@ func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
 		var wcm ipv4.ControlMessage
 		if ifIndex != 0 {
 			wcm.IfIndex = ifIndex
-			s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+			s.waitForLimiter()
+			_, err := s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+			metrics.CountAnnouncementError(wcm.IfIndex, err)
 		} else {
 			for _, intf := range s.ifaces {
 				wcm.IfIndex = intf.Index
-				s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+				s.waitForLimiter()
+				_, err := s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+				metrics.CountAnnouncementError(wcm.IfIndex, err)
 			}
 		}
 	}
@@ -773,14 +956,21 @@ func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
 		var wcm ipv6.ControlMessage
 		if ifIndex != 0 {
 			wcm.IfIndex = ifIndex
-			s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+			s.waitForLimiter()
+			_, err := s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+			metrics.CountAnnouncementError(wcm.IfIndex, err)
 		} else {
 			for _, intf := range s.ifaces {
 				wcm.IfIndex = intf.Index
-				s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+				s.waitForLimiter()
+				_, err := s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+				metrics.CountAnnouncementError(wcm.IfIndex, err)
 			}
 		}
 	}
+	if s.responder != nil {
+		s.responder.relay(buf, ifIndex)
+	}
 	return nil
 }
 
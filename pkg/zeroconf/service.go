@@ -1,4 +1,4 @@
-package main
+package zeroconf
 
 // source: https://github.com/grandcat/zeroconf
 